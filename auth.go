@@ -0,0 +1,279 @@
+package minioproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// What API keys can be used for
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeDelete = "delete"
+	ScopeList   = "list"
+)
+
+var errUnauthenticated = errors.New("missing or invalid API key or token")
+var errAccessDenied = errors.New("access denied")
+
+// API key clients authenticate with, sent in X-Api-Key header or as a bearer
+// token
+type APIKey struct {
+	// name of the client, used in logs
+	ID string `json:"id"`
+	// hex encoded SHA-256 of the key, keys themselves are not stored
+	Hash string `json:"hash"`
+	// Scope* constants
+	Scopes []string `json:"scopes"`
+	// files the key can access, all when empty
+	Prefixes []string `json:"prefixes,omitempty"`
+	// files of the key are kept apart from other tenants when set
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Authenticated client
+type principal struct {
+	id string
+	// empty when the client is not a tenant
+	tenant   string
+	scopes   map[string]bool
+	prefixes []string
+	// authorized by a signed link, policies were checked when it was made
+	signed bool
+	// constraints of the upload when authorized by an upload ticket
+	ticket *uploadTicket
+}
+
+type principalKey struct{}
+
+func (p *principal) hasScope(scope string) bool {
+	return p.scopes[scope]
+}
+
+func (p *principal) allows(scope, key string) bool {
+	if !p.hasScope(scope) {
+		return false
+	}
+	if len(p.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type authenticator struct {
+	// by hash of the key
+	keys map[string]*principal
+	// nil when JWTs are not accepted
+	jwt *jwtVerifier
+	// every client has to be a tenant, otherwise it could see files of all
+	// tenants kept in the default bucket
+	tenants bool
+}
+
+// Returns nil when there are no keys and JWTs are not accepted,
+// authentication is disabled then
+func newAuthenticator(cfg Config) (*authenticator, error) {
+	keys := cfg.APIKeys
+	if len(cfg.APIKeysFile) > 0 {
+		data, err := os.ReadFile(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		var fileKeys []APIKey
+		if err := json.Unmarshal(data, &fileKeys); err != nil {
+			return nil, fmt.Errorf("invalid API keys file %s: %w", cfg.APIKeysFile, err)
+		}
+		keys = append(append([]APIKey{}, keys...), fileKeys...)
+	}
+	if len(keys) == 0 && len(cfg.JWT.JWKS) == 0 {
+		return nil, nil
+	}
+
+	auth := &authenticator{keys: make(map[string]*principal, len(keys))}
+	auth.tenants = len(cfg.Tenants) > 0 || len(cfg.JWT.TenantClaim) > 0
+	for _, key := range keys {
+		auth.tenants = auth.tenants || len(key.Tenant) > 0
+	}
+	for _, key := range keys {
+		if err := key.validate(); err != nil {
+			return nil, err
+		}
+		if auth.tenants && len(key.Tenant) == 0 {
+			return nil, fmt.Errorf("API key %s: %w", key.ID, errNoTenant)
+		}
+		p := newPrincipal(key.ID, key.Scopes, key.Prefixes)
+		p.tenant = key.Tenant
+		auth.keys[strings.ToLower(key.Hash)] = p
+	}
+
+	if len(cfg.JWT.JWKS) > 0 {
+		if auth.tenants && len(cfg.JWT.TenantClaim) == 0 {
+			return nil, fmt.Errorf("JWT TenantClaim is missing: %w", errNoTenant)
+		}
+		var err error
+		if auth.jwt, err = newJWTVerifier(cfg.JWT); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+func newPrincipal(id string, scopes, prefixes []string) *principal {
+	p := &principal{id: id, scopes: make(map[string]bool), prefixes: prefixes}
+	for _, scope := range scopes {
+		p.scopes[scope] = true
+	}
+	return p
+}
+
+func (k APIKey) validate() error {
+	if len(k.ID) == 0 {
+		return errors.New("API key is missing an id")
+	}
+	if hash, err := hex.DecodeString(k.Hash); err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("API key %s: hash has to be hex encoded SHA-256", k.ID)
+	}
+	for _, scope := range k.Scopes {
+		if !isScope(scope) {
+			return fmt.Errorf("API key %s: unknown scope %q", k.ID, scope)
+		}
+	}
+	if len(k.Tenant) > 0 {
+		if err := validateTenantID(k.Tenant); err != nil {
+			return fmt.Errorf("API key %s: %w", k.ID, err)
+		}
+	}
+	return nil
+}
+
+func isScope(scope string) bool {
+	switch scope {
+	case ScopeRead, ScopeWrite, ScopeDelete, ScopeList:
+		return true
+	}
+	return false
+}
+
+// Bearer tokens which look like JWTs are verified as such when enabled, other
+// ones are treated as API keys
+func (a *authenticator) authenticate(r *http.Request) (*principal, error) {
+	key := r.Header.Get("X-Api-Key")
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && len(key) == 0 {
+		if a.jwt != nil && strings.Count(token, ".") == 2 {
+			return a.jwt.Verify(token)
+		}
+		key = token
+	}
+	if len(key) == 0 {
+		return nil, errUnauthenticated
+	}
+
+	// keys are random so looking up their hash doesn't leak anything useful
+	hash := sha256.Sum256([]byte(key))
+	if p, ok := a.keys[hex.EncodeToString(hash[:])]; ok {
+		return p, nil
+	}
+	return nil, errUnauthenticated
+}
+
+// Middleware rejecting requests without a valid API key, JWT, share link or
+// upload ticket, health checks and OPTIONS requests don't need one
+func (app *App) authenticate(next http.Handler) http.Handler {
+	next = app.requireTenant(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.shares != nil && r.URL.Query().Has("ticket") {
+			app.serveUploadTicket(w, r, next)
+			return
+		}
+		if app.shares != nil && r.URL.Query().Has("signature") {
+			app.serveShareLink(w, r, next)
+			return
+		}
+		if app.auth == nil || r.Method == http.MethodOptions || r.URL.Path == "/_health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := app.auth.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="minio-proxy"`)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// Rejects clients without a tenant once tenants are used, tokens without the
+// tenant claim and links issued before tenants were used included
+func (app *App) requireTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := requestPrincipal(r); p != nil && app.auth != nil && app.auth.tenants && len(p.tenant) == 0 {
+			writeError(w, http.StatusForbidden, fmt.Errorf("%w: %s", errAccessDenied, errNoTenant))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// nil when authentication is disabled
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// Checks scopes and prefixes of the client, and policies when configured
+func (app *App) decide(r *http.Request, scope, key string) policyDecision {
+	p := requestPrincipal(r)
+	id := anonymousPrincipal
+	if p != nil {
+		id = p.id
+	}
+
+	if p != nil && !p.allows(scope, key) {
+		return policyDecision{Principal: id, Action: scope, Key: key, Reason: "not allowed by scopes or prefixes of the API key or token"}
+	}
+	if p != nil && p.signed {
+		return policyDecision{Allowed: true, Principal: id, Action: scope, Key: key, Reason: "signed link"}
+	}
+	if app.policy != nil {
+		return app.policy.Evaluate(id, scope, key)
+	}
+	return policyDecision{Allowed: true, Principal: id, Action: scope, Key: key, Reason: "no policies are configured"}
+}
+
+// Checks the client can access the file, responds with 403 if it can't
+func (app *App) authorize(w http.ResponseWriter, r *http.Request, scope, key string) bool {
+	decision := app.decide(r, scope, key)
+	if decision.Allowed {
+		return true
+	}
+
+	log.Println(decision.Principal, "denied", scope, key+":", decision.Reason)
+	writeError(w, http.StatusForbidden, fmt.Errorf("%w: %s %s", errAccessDenied, scope, key))
+	return false
+}
+
+// Wraps handlers of /files/{filename} routes
+func (app *App) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.authorize(w, r, scope, mux.Vars(r)["filename"]) {
+			next(w, r)
+		}
+	}
+}
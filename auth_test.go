@@ -0,0 +1,103 @@
+package minioproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func newAuthTestApp(t *testing.T) *App {
+	app, err := New(Config{
+		ServerAddr: ":4040",
+		BucketName: "test",
+		EncKey:     genRandBytes(32),
+		HmacKey:    genRandBytes(32),
+		Storage:    newMemoryStorage(),
+		APIKeys: []APIKey{
+			{ID: "admin", Hash: hashKey("admin-key"), Scopes: []string{ScopeRead, ScopeWrite, ScopeDelete, ScopeList}},
+			{ID: "avatars", Hash: hashKey("avatars-key"), Scopes: []string{ScopeRead, ScopeWrite, ScopeList}, Prefixes: []string{"avatars-"}},
+		},
+	})
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+	return app
+}
+
+func authRequest(app *App, method, path, key string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if len(key) > 0 {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	app := newAuthTestApp(t)
+
+	if w := authRequest(app, http.MethodGet, "/files", "", nil); w.Code != http.StatusUnauthorized {
+		t.Error("expected request without a key to be rejected, got", w.Code)
+	}
+	if w := authRequest(app, http.MethodGet, "/files", "wrong", nil); w.Code != http.StatusUnauthorized || len(w.Header().Get("WWW-Authenticate")) == 0 {
+		t.Error("expected request with unknown key to be rejected, got", w.Code, w.Header())
+	}
+	if w := authRequest(app, http.MethodGet, "/_health", "", nil); w.Code != http.StatusOK {
+		t.Error("expected health check to be public, got", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/files/a.txt", bytes.NewReader([]byte("a")))
+	req.Header.Set("X-Api-Key", "admin-key")
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Error("expected upload with X-Api-Key to work, got", w.Code, w.Body)
+	}
+}
+
+func TestAPIKeyScopesAndPrefixes(t *testing.T) {
+	app := newAuthTestApp(t)
+
+	if w := authRequest(app, http.MethodPut, "/files/avatars-1.png", "avatars-key", []byte("1")); w.Code != http.StatusAccepted {
+		t.Fatal("expected upload within prefix to work, got", w.Code, w.Body)
+	}
+	if w := authRequest(app, http.MethodPut, "/files/secret.txt", "avatars-key", []byte("2")); w.Code != http.StatusForbidden {
+		t.Error("expected upload outside prefix to be denied, got", w.Code)
+	}
+	if w := authRequest(app, http.MethodDelete, "/files/avatars-1.png", "avatars-key", nil); w.Code != http.StatusForbidden {
+		t.Error("expected delete without scope to be denied, got", w.Code)
+	}
+	if w := authRequest(app, http.MethodPut, "/files/secret.txt", "admin-key", []byte("3")); w.Code != http.StatusAccepted {
+		t.Fatal("expected upload with unrestricted key to work, got", w.Code)
+	}
+
+	var files []fileInfo
+	json.NewDecoder(authRequest(app, http.MethodGet, "/files", "avatars-key", nil).Body).Decode(&files)
+	if len(files) != 1 || files[0].ID != "avatars-1.png" {
+		t.Error("expected listing to only show files within prefix, got", files)
+	}
+	files = nil
+	json.NewDecoder(authRequest(app, http.MethodGet, "/files", "admin-key", nil).Body).Decode(&files)
+	if len(files) != 2 {
+		t.Error("expected unrestricted key to see all files, got", files)
+	}
+}
+
+func TestAPIKeyValidation(t *testing.T) {
+	if _, err := newAuthenticator(Config{APIKeys: []APIKey{{ID: "a", Hash: "abcd"}}}); err == nil {
+		t.Error("expected invalid hash to be rejected")
+	}
+	if _, err := newAuthenticator(Config{APIKeys: []APIKey{{ID: "a", Hash: hashKey("a"), Scopes: []string{"admin"}}}}); err == nil {
+		t.Error("expected unknown scope to be rejected")
+	}
+}
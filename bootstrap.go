@@ -0,0 +1,67 @@
+package minioproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Storages which can check and create buckets on start
+type bucketManager interface {
+	CheckBucket(bucket string) error
+	CreateBucket(bucket string, cfg BucketConfig) error
+}
+
+// Storages which sign requests for the region of the buckets
+type regionDetector interface {
+	DetectRegion(buckets []string) error
+}
+
+// Checks every MinIO endpoint is reachable, credentials are valid and the
+// buckets, tenant ones included, exist, creating them when configured to.
+// Region of the buckets is detected once they exist. Problems of all
+// endpoints are returned together.
+func checkStorage(storage Storage, cfg Config) error {
+	storages := map[string]Storage{"storage": storage}
+	if replicated, ok := storage.(*replicatedStorage); ok {
+		storages = map[string]Storage{"primary storage": replicated.Storage}
+		for i, replica := range replicated.replicas {
+			storages[fmt.Sprintf("replica %d", i)] = replica
+		}
+	}
+
+	var errs []error
+	for name, storage := range storages {
+		manager, ok := storage.(bucketManager)
+		if !ok {
+			continue
+		}
+		failed := false
+		for _, bucket := range cfg.buckets() {
+			if err := checkBucket(manager, bucket, cfg); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				failed = true
+			}
+		}
+		if detector, ok := storage.(regionDetector); ok && !failed {
+			if err := detector.DetectRegion(cfg.buckets()); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(append([]error{errors.New("startup checks failed")}, errs...)...)
+	}
+	return nil
+}
+
+func checkBucket(manager bucketManager, bucket string, cfg Config) error {
+	err := manager.CheckBucket(bucket)
+	if !errors.Is(err, errBucketNotFound) || !cfg.CreateBucket {
+		return err
+	}
+
+	log.Println("creating bucket", bucket)
+	return manager.CreateBucket(bucket, cfg.Bucket)
+}
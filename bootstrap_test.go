@@ -0,0 +1,89 @@
+package minioproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type mockBucketServer struct {
+	server  *httptest.Server
+	exists  bool
+	headers http.Header
+	configs map[string]string
+}
+
+func newMockBucketServer(t *testing.T) *mockBucketServer {
+	m := &mockBucketServer{configs: make(map[string]string)}
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// requests are signed in the header or presigned
+		credential := r.Header.Get("Authorization") + " Credential=" + r.URL.Query().Get("X-Amz-Credential")
+		if !strings.Contains(credential, "Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>InvalidAccessKeyId</Code><Message>unknown key</Message></Error>`)
+			return
+		}
+
+		subresource, _, _ := strings.Cut(r.URL.RawQuery, "=")
+		switch {
+		case r.Method == http.MethodPut && len(subresource) == 0:
+			m.exists = true
+			m.headers = r.Header
+		case !m.exists:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchBucket</Code></Error>`)
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			m.configs[subresource] = string(body)
+		default:
+			fmt.Fprint(w, `<LocationConstraint></LocationConstraint>`)
+		}
+	}))
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func TestStartupChecks(t *testing.T) {
+	primary := newMockBucketServer(t)
+	replica := newMockBucketServer(t)
+	replica.exists = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newMinioClient(primary.server.URL, "key", "secret", nil)
+	storage := newReplicatedStorage(ctx, client, []Storage{newMinioClient(replica.server.URL, "wrong", "secret", nil)},
+		ReplicationAsync, "", newUploader(client, 2, 64*1024*1024), 0)
+	cfg := Config{BucketName: "bucket"}
+
+	err := checkStorage(storage, cfg)
+	if !errors.Is(err, errBucketNotFound) || !errors.Is(err, errInvalidCredentials) {
+		t.Fatal("expected problems of all endpoints to be reported, got", err)
+	}
+	if !strings.Contains(err.Error(), "primary storage") || !strings.Contains(err.Error(), "replica 0") {
+		t.Error("expected errors to name endpoints, got", err)
+	}
+
+	cfg.CreateBucket = true
+	cfg.Bucket = BucketConfig{Versioning: true}
+	if err := checkStorage(storage.Storage, cfg); err != nil {
+		t.Fatal("expected bucket to be created, got", err)
+	}
+	if !primary.exists {
+		t.Error("expected bucket to be created")
+	}
+	if !strings.Contains(primary.configs["versioning"], "<Status>Enabled</Status>") {
+		t.Error("expected versioning to be enabled, got", primary.configs)
+	}
+
+	if err := checkStorage(storage.Storage, Config{BucketName: "bucket"}); err != nil {
+		t.Error("expected existing bucket to pass, got", err)
+	}
+	if region := storage.Storage.(*minioClient).signer.Region; region != defaultRegion {
+		t.Error("expected region to be detected once the bucket exists, got", region)
+	}
+}
@@ -0,0 +1,213 @@
+package minioproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errStorageUnavailable = errors.New("storage unavailable")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+const (
+	// results are counted over this window before starting over
+	breakerWindow = 10 * time.Second
+	// too few requests in the window to decide anything
+	breakerMinRequests = 5
+	breakerFailureRate = 0.5
+	// requests taking longer than this to respond count as failures
+	breakerSlowRequest = 10 * time.Second
+	// how long requests are rejected before a probe is let through
+	breakerCooldown = 30 * time.Second
+)
+
+// Stops sending requests to an endpoint when too many of them fail or are
+// slow, so clients get an error right away instead of waiting for timeouts.
+// After a cooldown a single request is let through, the breaker closes again
+// if it succeeds.
+type circuitBreaker struct {
+	endpoint  string
+	transport http.RoundTripper
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+	lastError   string
+}
+
+type backendHealth struct {
+	Endpoint    string  `json:"endpoint"`
+	State       string  `json:"state"`
+	FailureRate float64 `json:"failureRate"`
+	LastError   string  `json:"lastError,omitempty"`
+	// seconds until a request is let through again
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// Returned while the breaker is open
+type unavailableError struct {
+	endpoint   string
+	retryAfter time.Duration
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%s is unavailable, retry in %s", e.endpoint, e.retryAfter.Round(time.Second))
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == errStorageUnavailable
+}
+
+// Storages which can report health of their endpoints
+type healthReporter interface {
+	Health() []backendHealth
+}
+
+func newCircuitBreaker(endpoint string, transport http.RoundTripper) *circuitBreaker {
+	return &circuitBreaker{
+		endpoint:    endpoint,
+		transport:   transport,
+		state:       breakerClosed,
+		windowStart: time.Now(),
+	}
+}
+
+func (b *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := b.allow(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := b.transport.RoundTrip(req)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// client went away, says nothing about the endpoint
+		b.release()
+	case err != nil:
+		b.record(err.Error())
+	case resp.StatusCode >= 500:
+		b.record(resp.Status)
+	case time.Since(start) > breakerSlowRequest:
+		b.record(fmt.Sprintf("slow response, took %s", time.Since(start).Round(time.Millisecond)))
+	default:
+		b.record("")
+	}
+	return resp, err
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if wait := breakerCooldown - time.Since(b.openedAt); wait > 0 {
+			return &unavailableError{endpoint: b.endpoint, retryAfter: wait}
+		}
+		b.state = breakerHalfOpen
+	}
+	if b.state == breakerHalfOpen {
+		// only one request at a time checks if the endpoint is back
+		if b.probing {
+			return &unavailableError{endpoint: b.endpoint, retryAfter: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Forgets a request which ended without a result, a probe can be sent again
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// Records result of a request, failure is empty if it succeeded
+func (b *circuitBreaker) record(failure string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(failure) > 0 {
+		b.lastError = failure
+	}
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if len(failure) > 0 {
+			b.open()
+		} else {
+			b.state = breakerClosed
+			b.resetWindow()
+		}
+		return
+	}
+
+	if time.Since(b.windowStart) > breakerWindow {
+		b.resetWindow()
+	}
+	b.requests++
+	if len(failure) > 0 {
+		b.failures++
+	}
+	if b.requests >= breakerMinRequests && b.failureRate() >= breakerFailureRate {
+		b.open()
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	b.resetWindow()
+}
+
+func (b *circuitBreaker) resetWindow() {
+	b.windowStart = time.Now()
+	b.requests = 0
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failureRate() float64 {
+	if b.requests == 0 {
+		return 0
+	}
+	return float64(b.failures) / float64(b.requests)
+}
+
+func (b *circuitBreaker) Health() backendHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := backendHealth{
+		Endpoint:    b.endpoint,
+		State:       b.state,
+		FailureRate: b.failureRate(),
+		LastError:   b.lastError,
+	}
+	if b.state == breakerOpen {
+		health.RetryAfter = retryAfterSeconds(breakerCooldown - time.Since(b.openedAt))
+	}
+	return health
+}
+
+func retryAfterSeconds(wait time.Duration) int {
+	return max(int(wait.Round(time.Second).Seconds()), 1)
+}
@@ -0,0 +1,93 @@
+package minioproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	minio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer minio.Close()
+
+	client := newMinioClient(minio.URL, "key", "secret", nil)
+	app, err := New(Config{
+		ServerAddr: ":4040",
+		BucketName: "test",
+		EncKey:     genRandBytes(32),
+		HmacKey:    genRandBytes(32),
+		Storage:    client,
+
+		SkipStartupChecks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < breakerMinRequests; i++ {
+		if _, err := client.Head("test", "file"); errors.Is(err, errStorageUnavailable) {
+			t.Fatal("expected breaker to be closed, failed at request", i)
+		}
+	}
+
+	w := doRequest(app, http.MethodGet, "/files/file", nil)
+	if w.Code != http.StatusServiceUnavailable || len(w.Header().Get("Retry-After")) == 0 {
+		t.Error("expected open breaker to fail fast, got", w.Code, w.Header())
+	}
+	if w := doRequest(app, http.MethodGet, "/_health", nil); w.Code != http.StatusServiceUnavailable {
+		t.Error("expected health check to fail, got", w.Code, w.Body)
+	}
+
+	// probe after cooldown closes the breaker
+	failing.Store(false)
+	client.breaker.mu.Lock()
+	client.breaker.openedAt = time.Now().Add(-breakerCooldown)
+	client.breaker.mu.Unlock()
+
+	if w := doRequest(app, http.MethodGet, "/files/file", nil); w.Code != http.StatusNotFound {
+		t.Error("expected request to go through, got", w.Code, w.Body)
+	}
+	if health := client.breaker.Health(); health.State != breakerClosed {
+		t.Error("expected breaker to be closed, got", health)
+	}
+	if w := doRequest(app, http.MethodGet, "/_health", nil); w.Code != http.StatusOK {
+		t.Error("expected health check to pass, got", w.Code, w.Body)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCircuitBreakerIgnoresCanceledProbe(t *testing.T) {
+	breaker := newCircuitBreaker("minio", roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, context.Canceled
+	}))
+	breaker.open()
+	breaker.openedAt = time.Now().Add(-breakerCooldown)
+
+	req := httptest.NewRequest(http.MethodGet, "http://minio/test/file", nil)
+	if _, err := breaker.RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected probe to be sent, got", err)
+	}
+	if health := breaker.Health(); health.State != breakerHalfOpen {
+		t.Error("expected canceled probe not to close the breaker, got", health.State)
+	}
+	if _, err := breaker.RoundTrip(req); errors.Is(err, errStorageUnavailable) {
+		t.Error("expected another probe to be let through")
+	}
+}
@@ -0,0 +1,314 @@
+package minioproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheSizeMB = 1024
+
+// On-disk LRU cache of encrypted files. Files are kept exactly as they are in
+// storage, so nothing is stored in cleartext. Cached files are revalidated
+// with storage on every read, only the transfer is saved when they haven't
+// changed.
+type objectCache struct {
+	dir     string
+	maxSize int64
+	storage Storage
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// most recently used entries are at the front
+	lru  *list.List
+	size int64
+
+	hits   int64
+	misses int64
+}
+
+type cacheEntry struct {
+	Bucket       string
+	Key          string
+	ContentType  string
+	Size         int64
+	ETag         ETag
+	LastModified time.Time
+	Metadata     map[string]string `json:",omitempty"`
+
+	lastUsed time.Time
+}
+
+type cacheStats struct {
+	Size    int64 `json:"size"`
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func newObjectCache(dir string, maxSize int64, storage Storage) (*objectCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	c := &objectCache{
+		dir:     dir,
+		maxSize: maxSize,
+		storage: storage,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	c.load()
+	return c, nil
+}
+
+// Returns the cached file if storage still has the same version of it,
+// otherwise fetch is used to get the file and it's cached while being read
+func (c *objectCache) Get(bucket, key string, fetch func() (*File, error)) (*File, error) {
+	id := cacheID(bucket, key)
+
+	c.mu.Lock()
+	elem, cached := c.entries[id]
+	var entry cacheEntry
+	if cached {
+		entry = *elem.Value.(*cacheEntry)
+	}
+	c.mu.Unlock()
+
+	if cached {
+		file, err := c.storage.GetIfNoneMatch(bucket, key, entry.ETag)
+		switch {
+		case errors.Is(err, errNotModified):
+			if file, err := c.open(id, entry); err == nil {
+				return file, nil
+			}
+		case errors.Is(err, errFileNotFound):
+			c.remove(id)
+			return nil, err
+		case err == nil:
+			// changed since it was cached
+			c.miss()
+			return c.fill(id, bucket, key, file), nil
+		}
+	}
+
+	c.miss()
+	file, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	return c.fill(id, bucket, key, file), nil
+}
+
+func (c *objectCache) Stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return cacheStats{
+		Size:    c.size,
+		Entries: c.lru.Len(),
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
+
+func (c *objectCache) miss() {
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+}
+
+func (c *objectCache) open(id string, entry cacheEntry) (*File, error) {
+	data, err := os.Open(c.dataPath(id))
+	if err != nil {
+		c.remove(id)
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if elem, exists := c.entries[id]; exists {
+		c.lru.MoveToFront(elem)
+	}
+	c.hits++
+	c.mu.Unlock()
+	// modification time keeps the order of entries after a restart
+	now := time.Now()
+	os.Chtimes(c.dataPath(id), now, now)
+
+	return &File{
+		ContentType:   entry.ContentType,
+		ContentLength: entry.Size,
+		ETag:          entry.ETag,
+		LastModified:  entry.LastModified,
+		Metadata:      entry.Metadata,
+		Data:          data,
+	}, nil
+}
+
+// Copies file into the cache as it's read, the entry is added only if the
+// whole file has been read
+func (c *objectCache) fill(id, bucket, key string, file *File) *File {
+	if file.ContentLength > c.maxSize {
+		return file
+	}
+
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		log.Println("can't cache", key, err)
+		return file
+	}
+
+	entry := &cacheEntry{
+		Bucket:       bucket,
+		Key:          key,
+		ContentType:  file.ContentType,
+		Size:         file.ContentLength,
+		ETag:         file.ETag,
+		LastModified: file.LastModified,
+		Metadata:     file.Metadata,
+	}
+	file.Data = &cacheFill{cache: c, id: id, entry: entry, src: file.Data, tmp: tmp}
+	return file
+}
+
+func (c *objectCache) add(id string, entry *cacheEntry, tmpName string) error {
+	if err := writeJsonFile(c.metaPath(id), entry); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, c.dataPath(id)); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(id, false)
+	c.entries[id] = c.lru.PushFront(entry)
+	c.size += entry.Size
+	c.evictLocked()
+	return nil
+}
+
+func (c *objectCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(id, true)
+}
+
+func (c *objectCache) removeLocked(id string, files bool) {
+	if elem, exists := c.entries[id]; exists {
+		c.size -= elem.Value.(*cacheEntry).Size
+		c.lru.Remove(elem)
+		delete(c.entries, id)
+	}
+	if files {
+		os.Remove(c.dataPath(id))
+		os.Remove(c.metaPath(id))
+	}
+}
+
+func (c *objectCache) evictLocked() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		entry := c.lru.Back().Value.(*cacheEntry)
+		c.removeLocked(cacheID(entry.Bucket, entry.Key), true)
+	}
+}
+
+// Rebuilds the index from files left from before a restart
+func (c *objectCache) load() {
+	tmps, _ := filepath.Glob(filepath.Join(c.dir, ".tmp-*"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	metas, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	var entries []*cacheEntry
+	for _, meta := range metas {
+		id := strings.TrimSuffix(filepath.Base(meta), ".json")
+
+		var entry cacheEntry
+		stat, err := os.Stat(c.dataPath(id))
+		if err == nil {
+			err = readJsonFile(meta, &entry)
+		}
+		if err != nil || stat.Size() != entry.Size || cacheID(entry.Bucket, entry.Key) != id {
+			os.Remove(meta)
+			os.Remove(c.dataPath(id))
+			continue
+		}
+
+		entry.lastUsed = stat.ModTime()
+		entries = append(entries, &entry)
+	}
+
+	slices.SortFunc(entries, func(a, b *cacheEntry) int {
+		return b.lastUsed.Compare(a.lastUsed)
+	})
+	for _, entry := range entries {
+		c.entries[cacheID(entry.Bucket, entry.Key)] = c.lru.PushBack(entry)
+		c.size += entry.Size
+	}
+	c.evictLocked()
+}
+
+func (c *objectCache) dataPath(id string) string {
+	return filepath.Join(c.dir, id)
+}
+
+func (c *objectCache) metaPath(id string) string {
+	return filepath.Join(c.dir, id+".json")
+}
+
+func cacheID(bucket, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+type cacheFill struct {
+	cache   *objectCache
+	id      string
+	entry   *cacheEntry
+	src     io.ReadCloser
+	tmp     *os.File
+	written int64
+	failed  bool
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.src.Read(p)
+	if n > 0 && !f.failed {
+		if _, writeErr := f.tmp.Write(p[:n]); writeErr != nil {
+			f.failed = true
+		}
+		f.written += int64(n)
+	}
+	return n, err
+}
+
+func (f *cacheFill) Close() error {
+	err := f.src.Close()
+
+	tmpName := f.tmp.Name()
+	if closeErr := f.tmp.Close(); closeErr != nil {
+		f.failed = true
+	}
+	if f.failed || f.written != f.entry.Size {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if addErr := f.cache.add(f.id, f.entry, tmpName); addErr != nil {
+		log.Println("can't cache", f.entry.Key, addErr)
+		os.Remove(tmpName)
+	}
+	return err
+}
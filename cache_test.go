@@ -0,0 +1,75 @@
+package minioproxy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func readCached(t *testing.T, cache *objectCache, storage Storage, key string) []byte {
+	file, err := cache.Get("test", key, func() (*File, error) {
+		return storage.Get("test", key)
+	})
+	if err != nil {
+		t.Fatal("failed to get", key, err)
+	}
+	defer file.Data.Close()
+
+	data, err := io.ReadAll(file.Data)
+	if err != nil {
+		t.Fatal("failed to read", key, err)
+	}
+	return data
+}
+
+func TestObjectCache(t *testing.T) {
+	storage := newMemoryStorage()
+	dir := t.TempDir()
+	cache, err := newObjectCache(dir, 100, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := genRandBytes(40)
+	storage.Put("test", "a", "", nil, Precondition{}, 40, bytes.NewReader(first))
+	readCached(t, cache, storage, "a")
+	if data := readCached(t, cache, storage, "a"); !bytes.Equal(data, first) {
+		t.Error("expected cached file to match")
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Size != 40 {
+		t.Error("expected second read to be served from cache, got", stats)
+	}
+
+	// revalidation picks up a new version
+	second := genRandBytes(40)
+	storage.Put("test", "a", "", nil, Precondition{}, 40, bytes.NewReader(second))
+	if data := readCached(t, cache, storage, "a"); !bytes.Equal(data, second) {
+		t.Error("expected changed file to be fetched again")
+	}
+	if data := readCached(t, cache, storage, "a"); !bytes.Equal(data, second) {
+		t.Error("expected changed file to be cached")
+	}
+
+	// least recently used file is evicted
+	storage.Put("test", "b", "", nil, Precondition{}, 40, bytes.NewReader(genRandBytes(40)))
+	storage.Put("test", "c", "", nil, Precondition{}, 40, bytes.NewReader(genRandBytes(40)))
+	readCached(t, cache, storage, "b")
+	readCached(t, cache, storage, "c")
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Size != 80 {
+		t.Error("expected cache to stay within its size, got", stats)
+	}
+
+	storage.Delete("test", "c", Precondition{})
+	if _, err := cache.Get("test", "c", nil); err != errFileNotFound {
+		t.Error("expected deleted file to be gone, got", err)
+	}
+
+	// index is rebuilt after a restart
+	cache, err = newObjectCache(dir, 100, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Size != 40 {
+		t.Error("expected cache to be loaded, got", stats)
+	}
+}
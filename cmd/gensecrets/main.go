@@ -2,7 +2,9 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 
@@ -11,6 +13,14 @@ import (
 
 // Generates an 8-byte key that can be used in config
 func main() {
+	apiKey := flag.Bool("apikey", false, "generate an API key and its hash instead")
+	flag.Parse()
+
+	if *apiKey {
+		genApiKey()
+		return
+	}
+
 	salt := make([]byte, 8)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		panic("rand reader err: " + err.Error())
@@ -30,3 +40,16 @@ func main() {
 
 	fmt.Println("key:\t", hex.EncodeToString(key))
 }
+
+// Key is given to the client, only its hash goes into config
+func genApiKey() {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic("rand reader err: " + err.Error())
+	}
+	encoded := hex.EncodeToString(key)
+	fmt.Println("key:\t", encoded)
+
+	hash := sha256.Sum256([]byte(encoded))
+	fmt.Println("hash:\t", hex.EncodeToString(hash[:]))
+}
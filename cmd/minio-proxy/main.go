@@ -4,6 +4,8 @@ import (
 	"encoding/hex"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/josip/minioproxy"
@@ -18,6 +20,34 @@ func main() {
 		AccessKey:  os.Getenv("MINIO_ACCESS_KEY"),
 		SecretKey:  os.Getenv("MINIO_SECRET_KEY"),
 		BucketName: os.Getenv("MINIO_BUCKET_NAME"),
+		Region:     os.Getenv("MINIO_REGION"),
+		Addressing: os.Getenv("MINIO_ADDRESSING"),
+
+		SessionToken:       os.Getenv("MINIO_SESSION_TOKEN"),
+		CredentialsFile:    os.Getenv("MINIO_CREDENTIALS_FILE"),
+		CredentialsProfile: os.Getenv("MINIO_CREDENTIALS_PROFILE"),
+		STS: minioproxy.STSConfig{
+			Endpoint:             os.Getenv("MINIO_STS_ENDPOINT"),
+			AssumeRole:           os.Getenv("MINIO_STS_ASSUME_ROLE") == "true",
+			RoleArn:              os.Getenv("MINIO_STS_ROLE_ARN"),
+			WebIdentityTokenFile: os.Getenv("MINIO_WEB_IDENTITY_TOKEN_FILE"),
+		},
+
+		StorageBackend:  os.Getenv("STORAGE_BACKEND"),
+		StoragePath:     os.Getenv("STORAGE_PATH"),
+		UploadStatePath: os.Getenv("UPLOAD_STATE_PATH"),
+		CachePath:       os.Getenv("CACHE_PATH"),
+		APIKeysFile:     os.Getenv("API_KEYS_FILE"),
+		PolicyFile:      os.Getenv("POLICY_FILE"),
+		TenantsFile:     os.Getenv("TENANTS_FILE"),
+		JWT: minioproxy.JWTConfig{
+			JWKS:          os.Getenv("JWT_JWKS"),
+			Issuer:        os.Getenv("JWT_ISSUER"),
+			Audience:      os.Getenv("JWT_AUDIENCE"),
+			ScopesClaim:   os.Getenv("JWT_SCOPES_CLAIM"),
+			PrefixesClaim: os.Getenv("JWT_PREFIXES_CLAIM"),
+			TenantClaim:   os.Getenv("JWT_TENANT_CLAIM"),
+		},
 	}
 
 	chunkSizeStr := os.Getenv("UPLOAD_CHUNK_SIZE_MB")
@@ -26,11 +56,60 @@ func main() {
 		chunkSize = -1
 	}
 	cfg.UploadChunkSizeMb = int(chunkSize)
+	cfg.UploadWorkers, _ = strconv.Atoi(os.Getenv("UPLOAD_WORKERS"))
+	cfg.UploadMemoryLimitMb, _ = strconv.Atoi(os.Getenv("UPLOAD_MEMORY_LIMIT_MB"))
+	cfg.UploadSpoolLimitMb, _ = strconv.Atoi(os.Getenv("UPLOAD_SPOOL_LIMIT_MB"))
+	cfg.UploadExpiry, _ = time.ParseDuration(os.Getenv("UPLOAD_EXPIRY"))
+	cfg.DownloadSegmentSizeMb, _ = strconv.Atoi(os.Getenv("DOWNLOAD_SEGMENT_SIZE_MB"))
+	cfg.DownloadWorkers, _ = strconv.Atoi(os.Getenv("DOWNLOAD_WORKERS"))
+	cfg.CacheSizeMb, _ = strconv.Atoi(os.Getenv("CACHE_SIZE_MB"))
+
+	// replicas use same credentials as the primary unless set
+	replicaAccessKey, replicaSecretKey := os.Getenv("REPLICA_ACCESS_KEY"), os.Getenv("REPLICA_SECRET_KEY")
+	if len(replicaAccessKey) == 0 {
+		replicaAccessKey, replicaSecretKey = cfg.AccessKey, cfg.SecretKey
+	}
+	for _, endpoint := range strings.Split(os.Getenv("REPLICA_ENDPOINTS"), ",") {
+		if endpoint = strings.TrimSpace(endpoint); len(endpoint) > 0 {
+			cfg.Replicas = append(cfg.Replicas, minioproxy.ReplicaConfig{
+				Endpoint:  endpoint,
+				AccessKey: replicaAccessKey,
+				SecretKey: replicaSecretKey,
+				Region:    os.Getenv("REPLICA_REGION"),
+			})
+		}
+	}
+	cfg.ReplicationMode = os.Getenv("REPLICATION_MODE")
+
+	cfg.STS.Duration, _ = time.ParseDuration(os.Getenv("MINIO_STS_DURATION"))
+	cfg.JWT.ClockSkew, _ = time.ParseDuration(os.Getenv("JWT_CLOCK_SKEW"))
+
+	cfg.SkipStartupChecks = os.Getenv("SKIP_STARTUP_CHECKS") == "true"
+	cfg.CreateBucket = os.Getenv("MINIO_CREATE_BUCKET") == "true"
+	cfg.CreateOnly = os.Getenv("CREATE_ONLY") == "true"
+	cfg.Bucket = minioproxy.BucketConfig{
+		Versioning: os.Getenv("MINIO_BUCKET_VERSIONING") == "true",
+	}
+
+	cfg.Transport = minioproxy.TransportConfig{
+		CAFile:         os.Getenv("MINIO_CA_FILE"),
+		ClientCertFile: os.Getenv("MINIO_CLIENT_CERT_FILE"),
+		ClientKeyFile:  os.Getenv("MINIO_CLIENT_KEY_FILE"),
+		Proxy:          os.Getenv("MINIO_PROXY"),
+	}
+	cfg.Transport.MaxIdleConns, _ = strconv.Atoi(os.Getenv("MINIO_MAX_IDLE_CONNS"))
+	cfg.Transport.MaxIdleConnsPerHost, _ = strconv.Atoi(os.Getenv("MINIO_MAX_IDLE_CONNS_PER_HOST"))
+	cfg.Transport.MaxConnsPerHost, _ = strconv.Atoi(os.Getenv("MINIO_MAX_CONNS_PER_HOST"))
+	cfg.Transport.IdleConnTimeout, _ = time.ParseDuration(os.Getenv("MINIO_IDLE_CONN_TIMEOUT"))
+	cfg.Transport.DialTimeout, _ = time.ParseDuration(os.Getenv("MINIO_DIAL_TIMEOUT"))
+	cfg.Transport.TLSTimeout, _ = time.ParseDuration(os.Getenv("MINIO_TLS_TIMEOUT"))
+	cfg.Transport.ResponseTimeout, _ = time.ParseDuration(os.Getenv("MINIO_RESPONSE_TIMEOUT"))
 
 	encKey, _ := hex.DecodeString(os.Getenv("ENC_KEY"))
 	cfg.EncKey = encKey
 	hmacKey, _ := hex.DecodeString(os.Getenv("HMAC_KEY"))
 	cfg.HmacKey = hmacKey
+	cfg.ShareKey, _ = hex.DecodeString(os.Getenv("SHARE_KEY"))
 
 	app, err := minioproxy.New(cfg)
 	if err != nil {
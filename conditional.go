@@ -0,0 +1,149 @@
+package minioproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+func hasPreconditions(header http.Header) bool {
+	for _, name := range conditionalHeaders {
+		if len(header.Values(name)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluates conditional headers in the order of RFC 9110 section 13.2.2
+// against the current version of the file, nil when it doesn't exist. Returns
+// the status to respond with when a precondition fails, 0 otherwise.
+func checkPreconditions(method string, header http.Header, file *File) int {
+	safe := method == http.MethodGet || method == http.MethodHead
+
+	if ifMatch := header.Values("If-Match"); len(ifMatch) > 0 {
+		if file == nil || !matchesETag(ifMatch, file.ETag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(header.Get("If-Unmodified-Since")); err == nil && file != nil {
+		if file.LastModified.Truncate(time.Second).After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := header.Values("If-None-Match"); len(ifNoneMatch) > 0 {
+		if file != nil && matchesETag(ifNoneMatch, file.ETag, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(header.Get("If-Modified-Since")); err == nil && safe && file != nil {
+		if !file.LastModified.Truncate(time.Second).After(since) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// If-None-Match of the request when storage can evaluate it, a single strong
+// etag, empty otherwise
+func storageIfNoneMatch(header http.Header) ETag {
+	values := header.Values("If-None-Match")
+	if len(values) != 1 || strings.ContainsAny(values[0], ",*") || strings.HasPrefix(values[0], "W/") {
+		return ""
+	}
+	return ETag(strings.TrimSpace(values[0]))
+}
+
+// If-None-Match uses weak comparison, If-Match strong comparison where weak
+// etags never match
+func matchesETag(values []string, etag ETag, weak bool) bool {
+	current, currentIsWeak := strings.CutPrefix(string(etag), "W/")
+	for _, value := range values {
+		for _, candidate := range strings.Split(value, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" {
+				return true
+			}
+
+			candidate, candidateIsWeak := strings.CutPrefix(candidate, "W/")
+			if !weak && (candidateIsWeak || currentIsWeak) {
+				continue
+			}
+			if ETag(current).Matches(ETag(candidate)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Responds with 304 or 412 when a precondition of the request fails for file,
+// nil when it doesn't exist
+func failedPreconditions(w http.ResponseWriter, r *http.Request, file *File) bool {
+	status := checkPreconditions(r.Method, r.Header, file)
+	if status == 0 {
+		return false
+	}
+
+	if file != nil {
+		setValidatorHeaders(w, file)
+	}
+	if status == http.StatusNotModified {
+		w.WriteHeader(status)
+	} else {
+		writeError(w, status, errPreconditionFailed)
+	}
+	return true
+}
+
+func setValidatorHeaders(w http.ResponseWriter, file *File) {
+	w.Header().Set("ETag", string(file.ETag))
+	if !file.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", file.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Current version of the file, nil when it doesn't exist
+func (app *App) currentFile(t *tenant, filename string) (*File, error) {
+	file, err := app.storage.Head(t.bucket, t.key(filename))
+	if errors.Is(err, errFileNotFound) {
+		return nil, nil
+	}
+	return file, err
+}
+
+// Checks preconditions of a write, the conditional headers of the request and
+// create-only mode, against the current version of the file. The returned
+// condition makes storage refuse the write if the file changes before it's
+// made. Responds with an error when a precondition fails.
+func (app *App) writePrecondition(w http.ResponseWriter, r *http.Request, header http.Header, t *tenant, filename string) (Precondition, bool) {
+	if !app.createOnly && !hasPreconditions(header) {
+		return Precondition{}, true
+	}
+
+	file, err := app.currentFile(t, filename)
+	if err != nil {
+		writeStorageError(w, err)
+		return Precondition{}, false
+	}
+	if app.createOnly && file != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("%w: %s", errFileExists, filename))
+		return Precondition{}, false
+	}
+	if status := checkPreconditions(r.Method, header, file); status != 0 {
+		writeError(w, status, errPreconditionFailed)
+		return Precondition{}, false
+	}
+
+	if file == nil {
+		return Precondition{IfNoneMatch: true}, true
+	}
+	return Precondition{IfMatch: file.ETag}, true
+}
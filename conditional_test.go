@@ -0,0 +1,187 @@
+package minioproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func conditionalRequest(app *App, method, path, header, value string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set(header, value)
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestConditionalReads(t *testing.T) {
+	app, _ := newTestApp(t)
+	w := doRequest(app, http.MethodPut, "/files/hello.txt", []byte("hello"))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusAccepted || len(etag) == 0 {
+		t.Fatal("upload failed", w.Code, w.Header())
+	}
+
+	w = doRequest(app, http.MethodGet, "/files/hello.txt", nil)
+	lastModified := w.Header().Get("Last-Modified")
+	if w.Header().Get("ETag") != etag || len(lastModified) == 0 {
+		t.Error("expected validators on download, got", w.Header())
+	}
+
+	cases := []struct {
+		method, header, value string
+		status                int
+	}{
+		{http.MethodGet, "If-None-Match", etag, http.StatusNotModified},
+		{http.MethodGet, "If-None-Match", `"other", ` + etag, http.StatusNotModified},
+		{http.MethodGet, "If-None-Match", "W/" + etag, http.StatusNotModified},
+		{http.MethodHead, "If-None-Match", "*", http.StatusNotModified},
+		{http.MethodGet, "If-None-Match", `"other"`, http.StatusOK},
+		{http.MethodGet, "If-Modified-Since", lastModified, http.StatusNotModified},
+		{http.MethodGet, "If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK},
+		{http.MethodGet, "If-Match", etag, http.StatusOK},
+		{http.MethodGet, "If-Match", "W/" + etag, http.StatusPreconditionFailed},
+		{http.MethodHead, "If-Match", `"other"`, http.StatusPreconditionFailed},
+		{http.MethodGet, "If-Unmodified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusPreconditionFailed},
+	}
+	for _, c := range cases {
+		w := conditionalRequest(app, c.method, "/files/hello.txt", c.header, c.value, nil)
+		if w.Code != c.status {
+			t.Error("expected", c.status, "for", c.method, c.header, c.value, "got", w.Code)
+		}
+		if c.status == http.StatusNotModified && (w.Body.Len() > 0 || w.Header().Get("ETag") != etag) {
+			t.Error("expected 304 with etag and without content, got", w.Header(), w.Body)
+		}
+	}
+
+	if w := conditionalRequest(app, http.MethodGet, "/files/missing.txt", "If-Match", "*", nil); w.Code != http.StatusPreconditionFailed {
+		t.Error("expected If-Match to fail for missing file, got", w.Code)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	w := conditionalRequest(app, http.MethodPut, "/files/hello.txt", "If-None-Match", "*", []byte("hello"))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusAccepted {
+		t.Fatal("expected create with If-None-Match to work, got", w.Code, w.Body)
+	}
+	if w := conditionalRequest(app, http.MethodPut, "/files/hello.txt", "If-None-Match", "*", []byte("again")); w.Code != http.StatusPreconditionFailed {
+		t.Error("expected If-None-Match to prevent replacing the file, got", w.Code)
+	}
+
+	if w := conditionalRequest(app, http.MethodPut, "/files/hello.txt", "If-Match", `"stale"`, []byte("lost update")); w.Code != http.StatusPreconditionFailed {
+		t.Error("expected update of a changed file to fail, got", w.Code)
+	}
+	w = conditionalRequest(app, http.MethodPut, "/files/hello.txt", "If-Match", etag, []byte("updated"))
+	if w.Code != http.StatusAccepted {
+		t.Fatal("expected update of the current version to work, got", w.Code, w.Body)
+	}
+	if w := doRequest(app, http.MethodGet, "/files/hello.txt", nil); w.Body.String() != "updated" {
+		t.Error("unexpected content", w.Body)
+	}
+
+	if w := conditionalRequest(app, http.MethodDelete, "/files/hello.txt", "If-Match", etag, nil); w.Code != http.StatusPreconditionFailed {
+		t.Error("expected delete of an old version to fail, got", w.Code)
+	}
+	if w := conditionalRequest(app, http.MethodDelete, "/files/hello.txt", "If-Match", w.Header().Get("ETag"), nil); w.Code != http.StatusNoContent {
+		t.Error("expected delete of the current version to work, got", w.Code)
+	}
+}
+
+func TestStoragePreconditions(t *testing.T) {
+	for name, s := range testStorages(t) {
+		data := []byte("hello")
+		etag, _ := s.Put("bucket", "a.txt", "text/plain", nil, Precondition{IfNoneMatch: true}, int64(len(data)), bytes.NewReader(data))
+		if len(etag) == 0 {
+			t.Fatal(name, "expected conditional create to work")
+		}
+		if _, err := s.Put("bucket", "a.txt", "text/plain", nil, Precondition{IfNoneMatch: true}, int64(len(data)), bytes.NewReader(data)); err != errPreconditionFailed {
+			t.Error(name, "expected create of existing file to fail, got", err)
+		}
+		if _, err := s.Put("bucket", "a.txt", "text/plain", nil, Precondition{IfMatch: `"stale"`}, int64(len(data)), bytes.NewReader(data)); err != errPreconditionFailed {
+			t.Error(name, "expected update with wrong etag to fail, got", err)
+		}
+		if _, err := s.Put("bucket", "a.txt", "text/plain", nil, Precondition{IfMatch: etag}, int64(len(data)), bytes.NewReader(data)); err != nil {
+			t.Error(name, "expected update with current etag to work, got", err)
+		}
+
+		if _, err := s.GetRange("bucket", "a.txt", 1, 2, `"stale"`); err != errPreconditionFailed {
+			t.Error(name, "expected range of another version to fail, got", err)
+		}
+		file, err := s.GetRange("bucket", "a.txt", 1, 2, etag)
+		if err != nil {
+			t.Fatal(name, "expected range of current version to work, got", err)
+		}
+		file.Data.Close()
+
+		if err := s.Delete("bucket", "a.txt", Precondition{IfMatch: `"stale"`}); err != errPreconditionFailed {
+			t.Error(name, "expected delete of another version to fail, got", err)
+		}
+		if err := s.Delete("bucket", "a.txt", Precondition{IfMatch: etag}); err != nil {
+			t.Error(name, "expected delete of current version to work, got", err)
+		}
+	}
+}
+
+// reports a version of every file which is no longer current, as if it was
+// replaced right after being checked
+type staleHeadStorage struct {
+	*memoryStorage
+	gets int
+}
+
+func (s *staleHeadStorage) Head(bucket, key string) (*File, error) {
+	file, err := s.memoryStorage.Head(bucket, key)
+	if file != nil {
+		file.ETag = `"stale"`
+	}
+	return file, err
+}
+
+func (s *staleHeadStorage) Get(bucket, key string) (*File, error) {
+	s.gets++
+	return s.memoryStorage.Get(bucket, key)
+}
+
+func TestConditionalReadsUseServedVersion(t *testing.T) {
+	storage := &staleHeadStorage{memoryStorage: newMemoryStorage()}
+	app, err := New(Config{
+		ServerAddr: ":4040",
+		BucketName: "test",
+		EncKey:     genRandBytes(32),
+		HmacKey:    genRandBytes(32),
+		Storage:    storage,
+	})
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+	etag := doRequest(app, http.MethodPut, "/files/hello.txt", []byte("hello")).Header().Get("ETag")
+
+	if w := conditionalRequest(app, http.MethodGet, "/files/hello.txt", "If-Match", etag, nil); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Error("expected If-Match to be checked against the version sent, got", w.Code)
+	}
+	if w := conditionalRequest(app, http.MethodGet, "/files/hello.txt", "If-Match", `"stale"`, nil); w.Code != http.StatusPreconditionFailed {
+		t.Error("expected If-Match with another version to fail, got", w.Code)
+	}
+
+	storage.gets = 0
+	w := conditionalRequest(app, http.MethodGet, "/files/hello.txt", "If-None-Match", etag, nil)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag {
+		t.Error("expected 304 with etag, got", w.Code, w.Header())
+	}
+	if storage.gets > 0 {
+		t.Error("expected storage to check If-None-Match without sending the file")
+	}
+
+	// file is replaced after preconditions were checked
+	if w := conditionalRequest(app, http.MethodDelete, "/files/hello.txt", "If-Match", `"stale"`, nil); w.Code != http.StatusPreconditionFailed {
+		t.Error("expected delete of a replaced version to fail, got", w.Code)
+	}
+	if _, err := storage.memoryStorage.Head("test", "hello.txt"); err != nil {
+		t.Error("expected file to be kept", err)
+	}
+}
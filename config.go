@@ -5,14 +5,20 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
+
+	"github.com/josip/minioproxy/presign"
 )
 
 const MIN_CHUNK_SIZE_MB = 5
 
 // files need to be at least 15mb to use chunking
 const minChunkedFileSize = 3 * MIN_CHUNK_SIZE_MB * 1024 * 1024
-const maxChunkedFileSizeMB = 100
+
+// max part size allowed by S3
+const maxChunkedFileSizeMB = 5 * 1024
 
 type Config struct {
 	ServerAddr string
@@ -20,34 +26,210 @@ type Config struct {
 	AccessKey  string
 	SecretKey  string
 	BucketName string
-	// 0 to disable, has to be bigger than MIN_CHUNK_SIZE_MB
+	// session token when AccessKey and SecretKey are temporary credentials
+	SessionToken string
+	// shared credentials file (~/.aws/credentials format), used when AccessKey
+	// is empty
+	CredentialsFile string
+	// profile to use from CredentialsFile, defaults to "default"
+	CredentialsProfile string
+	// gets temporary credentials from MinIO STS API
+	STS STSConfig
+
+	// region requests are signed for, detected from the bucket when empty
+	Region string
+	// one of presign.Addressing* constants, used for replicas too
+	Addressing string
+	// connections to MinIO, used for replicas too
+	Transport TransportConfig
+
+	// skips checking that MinIO endpoints are reachable, credentials are
+	// valid and the bucket exists on start
+	SkipStartupChecks bool
+	// creates the bucket on start when it doesn't exist
+	CreateBucket bool
+	// settings of the bucket when it's created
+	Bucket BucketConfig
+
+	// 0 to disable, has to be bigger than MIN_CHUNK_SIZE_MB. Used as preferred
+	// size, larger files get larger chunks to stay within 10 000 parts.
 	UploadChunkSizeMb int
 
+	// number of parts uploaded in parallel across all uploads, defaults to 16
+	UploadWorkers int
+	// memory shared by part buffers of all uploads, defaults to 512 MB
+	UploadMemoryLimitMb int
+
+	// uploads fail with 409 instead of replacing existing files
+	CreateOnly bool
+
+	// directory to keep state of resumable (tus) and client driven multipart
+	// uploads in, both are disabled when empty
+	UploadStatePath string
+	// disk space multipart upload parts received out of order can take in
+	// UploadStatePath, defaults to 10 GB
+	UploadSpoolLimitMb int
+	// resumable and multipart uploads without activity for this long are
+	// aborted, defaults to 24 hours
+	UploadExpiry time.Duration
+
+	// files larger than two segments are downloaded as ranges of this size
+	// fetched in parallel, 0 to disable
+	DownloadSegmentSizeMb int
+	// segments of a single download fetched in parallel, defaults to 4
+	DownloadWorkers int
+
+	// directory to cache encrypted files in, disabled when empty
+	CachePath string
+	// max size of cached files, defaults to 1 GB
+	CacheSizeMb int
+
+	// secondary MinIO endpoints every write is mirrored to
+	Replicas []ReplicaConfig
+	// ReplicationAsync (default) mirrors writes in the background,
+	// ReplicationSync before responding to the client
+	ReplicationMode string
+
+	// clients have to authenticate with one of these when set
+	APIKeys []APIKey
+	// JSON file with an array of more API keys
+	APIKeysFile string
+	// accepts OIDC tokens as bearer tokens when JWKS is set
+	JWT JWTConfig
+	// JSON file with access rules, reloaded when it changes
+	PolicyFile string
+
+	// buckets and prefixes of tenants API keys and tokens are issued for
+	Tenants []TenantConfig
+	// JSON file with an array of more tenants
+	TenantsFile string
+
+	// one of StorageMinio (default), StorageFS or StorageMemory
+	StorageBackend string
+	// root directory of StorageFS
+	StoragePath string
+	// overrides StorageBackend when set
+	Storage Storage
+
 	EncKey  []byte
 	HmacKey []byte
+	// signs share links and upload tickets, they are disabled when empty.
+	// Needs UploadStatePath.
+	ShareKey []byte
+}
+
+type ReplicaConfig struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	// detected from the bucket when empty
+	Region string
+	// overrides Endpoint when set
+	Storage Storage
 }
 
 func (c *Config) uploadChunkSizeInBytes() int64 {
 	return int64(c.UploadChunkSizeMb) * 1024 * 1024
 }
 
+func (c *Config) uploadWorkers() int {
+	if c.UploadWorkers <= 0 {
+		return defaultUploadWorkers
+	}
+	return c.UploadWorkers
+}
+
+func (c *Config) uploadSpoolLimitInBytes() int64 {
+	if c.UploadSpoolLimitMb <= 0 {
+		return defaultUploadSpoolLimitMB * 1024 * 1024
+	}
+	return int64(c.UploadSpoolLimitMb) * 1024 * 1024
+}
+
+func (c *Config) uploadExpiry() time.Duration {
+	if c.UploadExpiry <= 0 {
+		return defaultUploadExpiry
+	}
+	return c.UploadExpiry
+}
+
+func (c *Config) uploadMemoryLimitInBytes() int64 {
+	if c.UploadMemoryLimitMb <= 0 {
+		return defaultUploadMemoryLimitMB * 1024 * 1024
+	}
+	return int64(c.UploadMemoryLimitMb) * 1024 * 1024
+}
+
+func (c *Config) downloadSegmentSizeInBytes() int64 {
+	return int64(c.DownloadSegmentSizeMb) * 1024 * 1024
+}
+
+func (c *Config) downloadWorkers() int {
+	if c.DownloadWorkers <= 0 {
+		return defaultDownloadWorkers
+	}
+	return c.DownloadWorkers
+}
+
+func (c *Config) cacheSizeInBytes() int64 {
+	if c.CacheSizeMb <= 0 {
+		return defaultCacheSizeMB * 1024 * 1024
+	}
+	return int64(c.CacheSizeMb) * 1024 * 1024
+}
+
+// BucketName and buckets of tenants
+func (c *Config) buckets() []string {
+	buckets := []string{c.BucketName}
+	for _, tenant := range c.Tenants {
+		if len(tenant.Bucket) > 0 && !slices.Contains(buckets, tenant.Bucket) {
+			buckets = append(buckets, tenant.Bucket)
+		}
+	}
+	return buckets
+}
+
+func (c *Config) usesMinio() bool {
+	return c.Storage == nil && (len(c.StorageBackend) == 0 || c.StorageBackend == StorageMinio)
+}
+
 func (c *Config) validate() error {
 	var errs []error
 
 	if len(c.ServerAddr) < 5 || !strings.Contains(c.ServerAddr, ":") {
 		errs = append(errs, errors.New("invalid ServerAddr, :port required at least"))
 	}
-	if len(c.Endpoint) == 0 {
-		errs = append(errs, errors.New("missing minio endpoint"))
-	} else if _, err := url.Parse(c.Endpoint); err != nil {
-		errs = append(errs, errors.New("endpoint is not a valid url"))
-	}
+	if c.usesMinio() {
+		if len(c.Endpoint) == 0 {
+			errs = append(errs, errors.New("missing minio endpoint"))
+		} else if _, err := url.Parse(c.Endpoint); err != nil {
+			errs = append(errs, errors.New("endpoint is not a valid url"))
+		}
 
-	if len(c.AccessKey) == 0 {
-		errs = append(errs, errors.New("missing minio access key"))
+		// other credentials are checked when they are read
+		if len(c.CredentialsFile) == 0 && len(c.STS.WebIdentityTokenFile) == 0 {
+			if len(c.AccessKey) == 0 {
+				errs = append(errs, errors.New("missing minio access key"))
+			}
+			if len(c.SecretKey) == 0 {
+				errs = append(errs, errors.New("missing minio secret key"))
+			}
+		}
+	}
+	switch c.Addressing {
+	case presign.AddressingAuto, presign.AddressingPath, presign.AddressingVirtualHost:
+	default:
+		errs = append(errs, fmt.Errorf("unknown Addressing %q", c.Addressing))
 	}
-	if len(c.SecretKey) == 0 {
-		errs = append(errs, errors.New("missing minio secret key"))
+	errs = append(errs, c.Transport.validate()...)
+	switch c.StorageBackend {
+	case "", StorageMinio, StorageMemory:
+	case StorageFS:
+		if len(c.StoragePath) == 0 && c.Storage == nil {
+			errs = append(errs, errors.New("missing StoragePath for fs storage"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown StorageBackend %q", c.StorageBackend))
 	}
 	if len(c.BucketName) == 0 {
 		errs = append(errs, errors.New("missing BucketName"))
@@ -61,12 +243,65 @@ func (c *Config) validate() error {
 	if bytes.Equal(c.EncKey, c.HmacKey) {
 		errs = append(errs, errors.New("EncKey and HmacKey can't be same"))
 	}
+	if len(c.ShareKey) > 0 && len(c.ShareKey) != 32 {
+		errs = append(errs, errors.New("ShareKey needs to be 32b"))
+	}
+	if len(c.ShareKey) > 0 && (bytes.Equal(c.ShareKey, c.EncKey) || bytes.Equal(c.ShareKey, c.HmacKey)) {
+		errs = append(errs, errors.New("ShareKey can't be same as EncKey or HmacKey"))
+	}
+	// used tickets kept only in memory could be used again after a restart
+	if len(c.ShareKey) > 0 && len(c.UploadStatePath) == 0 {
+		errs = append(errs, errors.New("ShareKey needs UploadStatePath to keep track of used upload tickets"))
+	}
 	if c.UploadChunkSizeMb > 0 && c.UploadChunkSizeMb < MIN_CHUNK_SIZE_MB {
 		errs = append(errs, fmt.Errorf("UploadChunkSizeMb needs to be at least %d MB", MIN_CHUNK_SIZE_MB))
 	}
 	if c.UploadChunkSizeMb > maxChunkedFileSizeMB {
 		errs = append(errs, fmt.Errorf("UploadChunkSizeMb can be max %d MB", maxChunkedFileSizeMB))
 	}
+	if c.uploadChunkSizeInBytes() > c.uploadMemoryLimitInBytes() {
+		errs = append(errs, fmt.Errorf("UploadChunkSizeMb can't be larger than the upload memory limit of %d MB", c.uploadMemoryLimitInBytes()/1024/1024))
+	}
+	if c.UploadMemoryLimitMb > 0 && c.UploadMemoryLimitMb < MIN_CHUNK_SIZE_MB {
+		errs = append(errs, fmt.Errorf("UploadMemoryLimitMb needs to be at least %d MB", MIN_CHUNK_SIZE_MB))
+	}
+
+	for i, replica := range c.Replicas {
+		if replica.Storage != nil {
+			continue
+		}
+		if _, err := url.Parse(replica.Endpoint); err != nil || len(replica.Endpoint) == 0 {
+			errs = append(errs, fmt.Errorf("replica %d endpoint is not a valid url", i))
+		}
+		if len(replica.AccessKey) == 0 || len(replica.SecretKey) == 0 {
+			errs = append(errs, fmt.Errorf("missing replica %d access or secret key", i))
+		}
+	}
+	switch c.ReplicationMode {
+	case "", ReplicationAsync, ReplicationSync:
+	default:
+		errs = append(errs, fmt.Errorf("unknown ReplicationMode %q", c.ReplicationMode))
+	}
+	errs = append(errs, c.JWT.validate()...)
+	tenants := make(map[string]bool, len(c.Tenants))
+	for _, tenant := range c.Tenants {
+		if err := validateTenantID(tenant.ID); err != nil {
+			errs = append(errs, err)
+		}
+		if tenants[tenant.ID] {
+			errs = append(errs, fmt.Errorf("duplicate tenant %q", tenant.ID))
+		}
+		tenants[tenant.ID] = true
+	}
+	errs = append(errs, validateTenantLocations(c.Tenants, c.BucketName)...)
+	for _, key := range c.APIKeys {
+		if err := key.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.DownloadSegmentSizeMb < 0 {
+		errs = append(errs, errors.New("DownloadSegmentSizeMb can't be negative"))
+	}
 
 	return errors.Join(errs...)
 }
@@ -1,6 +1,9 @@
 package minioproxy
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestConfigValidation(t *testing.T) {
 	cfg := &Config{}
@@ -20,6 +23,16 @@ func TestConfigValidation(t *testing.T) {
 	if err := cfg.validate(); err != nil {
 		t.Error("expected config to be valid, instead got:", err)
 	}
+
+	// used upload tickets have to survive restarts
+	cfg.ShareKey = genRandBytes(32)
+	if err := cfg.validate(); err == nil {
+		t.Error("expected ShareKey without UploadStatePath to be invalid")
+	}
+	cfg.UploadStatePath = t.TempDir()
+	if err := cfg.validate(); err != nil {
+		t.Error("expected ShareKey with UploadStatePath to be valid, got:", err)
+	}
 }
 
 func TestConfigInvalidEndpoint(t *testing.T) {
@@ -42,4 +55,36 @@ func TestConfigInvalidChunkSize(t *testing.T) {
 	if err := cfg.validate(); err == nil {
 		t.Error("expected config validation to fail: too large chunk size")
 	}
+	// chunks are buffered in memory, the default limit applies too
+	cfg.UploadChunkSizeMb = 1024
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Error("expected config validation to fail: chunk size over memory limit, got", err)
+	}
+	cfg.UploadMemoryLimitMb = 2048
+	if err := cfg.validate(); err != nil && strings.Contains(err.Error(), "memory limit") {
+		t.Error("expected chunk size within memory limit to be valid, got", err)
+	}
+}
+
+func TestConfigStorageBackend(t *testing.T) {
+	cfg := &Config{
+		ServerAddr:     ":1234",
+		BucketName:     "test",
+		EncKey:         genRandBytes(32),
+		HmacKey:        genRandBytes(32),
+		StorageBackend: StorageMemory,
+	}
+	if err := cfg.validate(); err != nil {
+		t.Error("expected memory storage not to require minio settings, got:", err)
+	}
+
+	cfg.StorageBackend = StorageFS
+	if err := cfg.validate(); err == nil {
+		t.Error("expected config validation to fail: missing fs storage path")
+	}
+
+	cfg.StorageBackend = "tape"
+	if err := cfg.validate(); err == nil {
+		t.Error("expected config validation to fail: unknown storage backend")
+	}
 }
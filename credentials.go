@@ -0,0 +1,370 @@
+package minioproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josip/minioproxy/presign"
+)
+
+const (
+	// credentials are refreshed this long before they expire
+	credentialsRefreshWindow = 5 * time.Minute
+	// failed refreshes are retried after this long, doubling up to the max
+	credentialsRetryMin = 5 * time.Second
+	credentialsRetryMax = time.Minute
+	// shared credentials file is read again after this long
+	credentialsFileTTL  = 5 * time.Minute
+	defaultSTSDuration  = time.Hour
+	stsVersion          = "2011-06-15"
+	defaultCredsProfile = "default"
+)
+
+// Exchanges credentials for temporary ones with MinIO STS API
+type STSConfig struct {
+	// defaults to MinIO endpoint
+	Endpoint string
+	// assumes a role with AccessKey and SecretKey, or credentials from the
+	// credentials file
+	AssumeRole bool
+	// optional for MinIO
+	RoleArn string
+	// file with a JWT exchanged with AssumeRoleWithWebIdentity, used instead
+	// of other credentials when set
+	WebIdentityTokenFile string
+	// how long temporary credentials are valid for, defaults to 1 hour
+	Duration time.Duration
+}
+
+type credentialsProvider interface {
+	// returns credentials and when they expire, zero time for never
+	Retrieve() (presign.Credentials, time.Time, error)
+}
+
+// Caches credentials and gets new ones in the background before they expire,
+// so signing never waits for STS. If refreshing fails the old credentials are
+// used and it's retried with a backoff.
+type refreshingCredentials struct {
+	provider credentialsProvider
+
+	mu       sync.Mutex
+	creds    presign.Credentials
+	expires  time.Time
+	failures int
+}
+
+func newCredentialsProvider(ctx context.Context, cfg Config, client *http.Client) (*refreshingCredentials, error) {
+	var chain credentialsChain
+	if len(cfg.AccessKey) > 0 {
+		chain = append(chain, staticCredentials{presign.Credentials{
+			AccessKeyID:     cfg.AccessKey,
+			AccessKeySecret: cfg.SecretKey,
+			SessionToken:    cfg.SessionToken,
+		}})
+	}
+	if len(cfg.CredentialsFile) > 0 {
+		chain = append(chain, &fileCredentials{path: cfg.CredentialsFile, profile: cfg.CredentialsProfile})
+	}
+
+	sts := stsClient{
+		endpoint: cfg.STS.Endpoint,
+		region:   cfg.Region,
+		duration: withDefault(cfg.STS.Duration, defaultSTSDuration),
+		roleArn:  cfg.STS.RoleArn,
+		http:     client,
+	}
+	if len(sts.endpoint) == 0 {
+		sts.endpoint = cfg.Endpoint
+	}
+	if len(cfg.STS.WebIdentityTokenFile) > 0 {
+		chain = append(chain, &webIdentityCredentials{sts: sts, tokenFile: cfg.STS.WebIdentityTokenFile})
+	}
+
+	var provider credentialsProvider = chain
+	if cfg.STS.AssumeRole {
+		provider = &assumeRoleCredentials{sts: sts, base: chain}
+	}
+
+	creds := &refreshingCredentials{provider: provider}
+	if err := creds.refresh(); err != nil {
+		return nil, fmt.Errorf("failed to get minio credentials: %w", err)
+	}
+	go creds.run(ctx)
+	return creds, nil
+}
+
+func (c *refreshingCredentials) Credentials() presign.Credentials {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.creds
+}
+
+// Refreshes credentials until ctx is done or they stop expiring
+func (c *refreshingCredentials) run(ctx context.Context) {
+	for {
+		wait, ok := c.refreshIn()
+		if !ok {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := c.refresh(); err != nil {
+			c.mu.Lock()
+			expires := c.expires
+			c.mu.Unlock()
+			log.Println("failed to refresh minio credentials, expiring at", expires, err)
+		}
+	}
+}
+
+// Returns how long until the next refresh, false if credentials never expire
+func (c *refreshingCredentials) refreshIn() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.expires.IsZero() {
+		return 0, false
+	}
+	if c.failures > 0 {
+		return min(credentialsRetryMin<<(c.failures-1), credentialsRetryMax), true
+	}
+	// short lived credentials are refreshed halfway through
+	until := time.Until(c.expires)
+	return max(until-credentialsRefreshWindow, until/2), true
+}
+
+func (c *refreshingCredentials) refresh() error {
+	// signing goes on with current credentials while waiting for new ones
+	creds, expires, err := c.provider.Retrieve()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.failures = min(c.failures+1, 16)
+		return err
+	}
+	c.creds, c.expires, c.failures = creds, expires, 0
+	return nil
+}
+
+// Uses first provider which has credentials
+type credentialsChain []credentialsProvider
+
+func (chain credentialsChain) Retrieve() (presign.Credentials, time.Time, error) {
+	errs := []error{errors.New("no credentials found")}
+	for _, provider := range chain {
+		creds, expires, err := provider.Retrieve()
+		if err == nil {
+			return creds, expires, nil
+		}
+		errs = append(errs, err)
+	}
+	return presign.Credentials{}, time.Time{}, errors.Join(errs...)
+}
+
+type staticCredentials struct {
+	creds presign.Credentials
+}
+
+func (p staticCredentials) Retrieve() (presign.Credentials, time.Time, error) {
+	return p.creds, time.Time{}, nil
+}
+
+func (p staticCredentials) Credentials() presign.Credentials {
+	return p.creds
+}
+
+// Reads a profile from a shared credentials file (~/.aws/credentials)
+type fileCredentials struct {
+	path    string
+	profile string
+}
+
+func (p *fileCredentials) Retrieve() (presign.Credentials, time.Time, error) {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return presign.Credentials{}, time.Time{}, err
+	}
+	defer file.Close()
+
+	profile := p.profile
+	if len(profile) == 0 {
+		profile = defaultCredsProfile
+	}
+
+	var creds presign.Credentials
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, "=")
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.AccessKeySecret = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return presign.Credentials{}, time.Time{}, err
+	}
+
+	if len(creds.AccessKeyID) == 0 || len(creds.AccessKeySecret) == 0 {
+		return presign.Credentials{}, time.Time{}, fmt.Errorf("no credentials for profile %q in %s", profile, p.path)
+	}
+	// file can be updated, it's read again from time to time
+	return creds, time.Now().Add(credentialsFileTTL + credentialsRefreshWindow), nil
+}
+
+type assumeRoleCredentials struct {
+	sts  stsClient
+	base credentialsProvider
+}
+
+func (p *assumeRoleCredentials) Retrieve() (presign.Credentials, time.Time, error) {
+	base, _, err := p.base.Retrieve()
+	if err != nil {
+		return presign.Credentials{}, time.Time{}, err
+	}
+
+	params := url.Values{}
+	params.Set("Action", "AssumeRole")
+	return p.sts.request(params, &presign.Signer{
+		AccessKeyID:     base.AccessKeyID,
+		AccessKeySecret: base.AccessKeySecret,
+		SessionToken:    base.SessionToken,
+		Region:          p.sts.region,
+	})
+}
+
+type webIdentityCredentials struct {
+	sts       stsClient
+	tokenFile string
+}
+
+func (p *webIdentityCredentials) Retrieve() (presign.Credentials, time.Time, error) {
+	// token is read every time as it's usually rotated by the platform
+	token, err := os.ReadFile(p.tokenFile)
+	if err != nil {
+		return presign.Credentials{}, time.Time{}, err
+	}
+
+	params := url.Values{}
+	params.Set("Action", "AssumeRoleWithWebIdentity")
+	params.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	return p.sts.request(params, nil)
+}
+
+type stsClient struct {
+	endpoint string
+	region   string
+	duration time.Duration
+	roleArn  string
+	http     *http.Client
+}
+
+type stsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+type stsResponse struct {
+	AssumeRole struct {
+		Credentials stsCredentials
+	} `xml:"AssumeRoleResult"`
+	AssumeRoleWithWebIdentity struct {
+		Credentials stsCredentials
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+type stsError struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// Sends a request to STS API, signed when signer is set
+func (c stsClient) request(params url.Values, signer *presign.Signer) (presign.Credentials, time.Time, error) {
+	params.Set("Version", stsVersion)
+	params.Set("DurationSeconds", strconv.Itoa(int(c.duration.Seconds())))
+	if len(c.roleArn) > 0 {
+		params.Set("RoleArn", c.roleArn)
+	}
+	body := []byte(params.Encode())
+
+	req, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return presign.Credentials{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if signer != nil {
+		signer.Sign(req, "sts", body)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return presign.Credentials{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return presign.Credentials{}, time.Time{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var stsErr stsError
+		xml.Unmarshal(respBody, &stsErr)
+		return presign.Credentials{}, time.Time{}, fmt.Errorf("%s failed with %d: %s %s", params.Get("Action"), resp.StatusCode, stsErr.Code, stsErr.Message)
+	}
+
+	var result stsResponse
+	if err := xml.Unmarshal(respBody, &result); err != nil {
+		return presign.Credentials{}, time.Time{}, err
+	}
+	creds := result.AssumeRole.Credentials
+	if len(creds.AccessKeyId) == 0 {
+		creds = result.AssumeRoleWithWebIdentity.Credentials
+	}
+	if len(creds.AccessKeyId) == 0 {
+		return presign.Credentials{}, time.Time{}, errors.New("no credentials in STS response")
+	}
+
+	return presign.Credentials{
+		AccessKeyID:     creds.AccessKeyId,
+		AccessKeySecret: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}, creds.Expiration, nil
+}
@@ -0,0 +1,164 @@
+package minioproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Stand-in for MinIO STS API, issues credentials valid for lifetime
+func newMockSTS(t *testing.T, lifetime time.Duration) (*httptest.Server, *atomic.Int32) {
+	var issued atomic.Int32
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		action := r.Form.Get("Action")
+		switch {
+		case action == "AssumeRole" && strings.Contains(r.Header.Get("Authorization"), "Credential=base-key/"):
+		case action == "AssumeRoleWithWebIdentity" && r.Form.Get("WebIdentityToken") == "jwt":
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>denied</Message></Error></ErrorResponse>`)
+			return
+		}
+
+		n := issued.Add(1)
+		fmt.Fprintf(w, `<%[1]sResponse><%[1]sResult><Credentials>
+			<AccessKeyId>temp-%[2]d</AccessKeyId>
+			<SecretAccessKey>secret-%[2]d</SecretAccessKey>
+			<SessionToken>token-%[2]d</SessionToken>
+			<Expiration>%[3]s</Expiration>
+		</Credentials></%[1]sResult></%[1]sResponse>`, action, n, time.Now().Add(lifetime).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(sts.Close)
+	return sts, &issued
+}
+
+func TestAssumeRoleCredentials(t *testing.T) {
+	sts, issued := newMockSTS(t, time.Hour)
+	creds, err := newCredentialsProvider(context.Background(), Config{
+		Endpoint:  sts.URL,
+		AccessKey: "base-key",
+		SecretKey: "base-secret",
+		STS:       STSConfig{AssumeRole: true},
+	}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := creds.Credentials()
+	if got.AccessKeyID != "temp-1" || got.SessionToken != "token-1" {
+		t.Error("expected temporary credentials, got", got)
+	}
+	creds.Credentials()
+	if issued.Load() != 1 {
+		t.Error("expected credentials to be reused until they expire, got", issued.Load())
+	}
+}
+
+func TestWebIdentityCredentialsRefresh(t *testing.T) {
+	// always within the refresh window
+	sts, issued := newMockSTS(t, time.Minute)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("jwt\n"), 0o600)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	creds, err := newCredentialsProvider(ctx, Config{
+		Endpoint: sts.URL,
+		STS:      STSConfig{WebIdentityTokenFile: tokenFile},
+	}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// signing doesn't wait for a refresh
+	if got := creds.Credentials(); got.AccessKeyID != "temp-1" || issued.Load() != 1 {
+		t.Error("expected current credentials to be used, got", got)
+	}
+	if wait, ok := creds.refreshIn(); !ok || wait > 30*time.Second || wait < 20*time.Second {
+		t.Error("expected short lived credentials to be refreshed halfway through, got", wait)
+	}
+
+	// old credentials are kept when refreshing fails, retries back off
+	os.WriteFile(tokenFile, []byte("revoked"), 0o600)
+	for i := 1; i <= 2; i++ {
+		if err := creds.refresh(); err == nil {
+			t.Fatal("expected refresh with revoked token to fail")
+		}
+		if wait, _ := creds.refreshIn(); wait != credentialsRetryMin*time.Duration(i) {
+			t.Error("expected retry to back off, got", wait)
+		}
+	}
+	if got := creds.Credentials(); got.AccessKeyID != "temp-1" {
+		t.Error("expected last credentials to be used, got", got)
+	}
+
+	os.WriteFile(tokenFile, []byte("jwt"), 0o600)
+	if err := creds.refresh(); err != nil || creds.Credentials().AccessKeyID != "temp-2" {
+		t.Error("expected credentials to be refreshed, got", err, creds.Credentials())
+	}
+}
+
+func TestCredentialsRefreshInBackground(t *testing.T) {
+	sts, issued := newMockSTS(t, 2*time.Second)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("jwt"), 0o600)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	creds, err := newCredentialsProvider(ctx, Config{
+		Endpoint: sts.URL,
+		STS:      STSConfig{WebIdentityTokenFile: tokenFile},
+	}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); issued.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := creds.Credentials(); got.AccessKeyID == "temp-1" {
+		t.Error("expected credentials to be refreshed before they expire, got", got)
+	}
+}
+
+func TestCredentialsChain(t *testing.T) {
+	credsFile := filepath.Join(t.TempDir(), "credentials")
+	os.WriteFile(credsFile, []byte(`
+[default]
+aws_access_key_id = default-key
+aws_secret_access_key = default-secret
+
+[proxy]
+aws_access_key_id = proxy-key
+aws_secret_access_key = proxy-secret
+aws_session_token = proxy-token
+`), 0o600)
+
+	creds, err := newCredentialsProvider(context.Background(), Config{CredentialsFile: credsFile, CredentialsProfile: "proxy"}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := creds.Credentials(); got.AccessKeyID != "proxy-key" || got.SessionToken != "proxy-token" {
+		t.Error("expected credentials from the file, got", got)
+	}
+
+	creds, err = newCredentialsProvider(context.Background(), Config{AccessKey: "static", SecretKey: "secret", CredentialsFile: credsFile}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := creds.Credentials(); got.AccessKeyID != "static" {
+		t.Error("expected static credentials to be used first, got", got)
+	}
+
+	if _, err := newCredentialsProvider(context.Background(), Config{CredentialsFile: credsFile, CredentialsProfile: "missing"}, http.DefaultClient); err == nil {
+		t.Error("expected missing profile to fail")
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"math/big"
 	"os"
 )
 
@@ -40,6 +43,13 @@ func genIv() ([]byte, error) {
 // File format:
 // [random iv: 16b][encrypted content: variable, same size as original content][hmac sum: 32b]
 func encryptStream(encKey []byte, hmacKey []byte, input io.Reader) io.Reader {
+	return encryptStreamWithTrailer(encKey, hmacKey, input, nil)
+}
+
+// Same as encryptStream, but once input ends trailer is called and what it
+// returns is encrypted and authenticated right after the content:
+// [random iv: 16b][encrypted content][encrypted trailer][hmac sum: 32b]
+func encryptStreamWithTrailer(encKey []byte, hmacKey []byte, input io.Reader, trailer func() []byte) io.Reader {
 	r, w := io.Pipe()
 
 	go func() {
@@ -79,6 +89,13 @@ func encryptStream(encKey []byte, hmacKey []byte, input io.Reader) io.Reader {
 			}
 		}
 
+		if trailer != nil {
+			outBuf := trailer()
+			ctr.XORKeyStream(outBuf, outBuf)
+			sig.Write(outBuf)
+			w.Write(outBuf)
+		}
+
 		mac := sig.Sum(nil)
 		w.Write(mac)
 		// log.Printf("data encrypted with [%x, %x]", iv, mac)
@@ -92,6 +109,13 @@ func encryptStream(encKey []byte, hmacKey []byte, input io.Reader) io.Reader {
 // 1. stream is decrypted into a temporary file to recalculate its HMAC
 // 2. if the HMAC is correct, the temporary, now in cleartext, is written to `dest`
 func decryptStream(encKey []byte, hmacKey []byte, input io.Reader, fileSize int64, dest io.Writer) error {
+	return decryptStreamWithTrailer(encKey, hmacKey, input, fileSize, 0, dest, nil)
+}
+
+// Decrypts a stream written by encryptStreamWithTrailer with a trailer of
+// trailerSize bytes. Once the HMAC is verified the trailer is passed to
+// onTrailer, before anything is written to dest.
+func decryptStreamWithTrailer(encKey []byte, hmacKey []byte, input io.Reader, fileSize int64, trailerSize int64, dest io.Writer, onTrailer func(trailer []byte) error) error {
 	// step 1 Read IV used for AES
 	iv := make([]byte, IV_SIZE)
 	if n, err := input.Read(iv); n != IV_SIZE || err != nil {
@@ -158,12 +182,93 @@ func decryptStream(encKey []byte, hmacKey []byte, input io.Reader, fileSize int6
 		return ErrTamperedFile
 	}
 
-	// step 4 - stream temp file to client
+	// step 4 - stream temp file to client, without the trailer
 	tmp.Sync()
+	contentSize := fileSize - int64(ENC_META_SIZE) - trailerSize
+	if trailerSize > 0 {
+		trailer := make([]byte, trailerSize)
+		if _, err := tmp.ReadAt(trailer, contentSize); err != nil {
+			return ErrTamperedFile
+		}
+		if err := onTrailer(trailer); err != nil {
+			return err
+		}
+	}
 	tmp.Seek(0, io.SeekStart)
-	if _, err = io.Copy(dest, tmp); err != nil && err != io.EOF {
+	if _, err = io.Copy(dest, io.LimitReader(tmp, contentSize)); err != nil && err != io.EOF {
 		return err
 	}
 
 	return nil
 }
+
+// Returns AES-CTR stream positioned at offset bytes of the encrypted content,
+// so a file can be encrypted in several sittings.
+func newCTRAt(encKey, iv []byte, offset int64) (cipher.Stream, error) {
+	cip, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// CTR treats the IV as a 128-bit big-endian counter, incremented once per block
+	counter := new(big.Int).SetBytes(iv)
+	counter.Add(counter, big.NewInt(offset/int64(aes.BlockSize)))
+	counterBytes := counter.Bytes()
+	blockIv := make([]byte, IV_SIZE)
+	// counter overflows the same way as in cipher.NewCTR
+	if len(counterBytes) > IV_SIZE {
+		counterBytes = counterBytes[len(counterBytes)-IV_SIZE:]
+	}
+	copy(blockIv[IV_SIZE-len(counterBytes):], counterBytes)
+
+	ctr := cipher.NewCTR(cip, blockIv)
+	skip := make([]byte, offset%int64(aes.BlockSize))
+	ctr.XORKeyStream(skip, skip)
+
+	return ctr, nil
+}
+
+// HMAC-SHA256 which can be saved and restored between requests, produces the
+// same sums as hmac.New(sha256.New, key) for keys up to 64 bytes.
+type resumableMac struct {
+	key   []byte
+	inner hash.Hash
+}
+
+func newResumableMac(key []byte) *resumableMac {
+	m := &resumableMac{key: key, inner: sha256.New()}
+	m.inner.Write(m.pad(0x36))
+	return m
+}
+
+func restoreResumableMac(key []byte, state []byte) (*resumableMac, error) {
+	m := &resumableMac{key: key, inner: sha256.New()}
+	if err := m.inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *resumableMac) Write(p []byte) (int, error) {
+	return m.inner.Write(p)
+}
+
+func (m *resumableMac) Sum() []byte {
+	outer := sha256.New()
+	outer.Write(m.pad(0x5c))
+	outer.Write(m.inner.Sum(nil))
+	return outer.Sum(nil)
+}
+
+func (m *resumableMac) State() ([]byte, error) {
+	return m.inner.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func (m *resumableMac) pad(b byte) []byte {
+	pad := make([]byte, sha256.BlockSize)
+	copy(pad, m.key)
+	for i := range pad {
+		pad[i] ^= b
+	}
+	return pad
+}
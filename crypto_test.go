@@ -113,6 +113,41 @@ func TestTamper(t *testing.T) {
 	}
 }
 
+func TestEncryptWithTrailer(t *testing.T) {
+	aesKey := genRandBytes(32)
+	hmacKey := genRandBytes(32)
+
+	fileContents := genRandBytes(3*ENC_BUFFER_SIZE + 7)
+	trailer := []byte("trailer")
+	encrypted, _ := io.ReadAll(encryptStreamWithTrailer(aesKey, hmacKey, bytes.NewReader(fileContents), func() []byte {
+		return bytes.Clone(trailer)
+	}))
+	fileSize := int64(len(encrypted))
+	if fileSize != int64(len(fileContents)+len(trailer)+ENC_META_SIZE) {
+		t.Fatal("unexpected size of encrypted file", fileSize)
+	}
+
+	var decrypted bytes.Buffer
+	var decryptedTrailer []byte
+	err := decryptStreamWithTrailer(aesKey, hmacKey, bytes.NewReader(encrypted), fileSize, int64(len(trailer)), &decrypted, func(t []byte) error {
+		decryptedTrailer = t
+		return nil
+	})
+	if err != nil || !bytes.Equal(decrypted.Bytes(), fileContents) || !bytes.Equal(decryptedTrailer, trailer) {
+		t.Error("expected content and trailer to be decrypted, got", err, string(decryptedTrailer))
+	}
+
+	encrypted[len(encrypted)-HMAC_SIZE-1] ^= 1
+	decrypted.Reset()
+	err = decryptStreamWithTrailer(aesKey, hmacKey, bytes.NewReader(encrypted), fileSize, int64(len(trailer)), &decrypted, func([]byte) error {
+		t.Error("expected tampered trailer not to be passed on")
+		return nil
+	})
+	if !errors.Is(err, ErrTamperedFile) || decrypted.Len() > 0 {
+		t.Error("expected tampered trailer to be detected, got", err)
+	}
+}
+
 func TestWrongKeys(t *testing.T) {
 	aesKey := genRandBytes(32)
 	hmacKey := genRandBytes(32)
@@ -158,3 +193,44 @@ func TestFileReadError(t *testing.T) {
 		t.Error("expected encryption to fail when input reader fails too")
 	}
 }
+
+func TestResumableEncryption(t *testing.T) {
+	aesKey := genRandBytes(32)
+	hmacKey := genRandBytes(32)
+	fileContents := genRandBytes(ENC_BUFFER_SIZE*3 + 7)
+
+	iv, _ := genIv()
+	// worst case, the counter overflows while encrypting
+	for i := range iv {
+		iv[i] = 0xff
+	}
+	encrypted := bytes.NewBuffer(iv)
+	mac := newResumableMac(hmacKey)
+	mac.Write(iv)
+
+	// encrypt in pieces not aligned with AES blocks, restoring state each time
+	for offset := 0; offset < len(fileContents); {
+		end := min(offset+1001, len(fileContents))
+		ctr, err := newCTRAt(aesKey, iv, int64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]byte, end-offset)
+		ctr.XORKeyStream(out, fileContents[offset:end])
+		mac.Write(out)
+		encrypted.Write(out)
+
+		state, _ := mac.State()
+		if mac, err = restoreResumableMac(hmacKey, state); err != nil {
+			t.Fatal("can't restore mac", err)
+		}
+		offset = end
+	}
+	encrypted.Write(mac.Sum())
+
+	fileSize := int64(encrypted.Len())
+	decrypted, err := decryptToBuffer(aesKey, hmacKey, encrypted, fileSize)
+	if err != nil || !bytes.Equal(fileContents, decrypted) {
+		t.Error("expected file encrypted in pieces to decrypt, got", err)
+	}
+}
@@ -0,0 +1,246 @@
+package minioproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errDigestMismatch = errors.New("digest doesn't match content")
+var errInvalidDigest = errors.New("invalid digest")
+
+// digest algorithms from the IANA registry of RFC 9530 the proxy supports
+const (
+	digestSHA256 = "sha-256"
+	digestCRC32C = "crc32c"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Digests of cleartext, base64 encoded as in Repr-Digest and Content-Digest
+// headers
+type fileDigests struct {
+	SHA256 string `json:"sha256,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// Digests sent by the client with Repr-Digest or Content-Digest, uploads
+// aren't content encoded so both are digests of the file. Unknown algorithms
+// are ignored.
+func requestDigests(header http.Header) (fileDigests, error) {
+	var digests fileDigests
+	for _, name := range []string{"Repr-Digest", "Content-Digest"} {
+		for _, value := range header.Values(name) {
+			if err := parseDigests(value, &digests); err != nil {
+				return digests, fmt.Errorf("%w in %s: %w", errInvalidDigest, name, err)
+			}
+		}
+	}
+	return digests, nil
+}
+
+// Parses a structured field dictionary like `sha-256=:base64:, crc32c=:base64:`
+// into digests, parameters of its members are ignored
+func parseDigests(value string, digests *fileDigests) error {
+	for _, member := range strings.Split(value, ",") {
+		member, _, _ = strings.Cut(member, ";")
+		algorithm, encoded, found := strings.Cut(strings.TrimSpace(member), "=")
+		if !found || len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+			return fmt.Errorf("malformed digest %q", member)
+		}
+
+		size := 0
+		var field *string
+		switch strings.ToLower(algorithm) {
+		case digestSHA256:
+			size, field = sha256.Size, &digests.SHA256
+		case digestCRC32C:
+			size, field = crc32.Size, &digests.CRC32C
+		default:
+			continue
+		}
+
+		encoded = encoded[1 : len(encoded)-1]
+		if sum, err := base64.StdEncoding.DecodeString(encoded); err != nil || len(sum) != size {
+			return fmt.Errorf("malformed %s digest", algorithm)
+		}
+		if len(*field) > 0 && *field != encoded {
+			return fmt.Errorf("conflicting %s digests", algorithm)
+		}
+		*field = encoded
+	}
+	return nil
+}
+
+func (d fileDigests) String() string {
+	var members []string
+	if len(d.SHA256) > 0 {
+		members = append(members, digestSHA256+"=:"+d.SHA256+":")
+	}
+	if len(d.CRC32C) > 0 {
+		members = append(members, digestCRC32C+"=:"+d.CRC32C+":")
+	}
+	return strings.Join(members, ", ")
+}
+
+// Downloads are neither content encoded nor partial, so content and
+// representation digests are the same
+func setDigestHeaders(w http.ResponseWriter, digests fileDigests) {
+	if value := digests.String(); len(value) > 0 {
+		w.Header().Set("Repr-Digest", value)
+		w.Header().Set("Content-Digest", value)
+	}
+}
+
+// Computes digests of cleartext as it's read for encryptStream. When expected
+// digests are set, reading fails at the end of input if they don't match.
+type digestReader struct {
+	input    io.Reader
+	expected fileDigests
+	sha256   hash.Hash
+	crc32c   hash.Hash32
+	mismatch bool
+}
+
+func newDigestReader(input io.Reader, expected fileDigests) *digestReader {
+	return &digestReader{
+		input:    input,
+		expected: expected,
+		sha256:   sha256.New(),
+		crc32c:   crc32.New(crc32cTable),
+	}
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.input.Read(p)
+	r.sha256.Write(p[:n])
+	r.crc32c.Write(p[:n])
+
+	if err == io.EOF && !r.matches() {
+		r.mismatch = true
+		return n, errDigestMismatch
+	}
+	return n, err
+}
+
+func (r *digestReader) matches() bool {
+	return matchesDigest(r.expected.SHA256, r.sha256) && matchesDigest(r.expected.CRC32C, r.crc32c)
+}
+
+func matchesDigest(expected string, h hash.Hash) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	sum, _ := base64.StdEncoding.DecodeString(expected)
+	return bytes.Equal(sum, h.Sum(nil))
+}
+
+// Digests of everything read so far
+func (r *digestReader) Digests() fileDigests {
+	return fileDigests{
+		SHA256: base64.StdEncoding.EncodeToString(r.sha256.Sum(nil)),
+		CRC32C: base64.StdEncoding.EncodeToString(r.crc32c.Sum(nil)),
+	}
+}
+
+// Trailer with digests of the content, to be sealed into the file by
+// encryptStreamWithTrailer
+func (r *digestReader) Trailer() []byte {
+	return r.crc32c.Sum(r.sha256.Sum(make([]byte, 0, digestTrailerSize)))
+}
+
+// SHA-256 followed by CRC32C of cleartext, stored right after the content of
+// files which have fileMeta.DigestTrailer set
+const digestTrailerSize = sha256.Size + crc32.Size
+
+func parseDigestTrailer(trailer []byte) fileDigests {
+	return fileDigests{
+		SHA256: base64.StdEncoding.EncodeToString(trailer[:sha256.Size]),
+		CRC32C: base64.StdEncoding.EncodeToString(trailer[sha256.Size:]),
+	}
+}
+
+// Digests of cleartext received over several requests by resumable uploads,
+// the state is saved between them like resumableMac's
+type resumableDigests struct {
+	sha256 hash.Hash
+	crc32c hash.Hash32
+}
+
+func newResumableDigests() *resumableDigests {
+	return &resumableDigests{sha256: sha256.New(), crc32c: crc32.New(crc32cTable)}
+}
+
+func restoreResumableDigests(state resumableDigestState) (*resumableDigests, error) {
+	d := newResumableDigests()
+	if err := d.sha256.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.SHA256); err != nil {
+		return nil, err
+	}
+	if err := d.crc32c.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.CRC32C); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+type resumableDigestState struct {
+	SHA256 []byte
+	CRC32C []byte
+}
+
+func (d *resumableDigests) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	return d.crc32c.Write(p)
+}
+
+func (d *resumableDigests) State() (*resumableDigestState, error) {
+	sha, err := d.sha256.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	crc, err := d.crc32c.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &resumableDigestState{SHA256: sha, CRC32C: crc}, nil
+}
+
+// Same as digestReader.Trailer
+func (d *resumableDigests) Trailer() []byte {
+	return d.crc32c.Sum(d.sha256.Sum(make([]byte, 0, digestTrailerSize)))
+}
+
+// Encrypted digest trailer followed by the HMAC of the whole file, for
+// resumable uploads of length bytes of cleartext. Just the HMAC when digests
+// are nil. mac is left at the end of the content so the tail can be computed
+// again on retries.
+func resumableTail(encKey, iv []byte, length int64, mac *resumableMac, digests *resumableDigests) ([]byte, error) {
+	if digests == nil {
+		return mac.Sum(), nil
+	}
+
+	ctr, err := newCTRAt(encKey, iv, length)
+	if err != nil {
+		return nil, err
+	}
+	trailer := digests.Trailer()
+	ctr.XORKeyStream(trailer, trailer)
+
+	state, err := mac.State()
+	if err != nil {
+		return nil, err
+	}
+	tailMac, err := restoreResumableMac(mac.key, state)
+	if err != nil {
+		return nil, err
+	}
+	tailMac.Write(trailer)
+	return append(trailer, tailMac.Sum()...), nil
+}
@@ -0,0 +1,110 @@
+package minioproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func sha256Digest(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func crc32cDigest(data string) string {
+	sum := crc32.New(crc32cTable)
+	sum.Write([]byte(data))
+	return "crc32c=:" + base64.StdEncoding.EncodeToString(sum.Sum(nil)) + ":"
+}
+
+func fileDigest(data string) string {
+	return sha256Digest(data) + ", " + crc32cDigest(data)
+}
+
+func TestDigests(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	w := doRequest(app, http.MethodPut, "/files/hello.txt", []byte("hello"))
+	if w.Code != http.StatusAccepted {
+		t.Fatal("upload failed", w.Code, w.Body)
+	}
+	w = doRequest(app, http.MethodGet, "/files/hello.txt", nil)
+	if w.Header().Get("Repr-Digest") != fileDigest("hello") || w.Header().Get("Content-Digest") != fileDigest("hello") {
+		t.Error("expected digests of cleartext to be computed while uploading, got", w.Header())
+	}
+	if w.Body.String() != "hello" || w.Header().Get("Content-Length") != "5" {
+		t.Error("expected trailer not to be part of the content, got", w.Body, w.Header())
+	}
+
+	// digests are only known once the whole file has been verified
+	if w := doRequest(app, http.MethodHead, "/files/hello.txt", nil); w.Header().Get("Content-Length") != "5" || len(w.Header().Get("Repr-Digest")) > 0 {
+		t.Error("unexpected HEAD headers", w.Header())
+	}
+	var files []fileInfo
+	json.NewDecoder(doRequest(app, http.MethodGet, "/files", nil).Body).Decode(&files)
+	if len(files) != 1 || files[0].Size != 5 {
+		t.Error("expected listed size without the trailer, got", files)
+	}
+
+	digests := sha256Digest("world") + ", " + crc32cDigest("world") + ", md5=:AAAA:"
+	if w := conditionalRequest(app, http.MethodPut, "/files/world.txt", "Content-Digest", digests, []byte("world")); w.Code != http.StatusAccepted {
+		t.Fatal("expected upload with matching digests to work, got", w.Code, w.Body)
+	}
+	if w := doRequest(app, http.MethodGet, "/files/world.txt", nil); w.Header().Get("Repr-Digest") != fileDigest("world") {
+		t.Error("expected digests of the file, got", w.Header())
+	}
+	if w := conditionalRequest(app, http.MethodPut, "/files/crc.txt", "Repr-Digest", crc32cDigest("crc"), []byte("crc")); w.Code != http.StatusAccepted {
+		t.Fatal("expected upload with matching digest to work, got", w.Code, w.Body)
+	}
+}
+
+func TestDigestMismatch(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	for _, digest := range []string{sha256Digest("other"), crc32cDigest("other")} {
+		if w := conditionalRequest(app, http.MethodPut, "/files/hello.txt", "Content-Digest", digest, []byte("hello")); w.Code != http.StatusBadRequest {
+			t.Error("expected upload with wrong digest to fail, got", w.Code)
+		}
+		if w := doRequest(app, http.MethodGet, "/files/hello.txt", nil); w.Code != http.StatusNotFound {
+			t.Error("expected upload with wrong digest not to be stored, got", w.Code)
+		}
+	}
+
+	// streamed uploads are checked too
+	r := httptest.NewRequest(http.MethodPut, "/files/hello.txt", struct{ *bytes.Reader }{bytes.NewReader([]byte("hello"))})
+	r.ContentLength = -1
+	r.Header.Set("Repr-Digest", sha256Digest("other"))
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Error("expected streamed upload with wrong digest to fail, got", w.Code)
+	}
+
+	for _, digest := range []string{"sha-256=AAAA", "sha-256=:AAAA:", sha256Digest("a") + ", " + sha256Digest("b")} {
+		if w := conditionalRequest(app, http.MethodPut, "/files/hello.txt", "Content-Digest", digest, []byte("hello")); w.Code != http.StatusBadRequest {
+			t.Error("expected malformed digest", digest, "to be rejected, got", w.Code)
+		}
+	}
+}
+
+func TestFormUploadDigests(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	body, contentType := formBody(t, map[string]string{"a.txt": "a"})
+	r := httptest.NewRequest(http.MethodPost, "/files", body)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatal("form upload failed", w.Code, w.Body)
+	}
+
+	if w := doRequest(app, http.MethodGet, "/files/a.txt", nil); w.Header().Get("Repr-Digest") != fileDigest("a") {
+		t.Error("expected digest of files uploaded with a form, got", w.Header())
+	}
+}
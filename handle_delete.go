@@ -0,0 +1,53 @@
+package minioproxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type deleteApi struct {
+	app *App
+}
+
+func bindDeleteApi(app *App) {
+	api := deleteApi{app: app}
+	api.app.router.Methods("DELETE").Path("/files/{filename}").HandlerFunc(api.app.requireScope(ScopeDelete, api.handleDelete))
+}
+
+func (api *deleteApi) handleDelete(w http.ResponseWriter, r *http.Request) {
+	filename := mux.Vars(r)["filename"]
+	log.Println("DELETE /files/" + filename)
+
+	t := api.app.tenant(r)
+	// the version preconditions were checked against is the one deleted, if
+	// the file changed in the meantime storage refuses the delete
+	var cond Precondition
+	if hasPreconditions(r.Header) {
+		file, err := api.app.currentFile(t, filename)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		if failedPreconditions(w, r, file) {
+			return
+		}
+		if file != nil {
+			cond.IfMatch = file.ETag
+		}
+	}
+
+	err := api.app.storage.Delete(t.bucket, t.key(filename), cond)
+	if errors.Is(err, errPreconditionFailed) {
+		writeError(w, http.StatusPreconditionFailed, err)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
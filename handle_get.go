@@ -2,10 +2,13 @@ package minioproxy
 
 import (
 	"errors"
-	"io"
+	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -14,40 +17,204 @@ type readApi struct {
 	app *App
 }
 
+type fileInfo struct {
+	ID           string    `json:"id"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
 func bindReadApi(app *App) {
 	api := readApi{app: app}
-	api.app.router.Methods("GET").Path("/files/{filename}").HandlerFunc(api.handleRead)
+	api.app.router.Methods("GET").Path("/files").HandlerFunc(api.handleList)
+	api.app.router.Methods("GET").Path("/files/{filename}").HandlerFunc(api.app.requireScope(ScopeRead, api.handleRead))
+	api.app.router.Methods("HEAD").Path("/files/{filename}").HandlerFunc(api.app.requireScope(ScopeRead, api.handleHead))
 }
 
 func (api *readApi) handleRead(w http.ResponseWriter, r *http.Request) {
 	filename := mux.Vars(r)["filename"]
 	log.Println("GET /files/" + filename)
 
-	file, err := api.app.client.GetFile(api.app.bucketName, filename)
-	if err != nil || file.ContentLength == 0 {
-		if errors.Is(err, errFileNotFound) {
-			writeError(w, http.StatusNotFound, err)
-		} else if errors.Is(err, errAccessForbidden) {
-			writeError(w, http.StatusForbidden, err)
-		} else {
-			writeError(w, http.StatusInternalServerError, err)
-		}
+	t := api.app.tenant(r)
+	// preconditions are checked against the version being sent, storage
+	// checks If-None-Match itself so the file isn't transferred for a 304
+	ifNoneMatch := storageIfNoneMatch(r.Header)
+	file, err := api.open(t, filename, ifNoneMatch)
+	switch {
+	case errors.Is(err, errNotModified):
+		failedPreconditions(w, r, &File{ETag: ifNoneMatch})
+		return
+	case errors.Is(err, errFileNotFound) && failedPreconditions(w, r, nil):
+		return
+	case err != nil || file.ContentLength == 0:
+		writeStorageError(w, err)
 		return
 	}
 	defer file.Data.Close()
+	if failedPreconditions(w, r, file) {
+		return
+	}
 
 	encryptedSize := file.ContentLength
-	clearSize := strconv.FormatInt(encryptedSize-int64(ENC_META_SIZE), 10)
-	w.Header().Set("Content-Type", file.ContentType)
-	w.Header().Set("Content-Length", clearSize)
-	w.Header().Set("ETag", string(file.ETag))
+	meta, err := setMetaHeaders(w, t, file)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setFileHeaders(w, file, meta)
 
-	if err := api.decryptStream(file.Data, encryptedSize, w); err != nil {
+	// digests are only known once the whole file is verified
+	err = decryptStreamWithTrailer(t.encKey, t.hmacKey, file.Data, encryptedSize, meta.trailerSize(), w, func(trailer []byte) error {
+		setDigestHeaders(w, parseDigestTrailer(trailer))
+		return nil
+	})
+	if err != nil {
 		w.Header().Del("Content-Length")
 		writeError(w, http.StatusInternalServerError, err)
 	}
 }
 
-func (api *readApi) decryptStream(input io.Reader, fileSize int64, dest io.Writer) error {
-	return decryptStream(api.app.encKey, api.app.hmacKey, input, fileSize, dest)
+func (api *readApi) handleHead(w http.ResponseWriter, r *http.Request) {
+	filename := mux.Vars(r)["filename"]
+	log.Println("HEAD /files/" + filename)
+
+	t := api.app.tenant(r)
+	file, err := api.app.currentFile(t, filename)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if failedPreconditions(w, r, file) {
+		return
+	}
+	if file == nil {
+		writeStorageError(w, errFileNotFound)
+		return
+	}
+	if file.ContentLength == 0 {
+		writeStorageError(w, nil)
+		return
+	}
+
+	meta, err := setMetaHeaders(w, t, file)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setFileHeaders(w, file, meta)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *readApi) handleList(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	log.Println("GET /files?prefix=" + prefix)
+
+	p := requestPrincipal(r)
+	if p != nil && !p.hasScope(ScopeList) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("%w: %s", errAccessDenied, ScopeList))
+		return
+	}
+
+	t := api.app.tenant(r)
+	objects, err := api.app.storage.List(t.bucket, t.key(prefix))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	files := make([]fileInfo, 0, len(objects))
+	for _, obj := range objects {
+		id := strings.TrimPrefix(obj.Key, t.prefix)
+		// clients only see files they are allowed to list
+		if !api.app.decide(r, ScopeList, id).Allowed {
+			continue
+		}
+		// trailers can be only accounted for when storage lists metadata
+		meta, _ := t.openMeta(&File{Metadata: obj.Metadata})
+		files = append(files, fileInfo{
+			ID:           id,
+			Size:         obj.Size - int64(ENC_META_SIZE) - meta.trailerSize(),
+			ETag:         string(obj.ETag),
+			LastModified: obj.LastModified,
+		})
+	}
+
+	writeJson(w, http.StatusOK, files)
+}
+
+// Fails with errNotModified when the file still has etag ifNoneMatch, unless
+// it's empty
+func (api *readApi) open(t *tenant, filename string, ifNoneMatch ETag) (*File, error) {
+	if api.app.cache != nil {
+		return api.app.cache.Get(t.bucket, t.key(filename), func() (*File, error) {
+			return api.fetch(t.bucket, t.key(filename), ifNoneMatch)
+		})
+	}
+	return api.fetch(t.bucket, t.key(filename), ifNoneMatch)
+}
+
+// Large files are fetched as ranges in parallel when enabled
+func (api *readApi) fetch(bucket, key string, ifNoneMatch ETag) (*File, error) {
+	get := func() (*File, error) {
+		if len(ifNoneMatch) > 0 {
+			return api.app.storage.GetIfNoneMatch(bucket, key, ifNoneMatch)
+		}
+		return api.app.storage.Get(bucket, key)
+	}
+
+	segmentSize := api.app.downloadSegmentSize
+	if segmentSize == 0 {
+		return get()
+	}
+
+	file, err := api.app.storage.Head(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if file.ContentLength <= 2*segmentSize {
+		return get()
+	}
+	if len(ifNoneMatch) > 0 && file.ETag.Matches(ifNoneMatch) {
+		return nil, errNotModified
+	}
+
+	file.Data = newRangedReader(api.app.storage, bucket, key, file.ETag, file.ContentLength, segmentSize, api.app.downloadWorkers)
+	return file, nil
+}
+
+func setFileHeaders(w http.ResponseWriter, file *File, meta fileMeta) {
+	clearSize := strconv.FormatInt(file.ContentLength-int64(ENC_META_SIZE)-meta.trailerSize(), 10)
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("Content-Length", clearSize)
+	setValidatorHeaders(w, file)
+}
+
+// Files created with a generated id are served with their original name,
+// unless a share link already named them
+func setMetaHeaders(w http.ResponseWriter, t *tenant, file *File) (fileMeta, error) {
+	meta, err := t.openMeta(file)
+	if err != nil {
+		return meta, err
+	}
+	if len(meta.Filename) > 0 && len(w.Header().Get("Content-Disposition")) == 0 {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": meta.Filename}))
+	}
+	return meta, nil
+}
+
+func writeStorageError(w http.ResponseWriter, err error) {
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(unavailable.retryAfter)))
+		writeError(w, http.StatusServiceUnavailable, unavailable)
+	} else if errors.Is(err, errFileNotFound) {
+		writeError(w, http.StatusNotFound, err)
+	} else if errors.Is(err, errAccessForbidden) {
+		writeError(w, http.StatusForbidden, err)
+	} else if err == nil {
+		// empty files are not valid encrypted files
+		writeError(w, http.StatusInternalServerError, errors.New("invalid file"))
+	} else {
+		writeError(w, http.StatusInternalServerError, err)
+	}
 }
@@ -0,0 +1,52 @@
+package minioproxy
+
+import (
+	"net/http"
+)
+
+const (
+	healthOK = "ok"
+	// some replicas are unavailable
+	healthDegraded = "degraded"
+	// primary storage is unavailable
+	healthUnavailable = "unavailable"
+)
+
+type healthApi struct {
+	app *App
+}
+
+type healthStatus struct {
+	Status   string          `json:"status"`
+	Backends []backendHealth `json:"backends"`
+}
+
+func bindHealthApi(app *App) {
+	api := healthApi{app: app}
+	api.app.router.Methods("GET").Path("/_health").HandlerFunc(api.handleHealth)
+}
+
+func (api *healthApi) handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: healthOK, Backends: []backendHealth{}}
+	if reporter, ok := api.app.storage.(healthReporter); ok {
+		status.Backends = reporter.Health()
+	}
+
+	for i, backend := range status.Backends {
+		if backend.State != breakerOpen {
+			continue
+		}
+		// first one is the primary
+		if i == 0 {
+			status.Status = healthUnavailable
+			break
+		}
+		status.Status = healthDegraded
+	}
+
+	if status.Status == healthUnavailable {
+		writeJson(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJson(w, http.StatusOK, status)
+}
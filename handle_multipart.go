@@ -0,0 +1,197 @@
+package minioproxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Multipart uploads driven by clients, modeled after S3 API
+type multipartApi struct {
+	app   *App
+	store *clientUploadStore
+}
+
+type multipartUploadInfo struct {
+	ID       string          `json:"id"`
+	UploadID string          `json:"uploadId"`
+	PartSize int64           `json:"partSize"`
+	Parts    []multipartPart `json:"parts,omitempty"`
+}
+
+type multipartPart struct {
+	PartNumber int    `json:"partNumber"`
+	Size       int64  `json:"size"`
+	ETag       string `json:"etag,omitempty"`
+}
+
+// has to be bound before other /files/{filename} routes as they'd match first
+func bindMultipartApi(app *App, store *clientUploadStore) {
+	api := multipartApi{app: app, store: store}
+	files := api.app.router.Path("/files/{filename}").Subrouter()
+	files.Methods("POST").Queries("uploads", "").HandlerFunc(api.app.requireScope(ScopeWrite, api.handleInitiate))
+	files.Methods("PUT").Queries("uploadId", "{uploadId}", "partNumber", "{partNumber:[0-9]+}").HandlerFunc(api.app.requireScope(ScopeWrite, api.handleUploadPart))
+	files.Methods("GET").Queries("uploadId", "{uploadId}").HandlerFunc(api.app.requireScope(ScopeWrite, api.handleListParts))
+	files.Methods("POST").Queries("uploadId", "{uploadId}").HandlerFunc(api.app.requireScope(ScopeWrite, api.handleComplete))
+	files.Methods("DELETE").Queries("uploadId", "{uploadId}").HandlerFunc(api.app.requireScope(ScopeWrite, api.handleAbort))
+}
+
+func (api *multipartApi) handleInitiate(w http.ResponseWriter, r *http.Request) {
+	filename := mux.Vars(r)["filename"]
+	log.Println("POST /files/" + filename + "?uploads")
+
+	if err := validateFilename(filename); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	partSize := max(api.app.chunkSize, minPartSize)
+	if partSizeStr := r.URL.Query().Get("partSize"); len(partSizeStr) > 0 {
+		var err error
+		partSize, err = strconv.ParseInt(partSizeStr, 10, 64)
+		if err != nil || partSize < minPartSize || partSize > maxPartSize {
+			writeError(w, http.StatusBadRequest, errors.New("partSize has to be between 5 MB and 5 GB"))
+			return
+		}
+	}
+
+	t := api.app.tenant(r)
+	if api.app.refuseOverwrite(w, t, filename) {
+		return
+	}
+	metadata, err := t.sealMeta(fileMeta{DigestTrailer: true})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	upload, err := api.store.Initiate(t.bucket, t.key(filename), t.id, contentType, metadata, partSize)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, multipartUploadInfo{
+		ID:       filename,
+		UploadID: upload.ID,
+		PartSize: upload.PartSize,
+	})
+}
+
+func (api *multipartApi) handleUploadPart(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	filename := vars["filename"]
+	partNumber, _ := strconv.Atoi(vars["partNumber"])
+	log.Println("PUT /files/"+filename+"?partNumber="+vars["partNumber"], "of", vars["uploadId"])
+
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, errors.New("missing Content-Length"))
+		return
+	}
+
+	t := api.app.tenant(r)
+	part, err := api.store.UploadPart(t.bucket, t.key(filename), vars["uploadId"], partNumber, r.ContentLength, r.Body)
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", string(part.ETag))
+	writeJson(w, http.StatusOK, multipartPart{
+		PartNumber: part.PartNumber,
+		Size:       part.Size,
+		ETag:       string(part.ETag),
+	})
+}
+
+func (api *multipartApi) handleListParts(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	t := api.app.tenant(r)
+	upload, err := api.store.Get(t.bucket, t.key(vars["filename"]), vars["uploadId"])
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+
+	info := multipartUploadInfo{
+		ID:       vars["filename"],
+		UploadID: upload.ID,
+		PartSize: upload.PartSize,
+		Parts:    []multipartPart{},
+	}
+	parts := make([]CompletedPart, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		parts = append(parts, part)
+	}
+	sortParts(parts)
+	for _, part := range parts {
+		info.Parts = append(info.Parts, multipartPart{
+			PartNumber: part.PartNumber,
+			Size:       part.Size,
+			ETag:       string(part.ETag),
+		})
+	}
+
+	writeJson(w, http.StatusOK, info)
+}
+
+func (api *multipartApi) handleComplete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	filename := vars["filename"]
+	log.Println("POST /files/" + filename + "?uploadId=" + vars["uploadId"])
+
+	t := api.app.tenant(r)
+	etag, err := api.store.Complete(t.bucket, t.key(filename), vars["uploadId"], Precondition{IfNoneMatch: api.app.createOnly})
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+
+	writeJson(w, http.StatusAccepted, jsonData{
+		"id":   filename,
+		"etag": string(etag),
+	})
+}
+
+func (api *multipartApi) handleAbort(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	log.Println("DELETE /files/" + vars["filename"] + "?uploadId=" + vars["uploadId"])
+
+	t := api.app.tenant(r)
+	if err := api.store.Abort(t.bucket, t.key(vars["filename"]), vars["uploadId"]); err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeMultipartError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errPartTooLarge), errors.Is(err, errInvalidPart), errors.Is(err, errMissingParts):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, errPartChanged):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errPreconditionFailed):
+		// only create-only mode sets a precondition
+		writeError(w, http.StatusConflict, errFileExists)
+	case errors.Is(err, errFileTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+	case errors.Is(err, errPartTooFarAhead):
+		writeError(w, http.StatusTooManyRequests, err)
+	case errors.Is(err, errSpoolFull):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeStorageError(w, err)
+	}
+}
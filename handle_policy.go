@@ -0,0 +1,26 @@
+package minioproxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type policyApi struct {
+	app *App
+}
+
+func bindPolicyApi(app *App) {
+	api := policyApi{app: app}
+	api.app.router.Methods("GET").Path("/_policy/explain").HandlerFunc(api.handleExplain)
+}
+
+// Shows whether the client making the request could do action on key, and why
+func (api *policyApi) handleExplain(w http.ResponseWriter, r *http.Request) {
+	action, key := r.URL.Query().Get("action"), r.URL.Query().Get("key")
+	if !isScope(action) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown action %q", action))
+		return
+	}
+
+	writeJson(w, http.StatusOK, api.app.decide(r, action, key))
+}
@@ -1,9 +1,14 @@
 package minioproxy
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -13,39 +18,292 @@ type uploadApi struct {
 	app *App
 }
 
+var errFileExists = errors.New("file already exists")
+
+// Result of a file of a form upload
+type formFile struct {
+	ID   string `json:"id"`
+	ETag string `json:"etag"`
+	// bytes of cleartext
+	Size int64 `json:"size"`
+}
+
 func bindUploadApi(app *App) {
 	api := uploadApi{app: app}
-	api.app.router.Methods("PUT").Path("/files/{filename}").HandlerFunc(api.handleUpload)
+	api.app.router.Methods("PUT").Path("/files/{filename}").HandlerFunc(api.app.requireScope(ScopeWrite, api.handleUpload))
+	api.app.router.Methods("POST").Path("/files").HandlerFunc(api.handlePost)
 }
 
 func (api *uploadApi) handleUpload(w http.ResponseWriter, r *http.Request) {
 	filename := mux.Vars(r)["filename"]
 	log.Println("PUT /files/" + filename)
 
+	if err := validateFilename(filename); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	t := api.app.tenant(r)
+	cond, ok := api.app.writePrecondition(w, r, r.Header, t, filename)
+	if !ok {
+		return
+	}
+
+	etag, ok := api.upload(w, r, t, filename, fileMeta{}, cond)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("ETag", string(etag))
+	writeJson(w, http.StatusAccepted, jsonData{
+		"id":   filename,
+		"etag": string(etag),
+	})
+}
+
+// Forms are uploaded with their own names, other bodies as a new file
+func (api *uploadApi) handlePost(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		api.handleFormUpload(w, r)
+	} else {
+		api.handleCreate(w, r)
+	}
+}
+
+// Uploads the body as a new file with a generated id, starting with the prefix
+// query parameter when set. Name of the file from Content-Disposition and its
+// content type are kept as sealed metadata.
+func (api *uploadApi) handleCreate(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	log.Println("POST /files?prefix=" + prefix)
+
+	if strings.Contains(prefix, "/") || strings.Contains(prefix, "..") {
+		writeError(w, http.StatusBadRequest, errors.New("prefix can't contain / or .."))
+		return
+	}
+	id, err := newObjectID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	filename := prefix + id
+	if !api.app.authorize(w, r, ScopeWrite, filename) {
+		return
+	}
+
+	meta := fileMeta{ContentType: r.Header.Get("Content-Type")}
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		meta.Filename = params["filename"]
+	}
+
+	etag, ok := api.upload(w, r, api.app.tenant(r), filename, meta, Precondition{})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Location", "/files/"+url.PathEscape(filename))
+	w.Header().Set("ETag", string(etag))
+	writeJson(w, http.StatusCreated, jsonData{
+		"id":   filename,
+		"etag": string(etag),
+	})
+}
+
+// Uploads the body of the request as filename, responds with an error when it
+// fails. Digests of the content are sealed into the file, the ones sent by the
+// client are checked against it.
+func (api *uploadApi) upload(w http.ResponseWriter, r *http.Request, t *tenant, filename string, meta fileMeta, cond Precondition) (ETag, bool) {
 	contentType := r.Header.Get("Content-Type")
 	if len(contentType) == 0 {
 		contentType = "application/octet-stream"
 	}
 
-	contentLength := r.ContentLength + int64(ENC_META_SIZE)
+	expected, err := requestDigests(r.Header)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return "", false
+	}
+	meta.DigestTrailer = true
+
+	body, limit, err := api.app.checkTicket(r, filename, contentType, r.ContentLength, r.Body)
+	if err == nil {
+		err = api.app.useTicket(r)
+	}
+	if err != nil {
+		writeTicketError(w, err)
+		return "", false
+	}
 
+	metadata, err := t.sealMeta(meta)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return "", false
+	}
+
+	// unknown for chunked requests
+	contentLength := int64(-1)
+	if r.ContentLength >= 0 {
+		contentLength = r.ContentLength + int64(ENC_META_SIZE) + meta.trailerSize()
+	}
+
+	digest := newDigestReader(body, expected)
 	start := time.Now().UnixMilli()
-	etag, err := api.app.client.Upload(api.app.bucketName, filename, contentType, contentLength, api.app.chunkSize, api.encryptStream(r.Body))
+	etag, err := api.app.uploader.Upload(t.bucket, t.key(filename), contentType, metadata, cond, contentLength, api.app.chunkSize, encryptStreamWithTrailer(t.encKey, t.hmacKey, digest, digest.Trailer))
 	uploadDuration := time.Now().UnixMilli() - start
 
 	log.Println("upload", filename, "took", uploadDuration, "ms")
 
+	if limit != nil && limit.exceeded {
+		err = errTicketTooLarge
+	} else if digest.mismatch {
+		err = errDigestMismatch
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeUploadError(w, r.Header, filename, err)
+		return "", false
+	}
+	return etag, true
+}
+
+// Writes that fail their precondition without conditional headers were
+// refused by create-only mode
+func writeUploadError(w http.ResponseWriter, header http.Header, filename string, err error) {
+	switch {
+	case errors.Is(err, errFileTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+	case errors.Is(err, errDigestMismatch):
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %s", err, filename))
+	case errors.Is(err, errPreconditionFailed) && !hasPreconditions(header):
+		writeError(w, http.StatusConflict, fmt.Errorf("%w: %s", errFileExists, filename))
+	case errors.Is(err, errPreconditionFailed):
+		writeError(w, http.StatusPreconditionFailed, err)
+	default:
+		writeStorageError(w, err)
+	}
+}
+
+// Existing files can't be replaced in create-only mode, responds with 409 when
+// filename exists. Resumable and multipart uploads are checked again by storage
+// when they are completed.
+func (app *App) refuseOverwrite(w http.ResponseWriter, t *tenant, filename string) bool {
+	if !app.createOnly {
+		return false
+	}
+
+	file, err := app.currentFile(t, filename)
+	if err != nil {
+		writeStorageError(w, err)
+		return true
+	}
+	if file != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("%w: %s", errFileExists, filename))
+		return true
+	}
+	return false
+}
+
+// Uploads every file of a multipart/form-data request, as sent by HTML forms
+// and FormData. Files are streamed one after the other, the ones uploaded
+// before a failure are kept.
+func (api *uploadApi) handleFormUpload(w http.ResponseWriter, r *http.Request) {
+	log.Println("POST /files")
+
+	form, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	writeJson(w, http.StatusAccepted, jsonData{
-		"id":   filename,
-		"etag": string(etag),
-	})
+	t := api.app.tenant(r)
+	files := []formFile{}
+	for {
+		part, err := form.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// other form fields are ignored
+		filename := part.FileName()
+		if len(filename) == 0 {
+			part.Close()
+			continue
+		}
+		if err := validateFilename(filename); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !api.app.authorize(w, r, ScopeWrite, filename) {
+			return
+		}
+		// conditional headers are about the form, only create-only mode applies to its files
+		cond, ok := api.app.writePrecondition(w, r, http.Header{}, t, filename)
+		if !ok {
+			return
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if len(contentType) == 0 {
+			contentType = "application/octet-stream"
+		}
+		// parts can have digests of their own
+		expected, err := requestDigests(http.Header(part.Header))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		metadata, err := t.sealMeta(fileMeta{DigestTrailer: true})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// MaxSize of a ticket is about a single file, it can't be used for more
+		if p := requestPrincipal(r); len(files) > 0 && p != nil && p.ticket != nil {
+			writeError(w, http.StatusBadRequest, errors.New("only one file can be uploaded with a ticket"))
+			return
+		}
+		body, limit, err := api.app.checkTicket(r, filename, contentType, -1, part)
+		if err == nil && len(files) == 0 {
+			err = api.app.useTicket(r)
+		}
+		if err != nil {
+			writeTicketError(w, err)
+			return
+		}
+
+		counter := &countingReader{input: body}
+		digest := newDigestReader(counter, expected)
+		etag, err := api.app.uploader.Upload(t.bucket, t.key(filename), contentType, metadata, cond, -1, api.app.chunkSize, encryptStreamWithTrailer(t.encKey, t.hmacKey, digest, digest.Trailer))
+		if limit != nil && limit.exceeded {
+			err = errTicketTooLarge
+		} else if digest.mismatch {
+			err = errDigestMismatch
+		}
+		if err != nil {
+			writeUploadError(w, http.Header{}, filename, err)
+			return
+		}
+
+		files = append(files, formFile{ID: filename, ETag: string(etag), Size: counter.n})
+	}
+
+	if len(files) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("form has no files"))
+		return
+	}
+	writeJson(w, http.StatusAccepted, files)
+}
+
+type countingReader struct {
+	input io.Reader
+	n     int64
 }
 
-func (api *uploadApi) encryptStream(input io.Reader) io.Reader {
-	return encryptStream(api.app.encKey, api.app.hmacKey, input)
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.input.Read(p)
+	r.n += int64(n)
+	return n, err
 }
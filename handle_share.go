@@ -0,0 +1,155 @@
+package minioproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type shareApi struct {
+	app *App
+}
+
+type shareRequest struct {
+	// seconds, defaults to an hour
+	ExpiresIn    int    `json:"expiresIn"`
+	MaxDownloads int    `json:"maxDownloads"`
+	IP           string `json:"ip"`
+	Filename     string `json:"filename"`
+}
+
+type shareResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+func bindShareApi(app *App) {
+	api := shareApi{app: app}
+	api.app.router.Methods("POST").Path("/files/{filename}").Queries("share", "").HandlerFunc(api.app.requireScope(ScopeRead, api.handleShare))
+}
+
+func (api *shareApi) handleShare(w http.ResponseWriter, r *http.Request) {
+	filename := mux.Vars(r)["filename"]
+	log.Println("POST /files/" + filename + "?share")
+
+	var req shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	expiresIn := withDefault(time.Duration(req.ExpiresIn)*time.Second, defaultShareExpiry)
+	if expiresIn > maxShareExpiry {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expiresIn can be at most %d seconds", int(maxShareExpiry.Seconds())))
+		return
+	}
+	if req.MaxDownloads < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("maxDownloads can't be negative"))
+		return
+	}
+	if len(req.IP) > 0 && net.ParseIP(req.IP) == nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid ip"))
+		return
+	}
+
+	t := api.app.tenant(r)
+	if _, err := api.app.storage.Head(t.bucket, t.key(filename)); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	link := shareLink{
+		ID:           id,
+		Tenant:       t.id,
+		Key:          filename,
+		Expires:      time.Now().Add(expiresIn).Truncate(time.Second),
+		MaxDownloads: req.MaxDownloads,
+		IP:           req.IP,
+		Name:         req.Filename,
+	}
+
+	writeJson(w, http.StatusCreated, shareResponse{URL: api.app.shares.URL(link), Expires: link.Expires})
+}
+
+// Downloads with share links don't need other authentication
+func (app *App) serveShareLink(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusForbidden, errShareInvalid)
+		return
+	}
+
+	link, err := app.shares.Verify(r, mux.Vars(r)["filename"])
+	if err == nil && r.Method == http.MethodGet {
+		err = app.shares.Download(link)
+	}
+	if errors.Is(err, errShareExpired) || errors.Is(err, errShareUsedUp) {
+		writeError(w, http.StatusGone, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if len(link.Name) > 0 {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": link.Name}))
+	}
+	if r.Method == http.MethodGet {
+		// only downloads of the whole file count, Range isn't supported so
+		// there are no partial ones
+		download := &shareDownload{ResponseWriter: w}
+		defer func() {
+			if !download.complete() {
+				app.shares.Release(link)
+			}
+		}()
+		w = download
+	}
+	p := newPrincipal("share "+link.ID, []string{ScopeRead}, []string{link.Key})
+	p.tenant, p.signed = link.Tenant, true
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+}
+
+// Response to a download with a share link, tells whether the file was sent
+type shareDownload struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *shareDownload) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *shareDownload) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Content-Length is removed when decrypting fails after headers were sent,
+// empty files are sent without writing anything
+func (w *shareDownload) complete() bool {
+	length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	return (w.status == http.StatusOK || w.status == 0) && err == nil && w.written == length
+}
@@ -0,0 +1,44 @@
+package minioproxy
+
+import (
+	"net/http"
+)
+
+type statsApi struct {
+	app *App
+}
+
+type uploadStats struct {
+	schedulerStats
+	MemoryInUse int64 `json:"memoryInUse"`
+}
+
+type appStats struct {
+	Uploads     uploadStats       `json:"uploads"`
+	Cache       *cacheStats       `json:"cache,omitempty"`
+	Replication *replicationStats `json:"replication,omitempty"`
+}
+
+func bindStatsApi(app *App) {
+	api := statsApi{app: app}
+	api.app.router.Methods("GET").Path("/_stats").HandlerFunc(api.handleStats)
+}
+
+func (api *statsApi) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := appStats{
+		Uploads: uploadStats{
+			schedulerStats: api.app.uploader.scheduler.Stats(),
+			MemoryInUse:    api.app.uploader.buffers.InUse(),
+		},
+	}
+	if api.app.cache != nil {
+		cache := api.app.cache.Stats()
+		stats.Cache = &cache
+	}
+	if api.app.replication != nil {
+		replication := api.app.replication.Stats()
+		stats.Replication = &replication
+	}
+
+	writeJson(w, http.StatusOK, stats)
+}
@@ -0,0 +1,178 @@
+package minioproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ticketApi struct {
+	app *App
+}
+
+type ticketRequest struct {
+	// exactly one of key and prefix
+	Key          string   `json:"key"`
+	Prefix       string   `json:"prefix"`
+	MaxSize      int64    `json:"maxSize"`
+	ContentTypes []string `json:"contentTypes"`
+	// seconds, defaults to 15 minutes
+	ExpiresIn int `json:"expiresIn"`
+}
+
+type ticketResponse struct {
+	Ticket string `json:"ticket"`
+	// only for tickets with a key
+	URL     string    `json:"url,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func bindTicketApi(app *App) {
+	api := ticketApi{app: app}
+	api.app.router.Methods("POST").Path("/tickets").HandlerFunc(api.handleTicket)
+}
+
+func (api *ticketApi) handleTicket(w http.ResponseWriter, r *http.Request) {
+	log.Println("POST /tickets")
+
+	var req ticketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if (len(req.Key) > 0) == (len(req.Prefix) > 0) {
+		writeError(w, http.StatusBadRequest, errors.New("ticket needs either a key or a prefix"))
+		return
+	}
+	if (len(req.Key) > 0 && validateFilename(req.Key) != nil) || strings.Contains(req.Prefix, "/") || strings.Contains(req.Prefix, "..") {
+		writeError(w, http.StatusBadRequest, errors.New("key and prefix can't contain / or .."))
+		return
+	}
+	expiresIn := withDefault(time.Duration(req.ExpiresIn)*time.Second, defaultTicketExpiry)
+	if expiresIn > maxTicketExpiry {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expiresIn can be at most %d seconds", int(maxTicketExpiry.Seconds())))
+		return
+	}
+	if req.MaxSize < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("maxSize can't be negative"))
+		return
+	}
+	for _, contentType := range req.ContentTypes {
+		// wildcards are checked as any subtype of their type
+		if _, _, err := mime.ParseMediaType(strings.Replace(contentType, "/*", "/any", 1)); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid content type %q", contentType))
+			return
+		}
+	}
+
+	// prefix tickets are checked again with the name of the file once it's uploaded
+	if !api.app.authorize(w, r, ScopeWrite, req.Key+req.Prefix) {
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ticket := uploadTicket{
+		ID:           id,
+		Tenant:       api.app.tenant(r).id,
+		Key:          req.Key,
+		Prefix:       req.Prefix,
+		MaxSize:      req.MaxSize,
+		ContentTypes: req.ContentTypes,
+		Expires:      time.Now().Add(expiresIn).Unix(),
+	}
+	if p := requestPrincipal(r); p != nil {
+		ticket.Issuer = p.id
+	}
+
+	resp := ticketResponse{Ticket: api.app.shares.Ticket(ticket), Expires: time.Unix(ticket.Expires, 0)}
+	if len(ticket.Key) > 0 {
+		resp.URL = "/files/" + url.PathEscape(ticket.Key) + "?" + url.Values{"ticket": {resp.Ticket}}.Encode()
+	}
+	writeJson(w, http.StatusCreated, resp)
+}
+
+// Uploads with tickets don't need other authentication, upload handlers
+// enforce the constraints of the ticket
+func (app *App) serveUploadTicket(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	isFormUpload := r.Method == http.MethodPost && r.URL.Path == "/files"
+	if r.Method != http.MethodPut && !isFormUpload {
+		writeError(w, http.StatusForbidden, errTicketInvalid)
+		return
+	}
+
+	ticket, err := app.shares.VerifyTicket(r.URL.Query().Get("ticket"))
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	// policies are checked for the issuer, a ticket doesn't allow more than it could do
+	issuer := ticket.Issuer
+	if len(issuer) == 0 {
+		issuer = anonymousPrincipal
+	}
+	p := newPrincipal(issuer, []string{ScopeWrite}, []string{ticket.Key + ticket.Prefix})
+	p.tenant, p.ticket = ticket.Tenant, ticket
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+}
+
+// Checks the upload of filename is allowed by the ticket of the request if it
+// has one. The returned body fails once it's larger than allowed, limit is nil
+// when there's no limit.
+func (app *App) checkTicket(r *http.Request, filename, contentType string, contentLength int64, body io.Reader) (io.Reader, *ticketLimitReader, error) {
+	p := requestPrincipal(r)
+	if p == nil || p.ticket == nil {
+		return body, nil, nil
+	}
+
+	ticket := p.ticket
+	if !ticket.allowsFile(filename) {
+		return nil, nil, fmt.Errorf("%w: not valid for %s", errTicketInvalid, filename)
+	}
+	if !ticket.allowsContentType(contentType) {
+		return nil, nil, fmt.Errorf("%w: %s", errTicketContentType, contentType)
+	}
+	if ticket.MaxSize > 0 && contentLength > ticket.MaxSize {
+		return nil, nil, errTicketTooLarge
+	}
+
+	if ticket.MaxSize == 0 {
+		return body, nil, nil
+	}
+	limit := ticket.limit(body)
+	return limit, limit, nil
+}
+
+// Uses up the ticket of the request if it has one, a form upload with a
+// ticket can have a single file
+func (app *App) useTicket(r *http.Request) error {
+	if p := requestPrincipal(r); p != nil && p.ticket != nil {
+		return app.shares.UseTicket(p.ticket)
+	}
+	return nil
+}
+
+func writeTicketError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTicketContentType):
+		writeError(w, http.StatusUnsupportedMediaType, err)
+	case errors.Is(err, errFileTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+	case errors.Is(err, errTicketUsed):
+		writeError(w, http.StatusGone, err)
+	default:
+		writeError(w, http.StatusForbidden, err)
+	}
+}
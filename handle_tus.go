@@ -0,0 +1,219 @@
+package minioproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const tusVersion = "1.0.0"
+
+// Resumable uploads implementing tus.io v1 core protocol with creation and
+// termination extensions
+type tusApi struct {
+	app   *App
+	store *tusStore
+}
+
+func bindTusApi(app *App, store *tusStore) {
+	api := tusApi{app: app, store: store}
+	api.app.router.Methods("OPTIONS").Path("/tus").HandlerFunc(api.handleOptions)
+	api.app.router.Methods("POST").Path("/tus").HandlerFunc(api.requireTus(api.handleCreate))
+	api.app.router.Methods("HEAD").Path("/tus/{id}").HandlerFunc(api.requireTus(api.handleHead))
+	api.app.router.Methods("PATCH").Path("/tus/{id}").HandlerFunc(api.requireTus(api.handlePatch))
+	api.app.router.Methods("DELETE").Path("/tus/{id}").HandlerFunc(api.requireTus(api.handleTerminate))
+}
+
+func (api *tusApi) requireTus(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			writeError(w, http.StatusPreconditionFailed, errors.New("unsupported tus version"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (api *tusApi) handleOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxFileSize-int64(ENC_META_SIZE)-digestTrailerSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *tusApi) handleCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("missing or invalid Upload-Length"))
+		return
+	}
+
+	meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	filename := meta["filename"]
+	if len(filename) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("missing filename in Upload-Metadata"))
+		return
+	}
+	if err := validateFilename(filename); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !api.app.authorize(w, r, ScopeWrite, filename) {
+		return
+	}
+	contentType := meta["filetype"]
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	t := api.app.tenant(r)
+	if api.app.refuseOverwrite(w, t, filename) {
+		return
+	}
+	metadata, err := t.sealMeta(fileMeta{Filename: filename, ContentType: contentType, DigestTrailer: true})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	cond := Precondition{IfNoneMatch: api.app.createOnly}
+	upload, err := api.store.Create(t.bucket, t.key(filename), t.id, contentType, metadata, cond, length, api.app.chunkSize)
+	if errors.Is(err, errFileTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Println("POST /tus", filename, "created", upload.ID)
+	w.Header().Set("Location", "/tus/"+upload.ID)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (api *tusApi) handleHead(w http.ResponseWriter, r *http.Request) {
+	if !api.authorizeUpload(w, r) {
+		return
+	}
+	// clients consider uploads with all data received finished, if completing
+	// one failed it's retried here and the failure reported if it fails again
+	upload, err := api.store.Complete(mux.Vars(r)["id"])
+	if err != nil {
+		writeTusError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *tusApi) handlePatch(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	log.Println("PATCH /tus/" + id)
+
+	if !api.authorizeUpload(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type has to be application/offset+octet-stream"))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("missing or invalid Upload-Offset"))
+		return
+	}
+
+	upload, err := api.store.Write(id, offset, r.Body)
+	if upload != nil {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	}
+	if err != nil {
+		writeTusError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *tusApi) handleTerminate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	log.Println("DELETE /tus/" + id)
+
+	if !api.authorizeUpload(w, r) {
+		return
+	}
+
+	if err := api.store.Terminate(id); err != nil {
+		writeTusError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Checks the upload belongs to the tenant of the client and that the client
+// can write the file being uploaded
+func (api *tusApi) authorizeUpload(w http.ResponseWriter, r *http.Request) bool {
+	upload, err := api.store.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeTusError(w, err)
+		return false
+	}
+
+	t := api.app.tenant(r)
+	filename, ok := strings.CutPrefix(upload.Key, t.prefix)
+	if upload.Tenant != t.id || upload.Bucket != t.bucket || !ok {
+		writeTusError(w, errUploadNotFound)
+		return false
+	}
+	return api.app.authorize(w, r, ScopeWrite, filename)
+}
+
+func writeTusError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errTusOffsetMismatch):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errTusLocked):
+		writeError(w, http.StatusLocked, err)
+	case errors.Is(err, errPreconditionFailed):
+		// only create-only mode sets a precondition
+		writeError(w, http.StatusConflict, errFileExists)
+	default:
+		writeStorageError(w, err)
+	}
+}
+
+// Upload-Metadata is a comma separated list of keys and base64 encoded values
+func parseTusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if len(key) == 0 {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			meta[key] = string(value)
+		}
+	}
+
+	return meta
+}
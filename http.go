@@ -7,7 +7,7 @@ import (
 
 type jsonData map[string]string
 
-func writeJson(w http.ResponseWriter, statusCode int, data jsonData) {
+func writeJson(w http.ResponseWriter, statusCode int, data any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
@@ -0,0 +1,304 @@
+package minioproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultUploadExpiry = 24 * time.Hour
+
+// how often abandoned uploads are looked for
+const uploadExpiryInterval = 10 * time.Minute
+
+const (
+	journalBegin = "begin"
+	journalPart  = "part"
+	journalEnd   = "end"
+)
+
+// Append-only log of multipart uploads streamed through the proxy. Every
+// change is synced to disk before the upload continues, so after a crash
+// the proxy knows which uploads were left unfinished.
+type uploadJournal struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	active map[string]*journaledUpload
+	// bytes in the journal, and in it right after it was last compacted
+	size          int64
+	compactedSize int64
+}
+
+// journal is compacted once it's this large even while uploads are active
+const journalCompactSize = 1024 * 1024
+
+type journalEntry struct {
+	Op          string         `json:"op"`
+	UploadID    string         `json:"uploadId"`
+	Bucket      string         `json:"bucket,omitempty"`
+	Key         string         `json:"key,omitempty"`
+	ContentType string         `json:"contentType,omitempty"`
+	PartSize    int64          `json:"partSize,omitempty"`
+	Part        *CompletedPart `json:"part,omitempty"`
+}
+
+type journaledUpload struct {
+	UploadID    string
+	Bucket      string
+	Key         string
+	ContentType string
+	PartSize    int64
+	Parts       []CompletedPart
+}
+
+// Opens the journal, replaying entries of uploads which haven't ended
+func openUploadJournal(path string) (*uploadJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+
+	j := &uploadJournal{
+		path:   path,
+		active: make(map[string]*journaledUpload),
+	}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	// drops ended uploads and a possibly partially written last entry
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *uploadJournal) Begin(bucket, key, uploadID, contentType string, partSize int64) error {
+	return j.append(journalEntry{
+		Op:          journalBegin,
+		UploadID:    uploadID,
+		Bucket:      bucket,
+		Key:         key,
+		ContentType: contentType,
+		PartSize:    partSize,
+	})
+}
+
+func (j *uploadJournal) Part(uploadID string, part CompletedPart) error {
+	return j.append(journalEntry{Op: journalPart, UploadID: uploadID, Part: &part})
+}
+
+func (j *uploadJournal) End(uploadID string) error {
+	if err := j.append(journalEntry{Op: journalEnd, UploadID: uploadID}); err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// nothing worth keeping, start over. Otherwise entries of ended uploads are
+	// dropped once they take most of the journal.
+	if len(j.active) == 0 || j.size >= max(journalCompactSize, 2*j.compactedSize) {
+		return j.compactLocked()
+	}
+	return nil
+}
+
+func (j *uploadJournal) Pending() []journaledUpload {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	pending := make([]journaledUpload, 0, len(j.active))
+	for _, upload := range j.active {
+		pending = append(pending, *upload)
+	}
+	return pending
+}
+
+func (j *uploadJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+func (j *uploadJournal) append(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	n, err := j.file.Write(append(line, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.apply(entry)
+	return nil
+}
+
+func (j *uploadJournal) apply(entry journalEntry) {
+	switch entry.Op {
+	case journalBegin:
+		j.active[entry.UploadID] = &journaledUpload{
+			UploadID:    entry.UploadID,
+			Bucket:      entry.Bucket,
+			Key:         entry.Key,
+			ContentType: entry.ContentType,
+			PartSize:    entry.PartSize,
+		}
+	case journalPart:
+		if upload, exists := j.active[entry.UploadID]; exists && entry.Part != nil {
+			upload.Parts = append(upload.Parts, *entry.Part)
+		}
+	case journalEnd:
+		delete(j.active, entry.UploadID)
+	}
+}
+
+func (j *uploadJournal) replay() error {
+	file, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the proxy crashed while writing the entry, so it was never acted upon
+			log.Println("skipping corrupted journal entry", err)
+			continue
+		}
+		j.apply(entry)
+	}
+	return scanner.Err()
+}
+
+func (j *uploadJournal) compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.compactLocked()
+}
+
+// Rewrites the journal with entries of active uploads only
+func (j *uploadJournal) compactLocked() error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".journal-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	encoder := json.NewEncoder(tmp)
+	for _, upload := range j.active {
+		entries := []journalEntry{{
+			Op:          journalBegin,
+			UploadID:    upload.UploadID,
+			Bucket:      upload.Bucket,
+			Key:         upload.Key,
+			ContentType: upload.ContentType,
+			PartSize:    upload.PartSize,
+		}}
+		for _, part := range upload.Parts {
+			part := part
+			entries = append(entries, journalEntry{Op: journalPart, UploadID: upload.UploadID, Part: &part})
+		}
+
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	size := fileSize(tmp)
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.size, j.compactedSize = size, size
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	return err
+}
+
+// Streamed uploads can't be resumed after a restart as the request body is
+// gone, parts uploaded so far are removed from storage.
+func recoverJournaledUploads(j *uploadJournal, storage Storage) {
+	for _, upload := range j.Pending() {
+		parts, err := storage.ListParts(upload.Bucket, upload.Key, upload.UploadID)
+		if err == nil {
+			log.Printf("aborting interrupted upload %s of %s with %d/%d parts uploaded\n",
+				upload.UploadID, upload.Key, len(parts), len(upload.Parts))
+			err = storage.AbortMultipart(upload.Bucket, upload.Key, upload.UploadID)
+		}
+
+		if err != nil && !errors.Is(err, errUploadNotFound) {
+			// will be retried on next start
+			log.Println("failed to abort interrupted upload", upload.UploadID, err)
+			continue
+		}
+		if err := j.End(upload.UploadID); err != nil {
+			log.Println("failed to update upload journal", err)
+		}
+	}
+}
+
+// Checks that parts recorded locally are still in storage, so an upload can
+// be resumed
+func partsInStorage(storage Storage, bucket, key, uploadID string, recorded []CompletedPart) (bool, error) {
+	stored, err := storage.ListParts(bucket, key, uploadID)
+	if err != nil {
+		return false, err
+	}
+
+	storedETags := make(map[int]ETag, len(stored))
+	for _, part := range stored {
+		storedETags[part.PartNumber] = part.ETag
+	}
+	for _, part := range recorded {
+		if etag, exists := storedETags[part.PartNumber]; !exists || !etag.Matches(part.ETag) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Periodically aborts resumable and multipart uploads abandoned by clients,
+// freeing their parts in storage and their state on disk
+func expireUploads(ctx context.Context, maxAge time.Duration, tus *tusStore, multipart *clientUploadStore) {
+	ticker := time.NewTicker(uploadExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tus.Expire(maxAge)
+			multipart.Expire(maxAge)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package minioproxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "journal.log")
+	storage := newMemoryStorage()
+
+	j, err := openUploadJournal(journalPath)
+	if err != nil {
+		t.Fatal("can't open journal", err)
+	}
+
+	finishedID, _ := storage.InitiateMultipart("bucket", "finished.dat", "text/plain", nil)
+	j.Begin("bucket", "finished.dat", finishedID, "text/plain", minPartSize)
+	j.End(finishedID)
+
+	uploadID, _ := storage.InitiateMultipart("bucket", "crashed.dat", "text/plain", nil)
+	etag, _ := storage.UploadPart("bucket", "crashed.dat", uploadID, 1, 5, bytes.NewReader([]byte("hello")))
+	j.Begin("bucket", "crashed.dat", uploadID, "text/plain", minPartSize)
+	j.Part(uploadID, CompletedPart{PartNumber: 1, ETag: etag, Size: 5})
+	j.Close()
+
+	// proxy crashed while writing an entry
+	f, _ := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	f.Write([]byte(`{"op":"part","uploadId":"`))
+	f.Close()
+
+	j, err = openUploadJournal(journalPath)
+	if err != nil {
+		t.Fatal("can't reopen journal", err)
+	}
+	pending := j.Pending()
+	if len(pending) != 1 || pending[0].UploadID != uploadID || len(pending[0].Parts) != 1 {
+		t.Fatal("expected crashed upload to be pending, got", pending)
+	}
+
+	recoverJournaledUploads(j, storage)
+	if len(j.Pending()) != 0 {
+		t.Error("expected no pending uploads after recovery")
+	}
+	// only the upload which was never journaled as unfinished is left
+	if len(storage.uploads) != 1 {
+		t.Error("expected crashed upload to be aborted, got", storage.uploads)
+	}
+}
+
+func TestJournaledUpload(t *testing.T) {
+	j, err := openUploadJournal(filepath.Join(t.TempDir(), "journal.log"))
+	if err != nil {
+		t.Fatal("can't open journal", err)
+	}
+
+	u := newUploader(&failingPartStorage{newMemoryStorage(), 2}, 2, 64*1024*1024)
+	u.journal = j
+	content := genRandBytes(minChunkedFileSize + 44)
+
+	if _, err := u.Upload("bucket", "rand.dat", "text/plain", nil, Precondition{}, int64(len(content)), minPartSize, bytes.NewReader(content)); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	if len(j.Pending()) != 0 {
+		t.Error("expected aborted upload to be removed from the journal")
+	}
+
+	u.storage = newMemoryStorage()
+	if _, err := u.Upload("bucket", "rand.dat", "text/plain", nil, Precondition{}, int64(len(content)), minPartSize, bytes.NewReader(content)); err != nil {
+		t.Fatal("upload failed", err)
+	}
+	if len(j.Pending()) != 0 {
+		t.Error("expected completed upload to be removed from the journal")
+	}
+}
+
+func TestJournalCompactsWhileUploadsAreActive(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "journal.log")
+	j, err := openUploadJournal(journalPath)
+	if err != nil {
+		t.Fatal("can't open journal", err)
+	}
+	defer j.Close()
+
+	// a long upload stays active while many others come and go
+	j.Begin("bucket", "long.dat", "long", "text/plain", minPartSize)
+	for i := 0; i < 6000; i++ {
+		id := strconv.Itoa(i)
+		j.Begin("bucket", "short.dat", id, "text/plain", minPartSize)
+		j.Part(id, CompletedPart{PartNumber: 1, ETag: "etag", Size: minPartSize})
+		j.End(id)
+	}
+
+	info, err := os.Stat(journalPath)
+	if err != nil || info.Size() > journalCompactSize+1024 {
+		t.Error("expected journal to be compacted, got", info.Size())
+	}
+	if pending := j.Pending(); len(pending) != 1 || pending[0].UploadID != "long" {
+		t.Error("expected active upload to be kept, got", pending)
+	}
+}
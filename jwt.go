@@ -0,0 +1,390 @@
+package minioproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClockSkew   = time.Minute
+	defaultScopesClaim = "scope"
+	// keys are loaded again after this long to pick up rotated ones
+	jwksRefreshInterval = time.Hour
+	// tokens signed with unknown keys load keys again at most this often
+	jwksMinRefreshInterval = time.Minute
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// Validates OIDC tokens (JWTs) signed with RS256, ES256 or EdDSA
+type JWTConfig struct {
+	// JWKS file or http(s) url with keys tokens are signed with, JWTs are not
+	// accepted when empty
+	JWKS string
+	// required iss claim
+	Issuer string
+	// required to be in aud claim
+	Audience string
+	// tolerance of exp, nbf and iat claims, defaults to 1 minute
+	ClockSkew time.Duration
+	// claim with Scope* constants, space separated or an array, defaults to
+	// "scope". Other values are ignored.
+	ScopesClaim string
+	// claim with prefixes of files the token can access, all when empty or
+	// missing from the token
+	PrefixesClaim string
+	// claim with the tenant the token is issued for, tokens are not tied to
+	// tenants when empty or missing from the token
+	TenantClaim string
+}
+
+func (c JWTConfig) validate() []error {
+	if len(c.JWKS) == 0 {
+		return nil
+	}
+
+	var errs []error
+	if len(c.Issuer) == 0 {
+		errs = append(errs, errors.New("missing JWT Issuer"))
+	}
+	if len(c.Audience) == 0 {
+		errs = append(errs, errors.New("missing JWT Audience"))
+	}
+	if c.ClockSkew < 0 {
+		errs = append(errs, errors.New("JWT ClockSkew can't be negative"))
+	}
+	return errs
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtVerifier struct {
+	cfg  JWTConfig
+	http *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+	// closed when the load in progress is done, nil when there's none
+	loading chan struct{}
+}
+
+func newJWTVerifier(cfg JWTConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{cfg: cfg, http: &http.Client{Timeout: 10 * time.Second}}
+	if err := v.load(); err != nil {
+		return nil, fmt.Errorf("failed to load JWKS: %w", err)
+	}
+	return v, nil
+}
+
+// Returns the client a valid token was issued to
+func (v *jwtVerifier) Verify(token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", errInvalidToken)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	scopesClaim := v.cfg.ScopesClaim
+	if len(scopesClaim) == 0 {
+		scopesClaim = defaultScopesClaim
+	}
+	sub, _ := claims["sub"].(string)
+	var scopes []string
+	for _, scope := range claimStrings(claims[scopesClaim]) {
+		if isScope(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	var prefixes []string
+	if len(v.cfg.PrefixesClaim) > 0 {
+		prefixes = claimStrings(claims[v.cfg.PrefixesClaim])
+	}
+	p := newPrincipal(sub, scopes, prefixes)
+	if len(v.cfg.TenantClaim) > 0 {
+		p.tenant, _ = claims[v.cfg.TenantClaim].(string)
+		if len(p.tenant) > 0 && validateTenantID(p.tenant) != nil {
+			return nil, fmt.Errorf("%w: invalid tenant", errInvalidToken)
+		}
+	}
+	return p, nil
+}
+
+func (v *jwtVerifier) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	skew := withDefault(v.cfg.ClockSkew, defaultClockSkew)
+
+	exp, ok := claimTime(claims, "exp")
+	if !ok {
+		return fmt.Errorf("%w: missing exp", errInvalidToken)
+	}
+	if now.After(exp.Add(skew)) {
+		return fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Before(nbf.Add(-skew)) {
+		return fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	if iat, ok := claimTime(claims, "iat"); ok && now.Before(iat.Add(-skew)) {
+		return fmt.Errorf("%w: issued in the future", errInvalidToken)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", errInvalidToken, iss)
+	}
+	for _, aud := range claimStrings(claims["aud"]) {
+		if aud == v.cfg.Audience {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unexpected audience", errInvalidToken)
+}
+
+// Tokens signed with unknown keys load keys again, so keys can be rotated.
+// Keys are loaded without holding mu, tokens signed with known keys are
+// verified with them while new ones are loaded.
+func (v *jwtVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.lookup(kid)
+	sinceLoad := time.Since(v.loadedAt)
+	v.mu.Unlock()
+
+	if ok && sinceLoad > jwksRefreshInterval {
+		v.reload()
+	}
+	if !ok && sinceLoad > jwksMinRefreshInterval {
+		<-v.reload()
+		v.mu.Lock()
+		key, ok = v.lookup(kid)
+		v.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+	return key, nil
+}
+
+// Tokens without kid can be used with a single key
+func (v *jwtVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if len(kid) == 0 && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// Loads keys in the background unless they're already being loaded, the
+// returned channel is closed once they are
+func (v *jwtVerifier) reload() <-chan struct{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.loading != nil {
+		return v.loading
+	}
+
+	done := make(chan struct{})
+	v.loading = done
+	go func() {
+		defer close(done)
+		// keeps using keys loaded before
+		if err := v.load(); err != nil {
+			log.Println("failed to reload JWKS", err)
+		}
+		v.mu.Lock()
+		v.loading = nil
+		v.mu.Unlock()
+	}()
+	return done
+}
+
+func (v *jwtVerifier) load() error {
+	data, err := v.read()
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		// unsupported key types are skipped
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("no usable keys")
+	}
+
+	v.mu.Lock()
+	v.keys, v.loadedAt = keys, time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *jwtVerifier) read() ([]byte, error) {
+	if !strings.HasPrefix(v.cfg.JWKS, "http://") && !strings.HasPrefix(v.cfg.JWKS, "https://") {
+		return os.ReadFile(v.cfg.JWKS)
+	}
+
+	resp, err := v.http.Get(v.cfg.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.Kty == "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		exponent := new(big.Int).SetBytes(e)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		// points not on the curve are rejected by ecdsa.Verify
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+	valid := false
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		valid = alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// r and s are concatenated, not ASN.1 encoded
+		if alg == "ES256" && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(key, hash[:], r, s)
+		}
+	case ed25519.PublicKey:
+		valid = alg == "EdDSA" && ed25519.Verify(key, []byte(signed), signature)
+	}
+
+	if !valid {
+		return fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+	return nil
+}
+
+func decodeJWTSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil || json.Unmarshal(data, value) != nil {
+		return fmt.Errorf("%w: malformed", errInvalidToken)
+	}
+	return nil
+}
+
+func claimTime(claims map[string]any, name string) (time.Time, bool) {
+	seconds, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// Claims can be space separated strings or arrays of strings
+func claimStrings(claim any) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []any:
+		var values []string
+		for _, value := range claim {
+			if str, ok := value.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package minioproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testSigningKey struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (k testSigningKey) jwk() map[string]string {
+	switch pub := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": k.kid, "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": k.kid, "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": k.kid, "crv": "Ed25519", "x": b64(pub)}
+	}
+	return nil
+}
+
+func (k testSigningKey) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": k.alg, "kid": k.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, hash[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal("can't sign token", err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func newTestSigningKeys() []testSigningKey {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	return []testSigningKey{
+		{kid: "rsa", alg: "RS256", key: rsaKey},
+		{kid: "ec", alg: "ES256", key: ecKey},
+		{kid: "ed", alg: "EdDSA", key: edKey},
+	}
+}
+
+func writeJWKS(t *testing.T, path string, keys []testSigningKey) {
+	set := map[string]any{"keys": []map[string]string{}}
+	for _, key := range keys {
+		set["keys"] = append(set["keys"].([]map[string]string), key.jwk())
+	}
+	data, _ := json.Marshal(set)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testClaims(extra map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":   "https://issuer.test",
+		"aud":   []string{"other", "minio-proxy"},
+		"sub":   "service-a",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"scope": "openid read list",
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestJWTVerification(t *testing.T) {
+	keys := newTestSigningKeys()
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, keys)
+
+	verifier, err := newJWTVerifier(JWTConfig{JWKS: jwks, Issuer: "https://issuer.test", Audience: "minio-proxy", PrefixesClaim: "prefixes"})
+	if err != nil {
+		t.Fatal("can't load JWKS", err)
+	}
+
+	for _, key := range keys {
+		p, err := verifier.Verify(key.sign(t, testClaims(map[string]any{"prefixes": []string{"reports-"}})))
+		if err != nil {
+			t.Fatal(key.alg, "token rejected", err)
+		}
+		if p.id != "service-a" || !p.allows(ScopeRead, "reports-1.csv") || p.allows(ScopeRead, "other.csv") || p.hasScope(ScopeWrite) {
+			t.Error(key.alg, "unexpected principal", p)
+		}
+	}
+
+	rejected := map[string]string{
+		"expired":        keys[0].sign(t, testClaims(map[string]any{"exp": time.Now().Add(-2 * time.Minute).Unix()})),
+		"not yet valid":  keys[0].sign(t, testClaims(map[string]any{"nbf": time.Now().Add(2 * time.Minute).Unix()})),
+		"wrong issuer":   keys[0].sign(t, testClaims(map[string]any{"iss": "https://evil.test"})),
+		"wrong audience": keys[0].sign(t, testClaims(map[string]any{"aud": "other"})),
+		"tampered":       keys[1].sign(t, testClaims(nil))[:20] + keys[2].sign(t, testClaims(nil))[20:],
+		"alg mismatch":   testSigningKey{kid: "rsa", alg: "ES256", key: keys[1].key}.sign(t, testClaims(nil)),
+	}
+	for name, token := range rejected {
+		if _, err := verifier.Verify(token); !errors.Is(err, errInvalidToken) {
+			t.Error("expected", name, "token to be rejected, got", err)
+		}
+	}
+
+	skewed := keys[2].sign(t, testClaims(map[string]any{"exp": time.Now().Add(-30 * time.Second).Unix()}))
+	if _, err := verifier.Verify(skewed); err != nil {
+		t.Error("expected token within clock skew to be accepted, got", err)
+	}
+}
+
+func TestJWKSFromURLRotation(t *testing.T) {
+	keys := newTestSigningKeys()
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, keys[:1])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, jwks)
+	}))
+	defer server.Close()
+
+	verifier, err := newJWTVerifier(JWTConfig{JWKS: server.URL, Issuer: "https://issuer.test", Audience: "minio-proxy"})
+	if err != nil {
+		t.Fatal("can't load JWKS", err)
+	}
+
+	writeJWKS(t, jwks, keys)
+	token := keys[1].sign(t, testClaims(nil))
+	if _, err := verifier.Verify(token); err == nil {
+		t.Error("expected keys not to be reloaded more than once a minute")
+	}
+
+	verifier.loadedAt = verifier.loadedAt.Add(-2 * jwksMinRefreshInterval)
+	if _, err := verifier.Verify(token); err != nil {
+		t.Error("expected rotated key to be loaded, got", err)
+	}
+}
+
+func TestJWKSReloadDoesNotBlockKnownKeys(t *testing.T) {
+	keys := newTestSigningKeys()
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, keys[:1])
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// reloads hang until released
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		http.ServeFile(w, r, jwks)
+	}))
+	defer server.Close()
+
+	verifier, err := newJWTVerifier(JWTConfig{JWKS: server.URL, Issuer: "https://issuer.test", Audience: "minio-proxy"})
+	if err != nil {
+		t.Fatal("can't load JWKS", err)
+	}
+	verifier.loadedAt = verifier.loadedAt.Add(-2 * jwksRefreshInterval)
+
+	if _, err := verifier.Verify(keys[0].sign(t, testClaims(nil))); err != nil {
+		t.Error("expected known key to be used while keys are reloaded, got", err)
+	}
+
+	writeJWKS(t, jwks, keys)
+	token := keys[1].sign(t, testClaims(nil))
+	result := make(chan error)
+	go func() {
+		_, err := verifier.Verify(token)
+		result <- err
+	}()
+	close(release)
+	if err := <-result; err != nil {
+		t.Error("expected unknown key to wait for the reload, got", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Error("expected a single reload, got", n-1)
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	keys := newTestSigningKeys()
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, keys)
+
+	app, err := New(Config{
+		ServerAddr: ":4040",
+		BucketName: "test",
+		EncKey:     genRandBytes(32),
+		HmacKey:    genRandBytes(32),
+		Storage:    newMemoryStorage(),
+		APIKeys:    []APIKey{{ID: "admin", Hash: hashKey("admin-key"), Scopes: []string{ScopeWrite}}},
+		JWT:        JWTConfig{JWKS: jwks, Issuer: "https://issuer.test", Audience: "minio-proxy"},
+	})
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+
+	if w := authRequest(app, http.MethodPut, "/files/a.txt", "admin-key", []byte("a")); w.Code != http.StatusAccepted {
+		t.Fatal("expected API keys to keep working, got", w.Code, w.Body)
+	}
+	token := keys[0].sign(t, testClaims(nil))
+	if w := authRequest(app, http.MethodGet, "/files/a.txt", token, nil); w.Code != http.StatusOK {
+		t.Error("expected token with read scope to download, got", w.Code, w.Body)
+	}
+	if w := authRequest(app, http.MethodDelete, "/files/a.txt", token, nil); w.Code != http.StatusForbidden {
+		t.Error("expected token without delete scope to be denied, got", w.Code)
+	}
+	expired := keys[0].sign(t, testClaims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}))
+	if w := authRequest(app, http.MethodGet, "/files/a.txt", expired, nil); w.Code != http.StatusUnauthorized {
+		t.Error("expected expired token to be rejected, got", w.Code)
+	}
+}
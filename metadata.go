@@ -0,0 +1,125 @@
+package minioproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// name of the storage metadata field sealed fileMeta is kept in
+const sealedMetaField = "proxy-meta"
+
+// Metadata the proxy keeps with a file besides its content, encrypted and
+// authenticated the same way as the content so nothing leaks to storage
+type fileMeta struct {
+	// name of the file as uploaded by the client
+	Filename string `json:"filename,omitempty"`
+	// content type sent by the client
+	ContentType string `json:"contentType,omitempty"`
+	// content is followed by a trailer with its digests, see digestTrailerSize
+	DigestTrailer bool `json:"digestTrailer,omitempty"`
+}
+
+// Bytes between the encrypted content and its HMAC
+func (meta fileMeta) trailerSize() int64 {
+	if meta.DigestTrailer {
+		return digestTrailerSize
+	}
+	return 0
+}
+
+// Storage metadata with meta sealed with the keys of the tenant, nil when
+// there's nothing to store
+func (t *tenant) sealMeta(meta fileMeta) (map[string]string, error) {
+	if meta == (fileMeta{}) {
+		return nil, nil
+	}
+
+	data, _ := json.Marshal(meta)
+	sealed, err := sealBytes(t.encKey, t.hmacKey, data)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{sealedMetaField: base64.RawURLEncoding.EncodeToString(sealed)}, nil
+}
+
+// Zero fileMeta when the file has none
+func (t *tenant) openMeta(file *File) (fileMeta, error) {
+	var meta fileMeta
+	encoded, ok := file.Metadata[sealedMetaField]
+	if !ok {
+		return meta, nil
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return meta, ErrTamperedFile
+	}
+	data, err := openSealed(t.encKey, t.hmacKey, sealed)
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(data, &meta)
+}
+
+// Same format as encryptStream, for small values kept in memory
+func sealBytes(encKey, hmacKey, data []byte) ([]byte, error) {
+	iv, err := genIv()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, IV_SIZE+len(data), ENC_META_SIZE+len(data))
+	copy(sealed, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(sealed[IV_SIZE:], data)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(sealed)
+	return mac.Sum(sealed), nil
+}
+
+func openSealed(encKey, hmacKey, sealed []byte) ([]byte, error) {
+	if len(sealed) < ENC_META_SIZE {
+		return nil, ErrTamperedFile
+	}
+	content, sum := sealed[:len(sealed)-HMAC_SIZE], sealed[len(sealed)-HMAC_SIZE:]
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(content)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, ErrTamperedFile
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(content)-IV_SIZE)
+	cipher.NewCTR(block, content[:IV_SIZE]).XORKeyStream(data, content[IV_SIZE:])
+	return data, nil
+}
+
+// UUIDv7, ids sort by the time they were generated in
+func newObjectID() (string, error) {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	id[6] = id[6]&0x0f | 0x70
+	id[8] = id[8]&0x3f | 0x80
+
+	s := hex.EncodeToString(id[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+}
@@ -1,13 +1,15 @@
 package minioproxy
 
 import (
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/josip/minioproxy/presign"
 )
@@ -15,9 +17,13 @@ import (
 var errFileNotFound = errors.New("file not found")
 var errAccessForbidden = errors.New("access forbidden")
 
+// region requests are signed for when it's unknown
+const defaultRegion = "us-east-1"
+
 type minioClient struct {
 	endpoint string
 	signer   *presign.Signer
+	breaker  *circuitBreaker
 
 	// for testing
 	http *http.Client
@@ -25,15 +31,31 @@ type minioClient struct {
 
 type ETag string
 
-type minioFile struct {
-	ContentType   string
-	ContentLength int64
-	ETag          ETag
-
-	Data io.ReadCloser
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified time.Time
+		// MinIO extension, see List
+		UserMetadata struct {
+			Fields []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		}
+	}
+	IsTruncated           bool
+	NextContinuationToken string
 }
 
-func newMinioClient(endpoint, accessKeyID, accessSecret string) *minioClient {
+// Uses transport with default settings when nil
+func newMinioClient(endpoint, accessKeyID, accessSecret string, transport http.RoundTripper) *minioClient {
+	if transport == nil {
+		transport, _ = newTransport(TransportConfig{})
+	}
+	breaker := newCircuitBreaker(endpoint, transport)
+
 	return &minioClient{
 		endpoint: endpoint,
 		signer: &presign.Signer{
@@ -41,66 +63,241 @@ func newMinioClient(endpoint, accessKeyID, accessSecret string) *minioClient {
 			AccessKeySecret: accessSecret,
 			Endpoint:        endpoint,
 		},
-		http: http.DefaultClient,
+		breaker: breaker,
+		http:    &http.Client{Transport: breaker},
 	}
 }
 
-func (c *minioClient) GetFile(bucket, filename string) (*minioFile, error) {
-	resp, err := http.Get(c.signer.Presign("GET", bucket, filename, "10m", nil))
+func (c *minioClient) Health() []backendHealth {
+	return []backendHealth{c.breaker.Health()}
+}
+
+func (c *minioClient) Get(bucket, filename string) (*File, error) {
+	resp, err := c.http.Get(c.signer.Presign("GET", bucket, filename, "10m", nil))
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		switch resp.StatusCode {
-		case http.StatusNotFound:
-			return nil, errFileNotFound
-		case http.StatusForbidden:
-			return nil, errAccessForbidden
-		default:
-			return nil, fmt.Errorf("failed to get file info, unknown resp %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, statusError(resp, "failed to get file info")
+	}
+
+	file := fileFromResponse(resp)
+	file.Data = resp.Body
+	return file, nil
+}
+
+func (c *minioClient) GetIfNoneMatch(bucket, filename string, etag ETag) (*File, error) {
+	req, err := http.NewRequest(http.MethodGet, c.signer.Presign("GET", bucket, filename, "10m", nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("If-None-Match", string(etag))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotModified {
+			return nil, errNotModified
 		}
+		return nil, statusError(resp, "failed to get file")
 	}
 
-	return &minioFile{
-		ContentType:   resp.Header.Get("Content-Type"),
-		ContentLength: resp.ContentLength,
-		ETag:          ETag(resp.Header.Get("ETag")),
+	file := fileFromResponse(resp)
+	file.Data = resp.Body
+	return file, nil
+}
 
-		Data: resp.Body,
-	}, nil
+func (c *minioClient) GetRange(bucket, filename string, offset, length int64, ifMatch ETag) (*File, error) {
+	req, err := http.NewRequest(http.MethodGet, c.signer.Presign("GET", bucket, filename, "10m", nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if len(ifMatch) > 0 {
+		req.Header.Set("If-Match", string(ifMatch))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusRequestedRangeNotSatisfiable:
+			return nil, errInvalidRange
+		case http.StatusPreconditionFailed:
+			return nil, errPreconditionFailed
+		}
+		return nil, statusError(resp, "failed to get file range")
+	}
+
+	file := fileFromResponse(resp)
+	file.Data = resp.Body
+	return file, nil
 }
 
-func (c *minioClient) Upload(bucket, filename, contentType string, contentLength, chunkSize int64, input io.Reader) (ETag, error) {
-	chunks := c.chunksForFile(contentLength, chunkSize)
-	if chunks <= 1 {
-		// NOTE if input is coming from encryptStream, data will be still written
-		// to the request's body in blocks of ENC_BUFFER_SIZE
-		return c.uploadCommon("", -1, bucket, filename, contentType, contentLength, input)
+func (c *minioClient) Head(bucket, filename string) (*File, error) {
+	resp, err := c.http.Head(c.signer.Presign("HEAD", bucket, filename, "1m", nil))
+	if err != nil {
+		return nil, err
 	}
+	resp.Body.Close()
 
-	mu := multipartUpload{
-		client:        c,
-		Bucket:        bucket,
-		Filename:      filename,
-		ContentType:   contentType,
-		ContentLength: contentLength,
-		ChunkSize:     chunkSize,
-		Chunks:        chunks,
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, "failed to get file info")
 	}
-	return mu.Upload(input)
+
+	return fileFromResponse(resp), nil
+}
+
+func (c *minioClient) Put(bucket, filename, contentType string, metadata map[string]string, cond Precondition, contentLength int64, input io.Reader) (ETag, error) {
+	return c.uploadCommon("", -1, bucket, filename, contentType, metadata, cond, contentLength, input)
 }
 
-func (c *minioClient) chunksForFile(contentLength, chunkSize int64) int {
-	if contentLength < minChunkedFileSize || chunkSize < 1 {
-		return 1
+func (c *minioClient) Delete(bucket, filename string, cond Precondition) error {
+	req, err := http.NewRequest(http.MethodDelete, c.signer.Presign("DELETE", bucket, filename, "1m", nil), nil)
+	if err != nil {
+		return err
+	}
+	setPreconditionHeaders(req, cond)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return errPreconditionFailed
+	}
+
+	// deleting a file which does not exist is not an error
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return statusError(resp, "failed to delete file")
 	}
 
-	return int(math.Max(math.Ceil(float64(contentLength)/float64(chunkSize)), 1))
+	return nil
 }
 
-func (c *minioClient) uploadCommon(uploadID string, part int, bucket, filename, contentType string, contentLength int64, input io.Reader) (ETag, error) {
+func (c *minioClient) List(bucket, prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	continuationToken := ""
+
+	for {
+		reqOpts := url.Values{}
+		reqOpts.Set("list-type", "2")
+		// MinIO lists user metadata of files with it, S3 ignores it
+		reqOpts.Set("metadata", "true")
+		if len(prefix) > 0 {
+			reqOpts.Set("prefix", prefix)
+		}
+		if len(continuationToken) > 0 {
+			reqOpts.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := c.http.Get(c.signer.Presign("GET", bucket, "", "1m", reqOpts))
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+		if resp.StatusCode == http.StatusOK {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		} else {
+			err = statusError(resp, "failed to list files")
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Contents {
+			info := ObjectInfo{
+				Key:          obj.Key,
+				Size:         obj.Size,
+				ETag:         ETag(obj.ETag),
+				LastModified: obj.LastModified,
+			}
+			for _, field := range obj.UserMetadata.Fields {
+				if name, ok := strings.CutPrefix(strings.ToLower(field.XMLName.Local), metadataPrefix); ok {
+					if info.Metadata == nil {
+						info.Metadata = make(map[string]string)
+					}
+					info.Metadata[name] = field.Value
+				}
+			}
+			infos = append(infos, info)
+		}
+
+		if !result.IsTruncated {
+			return infos, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Returns region the bucket is in, requests for it can be signed for any
+// region
+func (c *minioClient) BucketLocation(bucket string) (string, error) {
 	reqOpts := url.Values{}
+	reqOpts.Set("location", "")
+
+	resp, err := c.http.Get(c.signer.Presign("GET", bucket, "", "1m", reqOpts))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp, "failed to get bucket location")
+	}
+
+	var location string
+	if err := xml.NewDecoder(resp.Body).Decode(&location); err != nil {
+		return "", err
+	}
+	// buckets in the default region have no location, EU is an old alias
+	switch location {
+	case "":
+		return defaultRegion, nil
+	case "EU":
+		return "eu-west-1", nil
+	}
+	return location, nil
+}
+
+// Signs requests for the region of the buckets, unless region has been set.
+// Requests are signed for a single region so all buckets have to be in it.
+func (c *minioClient) DetectRegion(buckets []string) error {
+	if len(c.signer.Region) > 0 {
+		return nil
+	}
+
+	var region string
+	for _, bucket := range buckets {
+		location, err := c.BucketLocation(bucket)
+		if err != nil {
+			return fmt.Errorf("can't detect region of bucket %s: %w", bucket, err)
+		}
+		if len(region) > 0 && location != region {
+			return fmt.Errorf("buckets %s are in different regions, %s and %s", strings.Join(buckets, ", "), region, location)
+		}
+		region = location
+	}
+	c.signer.Region = region
+	return nil
+}
+
+func (c *minioClient) uploadCommon(uploadID string, part int, bucket, filename, contentType string, metadata map[string]string, cond Precondition, contentLength int64, input io.Reader) (ETag, error) {
+	reqOpts := metadataQuery(metadata)
 	if len(uploadID) > 0 && part > 0 {
 		reqOpts.Set("partNumber", strconv.Itoa(part))
 		reqOpts.Set("uploadId", uploadID)
@@ -112,6 +309,7 @@ func (c *minioClient) uploadCommon(uploadID string, part int, bucket, filename,
 	}
 	req.Header.Add("Content-Type", contentType)
 	req.ContentLength = contentLength
+	setPreconditionHeaders(req, cond)
 
 	resp, err := c.http.Do(req)
 	if err != nil {
@@ -123,6 +321,9 @@ func (c *minioClient) uploadCommon(uploadID string, part int, bucket, filename,
 	if resp.StatusCode == http.StatusOK {
 		return ETag(etag), nil
 	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return "", errPreconditionFailed
+	}
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -131,3 +332,55 @@ func (c *minioClient) uploadCommon(uploadID string, part int, bucket, filename,
 
 	return "", fmt.Errorf("failed to upload file: %s", respBody)
 }
+
+func fileFromResponse(resp *http.Response) *File {
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	file := &File{
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+		ETag:          ETag(resp.Header.Get("ETag")),
+		LastModified:  lastModified,
+	}
+	for name, values := range resp.Header {
+		if name, ok := strings.CutPrefix(strings.ToLower(name), metadataPrefix); ok && len(values) > 0 {
+			if file.Metadata == nil {
+				file.Metadata = make(map[string]string)
+			}
+			file.Metadata[name] = values[0]
+		}
+	}
+	return file
+}
+
+// MinIO checks conditional writes itself, so they are atomic
+func setPreconditionHeaders(req *http.Request, cond Precondition) {
+	if len(cond.IfMatch) > 0 {
+		req.Header.Set("If-Match", string(cond.IfMatch))
+	}
+	if cond.IfNoneMatch {
+		req.Header.Set("If-None-Match", "*")
+	}
+}
+
+const metadataPrefix = "x-amz-meta-"
+
+// Metadata is sent in the query so it's covered by the presigned signature
+func metadataQuery(metadata map[string]string) url.Values {
+	query := url.Values{}
+	for name, value := range metadata {
+		query.Set(metadataPrefix+name, value)
+	}
+	return query
+}
+
+func statusError(resp *http.Response, msg string) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return errFileNotFound
+	case http.StatusForbidden:
+		return errAccessForbidden
+	default:
+		return fmt.Errorf("%s, unknown resp %d", msg, resp.StatusCode)
+	}
+}
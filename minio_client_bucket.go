@@ -0,0 +1,127 @@
+package minioproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var errBucketNotFound = errors.New("bucket does not exist")
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// Settings of buckets created on start. Object lock isn't supported as
+// uploads to such buckets need a checksum of the content up front, which
+// streamed uploads don't have.
+type BucketConfig struct {
+	Versioning bool
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+type createBucketConfiguration struct {
+	XMLName            xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CreateBucketConfiguration"`
+	LocationConstraint string
+}
+
+type versioningConfiguration struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ VersioningConfiguration"`
+	Status  string
+}
+
+// Checks the endpoint can be reached with valid credentials and has the bucket
+func (c *minioClient) CheckBucket(bucket string) error {
+	resp, err := c.bucketRequest(http.MethodGet, bucket, "location", nil, nil)
+	if err != nil {
+		return fmt.Errorf("%s is unreachable: %w", c.endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return bucketError(resp, bucket)
+}
+
+func (c *minioClient) CreateBucket(bucket string, cfg BucketConfig) error {
+	var body []byte
+	// buckets are created in the default region without a location
+	if region := c.signer.Region; len(region) > 0 && region != defaultRegion {
+		body, _ = xml.Marshal(createBucketConfiguration{LocationConstraint: region})
+	}
+	if err := c.bucketConfig(http.MethodPut, bucket, "", body, nil); err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	if cfg.Versioning {
+		body, _ := xml.Marshal(versioningConfiguration{Status: "Enabled"})
+		if err := c.bucketConfig(http.MethodPut, bucket, "versioning", body, nil); err != nil {
+			return fmt.Errorf("failed to enable versioning: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *minioClient) bucketConfig(method, bucket, subresource string, body []byte, headers map[string]string) error {
+	resp, err := c.bucketRequest(method, bucket, subresource, body, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return bucketError(resp, bucket)
+	}
+	return nil
+}
+
+// Bucket requests are signed with headers as some of them have to be signed
+func (c *minioClient) bucketRequest(method, bucket, subresource string, body []byte, headers map[string]string) (*http.Response, error) {
+	reqUrl := c.signer.URL(bucket, "")
+	if len(subresource) > 0 {
+		reqUrl += "?" + subresource + "="
+	}
+
+	req, err := http.NewRequest(method, reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	c.signer.Sign(req, "s3", body)
+
+	return c.http.Do(req)
+}
+
+func bucketError(resp *http.Response, bucket string) error {
+	var s3Err s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(body, &s3Err)
+
+	switch s3Err.Code {
+	case "NoSuchBucket":
+		return fmt.Errorf("%w: %s", errBucketNotFound, bucket)
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken", "InvalidTokenId":
+		return fmt.Errorf("%w: %s", errInvalidCredentials, s3Err.Message)
+	case "AccessDenied":
+		return fmt.Errorf("%w: %s", errAccessForbidden, s3Err.Message)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", errBucketNotFound, bucket)
+	}
+	return fmt.Errorf("unexpected response %d %s %s", resp.StatusCode, s3Err.Code, s3Err.Message)
+}
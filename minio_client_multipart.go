@@ -2,28 +2,19 @@ package minioproxy
 
 import (
 	"bytes"
-	"cmp"
 	"encoding/xml"
 	"errors"
-	"fmt"
 	"io"
-	"log"
-	"math"
 	"net/http"
 	"net/url"
-	"slices"
+	"strconv"
 )
 
-type chunk struct {
-	Part int
-	Data []byte
-	Size int64
-}
-
 // chunks become completedParts after they are uploaded
-type completedPart struct {
+type CompletedPart struct {
 	PartNumber int
 	ETag       ETag
+	Size       int64 `xml:"-"`
 }
 
 type initiateMultipartUploadResult struct {
@@ -33,88 +24,25 @@ type initiateMultipartUploadResult struct {
 
 type completeMultipartUpload struct {
 	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUpload" json:"-"`
-	Parts   []completedPart `xml:"Part"`
-}
-
-type multipartUpload struct {
-	Bucket        string
-	Filename      string
-	ContentType   string
-	ContentLength int64
-	ChunkSize     int64
-	Chunks        int
-
-	client   *minioClient
-	uploadID string
+	Parts   []CompletedPart `xml:"Part"`
 }
 
-var errUploadAlreadyStarted = errors.New("upload already started")
-
-const maxWorkers = 4
-
-func (m *multipartUpload) Upload(input io.Reader) (ETag, error) {
-	if len(m.uploadID) != 0 {
-		return "", errUploadAlreadyStarted
-	}
-
-	// in case we have <4 chunks we create one worker per chunk
-	workers := int(math.Min(maxWorkers, float64(m.Chunks)))
-
-	log.Printf("uploading %s of %d MB in %d chunks of %d MB with %d workers\n",
-		m.Filename, m.ContentLength/1024/1024,
-		m.Chunks, m.ChunkSize/1024/1024, workers,
-	)
-
-	jobs := make(chan chunk, workers)
-	completedParts := make(chan completedPart, m.Chunks)
-
-	uploadID, err := m.initiate()
-	if err != nil {
-		return "", errors.Join(errors.New("failed to initiate upload"), err)
-	}
-	m.uploadID = uploadID
-
-	for i := 0; i < workers; i++ {
-		go m.uploader(i, jobs, completedParts)
-	}
-
-	// TODO abort upload if it has not been completed
-	go func() {
-		for i := 0; i < m.Chunks; i++ {
-			data := make([]byte, m.ChunkSize)
-			// NOTE int64 -> int
-			n, err := io.ReadAtLeast(input, data, int(m.ChunkSize))
-			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-				log.Println("error while reading encrypted input", err)
-				close(jobs)
-				return
-			}
-
-			if n > 0 {
-				jobs <- chunk{i + 1, data[:n], int64(n)}
-			}
-
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				close(jobs)
-				break
-			}
-		}
-	}()
-
-	allCompletedParts, err := m.collectCompletitions(completedParts)
-	if err != nil {
-		return "", err
-	}
-
-	return m.complete(allCompletedParts)
+type listPartsResult struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+		Size       int64
+	} `xml:"Part"`
+	IsTruncated          bool
+	NextPartNumberMarker int
 }
 
-func (m *multipartUpload) initiate() (string, error) {
-	reqParams := url.Values{}
+func (c *minioClient) InitiateMultipart(bucket, filename, contentType string, metadata map[string]string) (string, error) {
+	reqParams := metadataQuery(metadata)
 	reqParams.Add("uploads", "")
 
-	reqUrl := m.client.signer.Presign("POST", m.Bucket, m.Filename, "1m", reqParams)
-	resp, err := m.client.http.Post(reqUrl, m.ContentType, nil)
+	reqUrl := c.signer.Presign("POST", bucket, filename, "1m", reqParams)
+	resp, err := c.http.Post(reqUrl, contentType, nil)
 	if err != nil {
 		return "", err
 	}
@@ -128,32 +56,61 @@ func (m *multipartUpload) initiate() (string, error) {
 	return respData.UploadID, nil
 }
 
-func (m *multipartUpload) uploader(id int, jobs <-chan chunk, results chan<- completedPart) {
-	for job := range jobs {
-		if len(job.Data) == 0 {
-			log.Println("upload worker", id, "tried to process empty job")
-			continue
+func (c *minioClient) UploadPart(bucket, filename, uploadID string, part int, size int64, input io.Reader) (ETag, error) {
+	return c.uploadCommon(uploadID, part, bucket, filename, "application/octet-stream", nil, Precondition{}, size, input)
+}
+
+func (c *minioClient) ListParts(bucket, filename, uploadID string) ([]CompletedPart, error) {
+	var parts []CompletedPart
+	marker := 0
+
+	for {
+		reqOpts := url.Values{}
+		reqOpts.Set("uploadId", uploadID)
+		if marker > 0 {
+			reqOpts.Set("part-number-marker", strconv.Itoa(marker))
 		}
 
-		etag, err := m.client.uploadCommon(m.uploadID, job.Part, m.Bucket, m.Filename, m.ContentType, job.Size, bytes.NewReader(job.Data))
-		if err == nil {
-			log.Println("upload worker", id, "chunk", job.Part, "✔︎")
-		} else {
-			log.Println("upload worker", id, "chunk", job.Part, "X", err)
+		resp, err := c.http.Get(c.signer.Presign("GET", bucket, filename, "1m", reqOpts))
+		if err != nil {
+			return nil, err
+		}
+
+		var result listPartsResult
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		case http.StatusNotFound:
+			err = errUploadNotFound
+		default:
+			err = statusError(resp, "failed to list parts")
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
 		}
 
-		results <- completedPart{job.Part, etag}
+		for _, part := range result.Parts {
+			parts = append(parts, CompletedPart{
+				PartNumber: part.PartNumber,
+				ETag:       ETag(part.ETag),
+				Size:       part.Size,
+			})
+		}
+
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
 	}
 }
 
-func (m *multipartUpload) complete(completedParts []completedPart) (ETag, error) {
+func (c *minioClient) CompleteMultipart(bucket, filename, uploadID string, completedParts []CompletedPart, cond Precondition) (ETag, error) {
 	reqOpts := url.Values{}
-	reqOpts.Add("uploadId", m.uploadID)
+	reqOpts.Add("uploadId", uploadID)
 
-	reqUrl := m.client.signer.Presign("POST", m.Bucket, m.Filename, "1m", reqOpts)
-	slices.SortFunc(completedParts, func(a, b completedPart) int {
-		return cmp.Compare(a.PartNumber, b.PartNumber)
-	})
+	reqUrl := c.signer.Presign("POST", bucket, filename, "1m", reqOpts)
+	sortParts(completedParts)
 
 	body := completeMultipartUpload{Parts: completedParts}
 	xmlBody, err := xml.Marshal(&body)
@@ -161,12 +118,22 @@ func (m *multipartUpload) complete(completedParts []completedPart) (ETag, error)
 	if err != nil {
 		return "", err
 	}
-	resp, err := m.client.http.Post(reqUrl, m.ContentType, bytes.NewReader(xmlBody))
+	req, err := http.NewRequest(http.MethodPost, reqUrl, bytes.NewReader(xmlBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	setPreconditionHeaders(req, cond)
+
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return "", errPreconditionFailed
+	}
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
 		return "", errors.New(string(respBody))
@@ -175,17 +142,26 @@ func (m *multipartUpload) complete(completedParts []completedPart) (ETag, error)
 	return ETag(resp.Header.Get("Etag")), nil
 }
 
-func (m *multipartUpload) collectCompletitions(parts <-chan completedPart) ([]completedPart, error) {
-	all := make([]completedPart, m.Chunks)
-
-	for i := 0; i < m.Chunks; i++ {
-		part := <-parts
-		if len(part.ETag) == 0 {
-			return nil, fmt.Errorf("failed to upload chunk %d", part.PartNumber)
-		}
+func (c *minioClient) AbortMultipart(bucket, filename, uploadID string) error {
+	reqOpts := url.Values{}
+	reqOpts.Add("uploadId", uploadID)
 
-		all[i] = part
+	req, err := http.NewRequest(http.MethodDelete, c.signer.Presign("DELETE", bucket, filename, "1m", reqOpts), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	return all, nil
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errUploadNotFound
+	default:
+		return statusError(resp, "failed to abort upload")
+	}
 }
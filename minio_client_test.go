@@ -20,6 +20,7 @@ import (
 type mockMinioFile struct {
 	ContentType   string
 	ContentLength int64
+	Metadata      map[string]string
 	Data          []byte
 }
 
@@ -81,8 +82,14 @@ func newMockMinioServer(keyId, secret string) *mockMinioServer {
 				minio.Files[id] = &mockMinioFile{
 					ContentType:   r.Header.Get("Content-Type"),
 					ContentLength: r.ContentLength,
+					Metadata:      make(map[string]string),
 					Data:          data,
 				}
+				for name := range q {
+					if name, ok := strings.CutPrefix(name, metadataPrefix); ok {
+						minio.Files[id].Metadata[name] = q.Get(metadataPrefix + name)
+					}
+				}
 
 				w.Header().Set("ETag", minio.Files[id].ETag())
 			}
@@ -148,6 +155,9 @@ func newMockMinioServer(keyId, secret string) *mockMinioServer {
 			w.Header().Set("Content-Type", f.ContentType)
 			w.Header().Set("Content-Length", strconv.FormatInt(f.ContentLength, 10))
 			w.Header().Set("ETag", f.ETag())
+			for name, value := range f.Metadata {
+				w.Header().Set(metadataPrefix+name, value)
+			}
 			_, err := w.Write(f.Data)
 			if err != nil {
 				writeError(w, http.StatusInternalServerError, err)
@@ -162,16 +172,16 @@ func newMockPair() (*mockMinioServer, *minioClient) {
 	keyID := "access-key-id"
 	secretKey := "access-key-secret"
 	minio := newMockMinioServer(keyID, secretKey)
-	client := newMinioClient(minio.server.URL, keyID, secretKey)
+	client := newMinioClient(minio.server.URL, keyID, secretKey, nil)
 
 	return minio, client
 }
 
 func verifyFilesMatch(client *minioClient, bucket, filename, contentType string, data []byte, chunkSize int64) error {
 	contentLength := int64(len(data))
-	etag, err := client.Upload(
+	etag, err := newUploader(client, defaultUploadWorkers, 64*1024*1024).Upload(
 		bucket, filename,
-		contentType, contentLength,
+		contentType, nil, Precondition{}, contentLength,
 		chunkSize,
 		bytes.NewReader(data),
 	)
@@ -182,7 +192,7 @@ func verifyFilesMatch(client *minioClient, bucket, filename, contentType string,
 		return errors.New("upload failed: no etag")
 	}
 
-	file, err := client.GetFile(bucket, filename)
+	file, err := client.Get(bucket, filename)
 	if err != nil {
 		return fmt.Errorf("failed to get file: %w", err)
 	}
@@ -216,6 +226,25 @@ func TestUploadDownloadSimpleFile(t *testing.T) {
 	}
 }
 
+func TestUploadMetadata(t *testing.T) {
+	_, client := newMockPair()
+	content := []byte("hello world")
+
+	metadata := map[string]string{"proxy-meta": "sealed"}
+	if _, err := client.Put("testbucket", "hello.txt", "text/plain", metadata, Precondition{}, int64(len(content)), bytes.NewReader(content)); err != nil {
+		t.Fatal("upload failed", err)
+	}
+
+	file, err := client.Get("testbucket", "hello.txt")
+	if err != nil {
+		t.Fatal("download failed", err)
+	}
+	file.Data.Close()
+	if file.Metadata["proxy-meta"] != "sealed" {
+		t.Error("expected metadata to be sent with the file, got", file.Metadata)
+	}
+}
+
 func TestChunkedUpload(t *testing.T) {
 	minio, client := newMockPair()
 	bucket := "testbucket"
@@ -231,3 +260,57 @@ func TestChunkedUpload(t *testing.T) {
 		t.Error("expected for upload to happen with multipart but it did not")
 	}
 }
+
+func TestDetectRegion(t *testing.T) {
+	var credentials []string
+	locations := map[string]string{"/bucket/": "eu-central-1", "/tenant/": "eu-central-1", "/other/": ""}
+	minio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credentials = append(credentials, r.URL.Query().Get("X-Amz-Credential"))
+		location, ok := locations[r.URL.Path]
+		if !ok || !r.URL.Query().Has("location") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` + location + `</LocationConstraint>`))
+	}))
+	defer minio.Close()
+
+	client := newMinioClient(minio.URL, "key", "secret", nil)
+	if err := client.DetectRegion([]string{"bucket", "missing"}); err == nil || len(client.signer.Region) > 0 {
+		t.Error("expected failed detection to be reported, got", err, client.signer.Region)
+	}
+	if err := client.DetectRegion([]string{"bucket", "other"}); err == nil || len(client.signer.Region) > 0 {
+		t.Error("expected buckets in different regions to be reported, got", err, client.signer.Region)
+	}
+
+	credentials = nil
+	if err := client.DetectRegion([]string{"bucket", "tenant"}); err != nil || client.signer.Region != "eu-central-1" {
+		t.Fatal("expected region to be detected, got", err, client.signer.Region)
+	}
+
+	client.Head("bucket", "file")
+	if !strings.Contains(credentials[2], "/eu-central-1/s3/") {
+		t.Error("expected requests to be signed for detected region, got", credentials[2])
+	}
+}
+
+func TestListMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("metadata") != "true" {
+			t.Error("expected metadata to be requested")
+		}
+		w.Write([]byte(`<ListBucketResult><Contents><Key>a.txt</Key><Size>100</Size><ETag>"abc"</ETag>` +
+			`<UserMetadata><X-Amz-Meta-Proxy-Meta>sealed</X-Amz-Meta-Proxy-Meta><content-type>text/plain</content-type></UserMetadata>` +
+			`</Contents><Contents><Key>b.txt</Key><Size>50</Size></Contents></ListBucketResult>`))
+	}))
+	defer server.Close()
+
+	client := newMinioClient(server.URL, "key", "secret", nil)
+	infos, err := client.List("bucket", "")
+	if err != nil || len(infos) != 2 {
+		t.Fatal("list failed", infos, err)
+	}
+	if len(infos[0].Metadata) != 1 || infos[0].Metadata["proxy-meta"] != "sealed" || infos[1].Metadata != nil {
+		t.Error("expected listed metadata of files, got", infos[0].Metadata, infos[1].Metadata)
+	}
+}
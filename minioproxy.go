@@ -4,21 +4,37 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 
 	"github.com/gorilla/mux"
 )
 
 type App struct {
-	ctx    context.Context
-	router *mux.Router
-	client *minioClient
+	ctx      context.Context
+	router   *mux.Router
+	storage  Storage
+	uploader *uploader
+	// nil when clients don't have to authenticate
+	auth *authenticator
+	// nil when disabled
+	policy *policyEngine
+	shares *shareStore
+	// nil when disabled
+	cache       *objectCache
+	replication *replicatedStorage
 
-	addr       string
-	chunkSize  int64
-	bucketName string
+	addr      string
+	chunkSize int64
+	// parallel ranged downloads, disabled when segment size is 0
+	downloadSegmentSize int64
+	downloadWorkers     int
+	bucketName          string
+	tenants             map[string]TenantConfig
+	// existing files can't be replaced by uploads
+	createOnly bool
 
-	encKey  []byte
-	hmacKey []byte
+	keys keyring
 }
 
 func New(cfg Config) (*App, error) {
@@ -26,19 +42,129 @@ func New(cfg Config) (*App, error) {
 		return nil, err
 	}
 
+	// shared by all MinIO endpoints
+	transport, err := newTransport(cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	storage, err := newStorage(ctx, cfg, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	uploader := newUploader(storage, cfg.uploadWorkers(), cfg.uploadMemoryLimitInBytes())
+	var replication *replicatedStorage
+	if len(cfg.Replicas) > 0 {
+		var statePath string
+		if len(cfg.UploadStatePath) > 0 {
+			if err := os.MkdirAll(cfg.UploadStatePath, 0o700); err != nil {
+				return nil, err
+			}
+			statePath = filepath.Join(cfg.UploadStatePath, "replication.json")
+		}
+		// copies share memory and workers with uploads
+		replication = newReplicatedStorage(ctx, storage, newReplicaStorages(cfg, transport), cfg.ReplicationMode, statePath, uploader, cfg.uploadChunkSizeInBytes())
+		storage = replication
+		uploader = uploader.withStorage(replication)
+	}
+
+	cfg.Tenants, err = loadTenants(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.SkipStartupChecks {
+		if err := checkStorage(storage, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	auth, err := newAuthenticator(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	app := &App{
-		ctx:       context.Background(),
+		ctx:       ctx,
 		router:    mux.NewRouter(),
 		addr:      cfg.ServerAddr,
 		chunkSize: cfg.uploadChunkSizeInBytes(),
-		encKey:    cfg.EncKey,
-		hmacKey:   cfg.HmacKey,
-		client:    newMinioClient(cfg.Endpoint, cfg.AccessKey, cfg.SecretKey),
+		keys:      keyring{encKey: cfg.EncKey, hmacKey: cfg.HmacKey},
+		storage:   storage,
+		auth:      auth,
+
+		replication: replication,
+
+		downloadSegmentSize: cfg.downloadSegmentSizeInBytes(),
+		downloadWorkers:     cfg.downloadWorkers(),
+
+		uploader: uploader,
 	}
 	app.bucketName = cfg.BucketName
+	app.createOnly = cfg.CreateOnly
+	app.tenants = make(map[string]TenantConfig, len(cfg.Tenants))
+	for _, tenant := range cfg.Tenants {
+		app.tenants[tenant.ID] = tenant
+	}
+	if len(cfg.PolicyFile) > 0 {
+		app.policy, err = newPolicyEngine(ctx, cfg.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	app.router.Use(app.authenticate)
+
+	if len(cfg.CachePath) > 0 {
+		app.cache, err = newObjectCache(cfg.CachePath, cfg.cacheSizeInBytes(), storage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.ShareKey) > 0 {
+		if err := os.MkdirAll(cfg.UploadStatePath, 0o700); err != nil {
+			return nil, err
+		}
+		app.shares, err = newShareStore(cfg.ShareKey, filepath.Join(cfg.UploadStatePath, "shares.json"))
+		if err != nil {
+			return nil, err
+		}
+		bindShareApi(app)
+		bindTicketApi(app)
+	}
+
+	if len(cfg.UploadStatePath) > 0 {
+		tus, err := newTusStore(filepath.Join(cfg.UploadStatePath, "tus"), storage, app.keys)
+		if err != nil {
+			return nil, err
+		}
+		multipart, err := newClientUploadStore(filepath.Join(cfg.UploadStatePath, "multipart"), storage, app.keys, cfg.uploadSpoolLimitInBytes())
+		if err != nil {
+			return nil, err
+		}
+
+		journal, err := openUploadJournal(filepath.Join(cfg.UploadStatePath, "journal.log"))
+		if err != nil {
+			return nil, err
+		}
+		app.uploader.journal = journal
+
+		recoverJournaledUploads(journal, storage)
+		tus.Recover()
+		multipart.Recover()
+		go expireUploads(ctx, cfg.uploadExpiry(), tus, multipart)
+
+		bindTusApi(app, tus)
+		bindMultipartApi(app, multipart)
+	}
 
 	bindUploadApi(app)
 	bindReadApi(app)
+	bindDeleteApi(app)
+	bindStatsApi(app)
+	bindHealthApi(app)
+	bindPolicyApi(app)
 
 	return app, nil
 }
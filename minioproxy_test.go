@@ -0,0 +1,164 @@
+package minioproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestApp(t *testing.T) (*App, *memoryStorage) {
+	storage := newMemoryStorage()
+	app, err := New(Config{
+		ServerAddr: ":4040",
+		BucketName: "test",
+		EncKey:     genRandBytes(32),
+		HmacKey:    genRandBytes(32),
+		Storage:    storage,
+	})
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+
+	return app, storage
+}
+
+func doRequest(app *App, method, path string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadReadDelete(t *testing.T) {
+	app, storage := newTestApp(t)
+	content := []byte("hello world")
+
+	if w := doRequest(app, http.MethodPut, "/files/hello.txt", content); w.Code != http.StatusAccepted {
+		t.Fatal("upload failed", w.Code, w.Body)
+	}
+
+	stored, _ := storage.Get("test", "hello.txt")
+	encrypted, _ := io.ReadAll(stored.Data)
+	if bytes.Contains(encrypted, content) {
+		t.Error("expected stored file to be encrypted")
+	}
+
+	w := doRequest(app, http.MethodGet, "/files/hello.txt", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Error("expected to download uploaded file, got", w.Code, w.Body)
+	}
+
+	w = doRequest(app, http.MethodHead, "/files/hello.txt", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "11" {
+		t.Error("expected HEAD to return cleartext size, got", w.Code, w.Header())
+	}
+
+	w = doRequest(app, http.MethodGet, "/files", nil)
+	var files []fileInfo
+	json.NewDecoder(w.Body).Decode(&files)
+	if len(files) != 1 || files[0].ID != "hello.txt" || files[0].Size != 11 {
+		t.Error("expected to list uploaded file, got", files)
+	}
+
+	if w := doRequest(app, http.MethodDelete, "/files/hello.txt", nil); w.Code != http.StatusNoContent {
+		t.Error("delete failed", w.Code, w.Body)
+	}
+	if w := doRequest(app, http.MethodGet, "/files/hello.txt", nil); w.Code != http.StatusNotFound {
+		t.Error("expected deleted file to be gone, got", w.Code)
+	}
+}
+
+func formBody(t *testing.T, files map[string]string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("title", "ignored")
+	for name, content := range files {
+		part, err := form.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	form.Close()
+	return body, form.FormDataContentType()
+}
+
+func TestFormUpload(t *testing.T) {
+	app, _ := newTestApp(t)
+	body, contentType := formBody(t, map[string]string{"a.txt": "first file", "b.txt": "second"})
+
+	req := httptest.NewRequest(http.MethodPost, "/files", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+
+	var files []formFile
+	json.NewDecoder(w.Body).Decode(&files)
+	if w.Code != http.StatusAccepted || len(files) != 2 {
+		t.Fatal("form upload failed", w.Code, files)
+	}
+	for _, file := range files {
+		if len(file.ETag) == 0 || (file.ID == "a.txt" && file.Size != 10) {
+			t.Error("unexpected result", file)
+		}
+	}
+
+	if w := doRequest(app, http.MethodGet, "/files/b.txt", nil); w.Body.String() != "second" {
+		t.Error("expected to download file of form, got", w.Code, w.Body)
+	}
+}
+
+func TestCreateWithGeneratedID(t *testing.T) {
+	app, storage := newTestApp(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/files?prefix=invoice-", bytes.NewReader([]byte("%PDF")))
+	req.Header.Set("Content-Type", "application/pdf")
+	req.Header.Set("Content-Disposition", `attachment; filename="March invoice.pdf"`)
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+
+	var created struct{ ID string }
+	json.NewDecoder(w.Body).Decode(&created)
+	if w.Code != http.StatusCreated || !strings.HasPrefix(created.ID, "invoice-") || w.Header().Get("Location") != "/files/"+created.ID {
+		t.Fatal("create failed", w.Code, created, w.Header())
+	}
+
+	stored, _ := storage.Head("test", created.ID)
+	if strings.Contains(stored.Metadata[sealedMetaField], "March") {
+		t.Error("expected original filename to be sealed")
+	}
+
+	w = doRequest(app, http.MethodGet, "/files/"+created.ID, nil)
+	if w.Body.String() != "%PDF" || w.Header().Get("Content-Type") != "application/pdf" {
+		t.Error("expected to download created file, got", w.Code, w.Header())
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `inline; filename="March invoice.pdf"` {
+		t.Error("expected original filename, got", disposition)
+	}
+
+	first := created.ID
+	json.NewDecoder(doRequest(app, http.MethodPost, "/files?prefix=invoice-", []byte("%PDF")).Body).Decode(&created)
+	if created.ID == first {
+		t.Error("expected every file to get a new id")
+	}
+}
+
+func TestCreateOnly(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.createOnly = true
+
+	if w := doRequest(app, http.MethodPut, "/files/hello.txt", []byte("hello")); w.Code != http.StatusAccepted {
+		t.Fatal("upload failed", w.Code, w.Body)
+	}
+	if w := doRequest(app, http.MethodPut, "/files/hello.txt", []byte("replaced")); w.Code != http.StatusConflict {
+		t.Error("expected existing file not to be replaced, got", w.Code)
+	}
+	if w := doRequest(app, http.MethodGet, "/files/hello.txt", nil); w.Body.String() != "hello" {
+		t.Error("unexpected content", w.Body)
+	}
+}
@@ -0,0 +1,594 @@
+package minioproxy
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errPartTooLarge = errors.New("part is larger than part size")
+var errPartChanged = errors.New("part has already been uploaded with different content")
+var errMissingParts = errors.New("upload is missing parts")
+var errPartTooFarAhead = errors.New("part is too far ahead of missing parts")
+var errSpoolFull = errors.New("too many parts are waiting for missing parts")
+
+// parts received ahead of the first missing part a single upload can spool
+const maxSpooledParts = 64
+
+const defaultUploadSpoolLimitMB = 10 * 1024
+
+// Multipart upload driven by the client, parts are uploaded in parallel
+// through the proxy.
+//
+// All parts except the last one have to be PartSize large, so every part
+// can be encrypted on its own at its offset in the file. The first part is
+// prefixed with the IV. HMAC has to be calculated over the whole file in order,
+// so parts received out of order are spooled to disk until all parts before
+// them arrive. Digests of cleartext are computed in the same order. The last,
+// shorter, part is uploaded only when the upload is completed so the digest
+// trailer and HMAC sum can be appended to it. If the last part is full length,
+// they are uploaded as an extra part.
+type clientUpload struct {
+	// same as the upload id in storage
+	ID     string
+	Bucket string
+	Key    string
+	// keys of the tenant are used to encrypt the file
+	Tenant      string
+	ContentType string
+	PartSize    int64
+
+	IV       []byte
+	MacState []byte
+	// digests of cleartext of hashed parts, sealed into the file after the
+	// content, nil for uploads created without a digest trailer
+	Digests *resumableDigestState
+	// parts 1..HashedParts have been written to MacState and Digests
+	HashedParts int
+	// number of the part shorter than PartSize, if it has been received
+	LastPart int
+	// uploaded parts with their cleartext size
+	Parts map[int]CompletedPart
+}
+
+type clientUploadStore struct {
+	dir     string
+	storage Storage
+	keys    keyring
+	// disk space spooled parts of all uploads can take
+	spoolLimit int64
+
+	mu sync.Mutex
+	// one lock per upload, state itself always lives on disk
+	locks map[string]*sync.Mutex
+	// bytes of spooled parts, including parts being received
+	spooled int64
+}
+
+func newClientUploadStore(dir string, storage Storage, keys keyring, spoolLimit int64) (*clientUploadStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &clientUploadStore{
+		dir:        dir,
+		storage:    storage,
+		keys:       keys,
+		spoolLimit: spoolLimit,
+		locks:      make(map[string]*sync.Mutex),
+	}, nil
+}
+
+func (s *clientUploadStore) statePath(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".json")
+}
+
+// ciphertext of parts waiting to be hashed, without the IV
+func (s *clientUploadStore) spoolPath(id string, part int) string {
+	return filepath.Join(s.dir, filepath.Base(id)+"."+strconv.Itoa(part))
+}
+
+func (s *clientUploadStore) lock(id string) func() {
+	s.mu.Lock()
+	l, exists := s.locks[id]
+	if !exists {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	s.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Metadata is sealed by the caller and has to have fileMeta.DigestTrailer set
+func (s *clientUploadStore) Initiate(bucket, key, tenant, contentType string, metadata map[string]string, partSize int64) (*clientUpload, error) {
+	iv, err := genIv()
+	if err != nil {
+		return nil, err
+	}
+	_, hmacKey := s.keys.forTenant(tenant)
+	mac := newResumableMac(hmacKey)
+	mac.Write(iv)
+	macState, err := mac.State()
+	if err != nil {
+		return nil, err
+	}
+	digests, err := newResumableDigests().State()
+	if err != nil {
+		return nil, err
+	}
+
+	uploadID, err := s.storage.InitiateMultipart(bucket, key, contentType, metadata)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to initiate upload"), err)
+	}
+
+	upload := &clientUpload{
+		ID:          uploadID,
+		Bucket:      bucket,
+		Key:         key,
+		Tenant:      tenant,
+		ContentType: contentType,
+		PartSize:    partSize,
+		IV:          iv,
+		MacState:    macState,
+		Digests:     digests,
+		Parts:       make(map[int]CompletedPart),
+	}
+	return upload, s.save(upload)
+}
+
+func (s *clientUploadStore) Get(bucket, key, id string) (*clientUpload, error) {
+	var upload clientUpload
+	if err := readJsonFile(s.statePath(id), &upload); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errUploadNotFound
+		}
+		return nil, err
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		return nil, errUploadNotFound
+	}
+
+	return &upload, nil
+}
+
+// Encrypts and uploads a part. Parts smaller than PartSize are treated as the
+// last part of the file and are uploaded when the upload is completed.
+func (s *clientUploadStore) UploadPart(bucket, key, id string, part int, size int64, input io.Reader) (*CompletedPart, error) {
+	upload, err := s.Get(bucket, key, id)
+	if err != nil {
+		return nil, err
+	}
+	if part < 1 || part >= maxParts {
+		return nil, fmt.Errorf("%w %d", errInvalidPart, part)
+	}
+	if size > upload.PartSize {
+		return nil, errPartTooLarge
+	}
+	if int64(part-1)*upload.PartSize+size+int64(ENC_META_SIZE)+upload.trailerSize() > maxFileSize {
+		return nil, errFileTooLarge
+	}
+	if part <= upload.HashedParts {
+		// already part of HMAC, can be only retried with the same content
+		return s.verifyPart(upload, part, size, input)
+	}
+	if part > upload.HashedParts+maxSpooledParts {
+		return nil, fmt.Errorf("%w, part %d hasn't been received", errPartTooFarAhead, upload.HashedParts+1)
+	}
+	// the next part is hashed as soon as it's received, so it's never refused
+	if !s.reserveSpool(size, part == upload.HashedParts+1) {
+		return nil, errSpoolFull
+	}
+	// once renamed, space is released when the spooled part is removed
+	spooled := false
+	defer func() {
+		if !spooled {
+			s.releaseSpool(size)
+		}
+	}()
+
+	encKey, _ := s.keys.forTenant(upload.Tenant)
+	ctr, err := newCTRAt(encKey, upload.IV, int64(part-1)*upload.PartSize)
+	if err != nil {
+		return nil, err
+	}
+	// renamed to spoolPath once the part is recorded
+	spool, err := os.CreateTemp(s.dir, filepath.Base(id)+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	encrypted := io.TeeReader(cipher.StreamReader{S: ctr, R: input}, spool)
+	var etag ETag
+	if size < upload.PartSize {
+		_, err = io.Copy(io.Discard, encrypted)
+		if err == nil {
+			err = checkLength(size, fileSize(spool))
+		}
+	} else {
+		storedSize := size
+		if part == 1 {
+			encrypted = io.MultiReader(bytes.NewReader(upload.IV), encrypted)
+			storedSize += int64(IV_SIZE)
+		}
+		etag, err = s.storage.UploadPart(bucket, key, id, part, storedSize, encrypted)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.lock(id)()
+	// state could have changed while the part was uploading
+	if upload, err = s.Get(bucket, key, id); err != nil {
+		return nil, err
+	}
+	if part <= upload.HashedParts {
+		existing := upload.Parts[part]
+		if existing.Size != size || !existing.ETag.Matches(etag) {
+			return nil, errPartChanged
+		}
+		return &existing, nil
+	}
+
+	if size < upload.PartSize {
+		if upload.LastPart != 0 && upload.LastPart != part {
+			return nil, fmt.Errorf("%w %d, part %d is already the last part", errInvalidPart, part, upload.LastPart)
+		}
+		upload.LastPart = part
+	} else if upload.LastPart == part {
+		upload.LastPart = 0
+	}
+	if err := os.Rename(spool.Name(), s.spoolPath(id, part)); err != nil {
+		return nil, err
+	}
+	spooled = true
+
+	completed := CompletedPart{PartNumber: part, ETag: etag, Size: size}
+	upload.Parts[part] = completed
+	if err := s.hashParts(upload); err != nil {
+		return nil, err
+	}
+
+	return &completed, s.save(upload)
+}
+
+// Storage refuses to complete the upload if cond fails, the upload is kept so
+// it can be aborted
+func (s *clientUploadStore) Complete(bucket, key, id string, cond Precondition) (ETag, error) {
+	defer s.lock(id)()
+
+	upload, err := s.Get(bucket, key, id)
+	if err != nil {
+		return "", err
+	}
+
+	last := 0
+	for part := range upload.Parts {
+		last = max(last, part)
+	}
+	if last == 0 || upload.HashedParts != last {
+		return "", errMissingParts
+	}
+	if upload.LastPart != 0 && upload.LastPart != last {
+		return "", fmt.Errorf("%w %d, only the last part can be smaller than part size", errInvalidPart, upload.LastPart)
+	}
+
+	encKey, hmacKey := s.keys.forTenant(upload.Tenant)
+	mac, err := restoreResumableMac(hmacKey, upload.MacState)
+	if err != nil {
+		return "", err
+	}
+	digests, err := upload.restoreDigests()
+	if err != nil {
+		return "", err
+	}
+
+	var parts []CompletedPart
+	var length int64
+	for i := 1; i <= last; i++ {
+		parts = append(parts, upload.Parts[i])
+		length += upload.Parts[i].Size
+	}
+	tail, err := resumableTail(encKey, upload.IV, length, mac, digests)
+	if err != nil {
+		return "", err
+	}
+
+	if upload.LastPart == 0 {
+		etag, err := s.storage.UploadPart(bucket, key, id, last+1, int64(len(tail)), bytes.NewReader(tail))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, CompletedPart{PartNumber: last + 1, ETag: etag})
+	} else {
+		etag, err := s.uploadLastPart(upload, tail)
+		if err != nil {
+			return "", err
+		}
+		parts[last-1].ETag = etag
+	}
+
+	etag, err := s.storage.CompleteMultipart(bucket, key, id, parts, cond)
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("multipart upload", id, "of", key, "completed")
+	s.remove(upload)
+	return etag, nil
+}
+
+// Checks uploads left from before a restart against storage, uploads which
+// can't be resumed are removed
+func (s *clientUploadStore) Recover() {
+	// parts which were being received during the restart
+	interrupted, _ := filepath.Glob(filepath.Join(s.dir, "*.tmp-*"))
+	for _, name := range interrupted {
+		os.Remove(name)
+	}
+	spooled, _ := filepath.Glob(filepath.Join(s.dir, "*.[0-9]*"))
+	for _, name := range spooled {
+		if info, err := os.Stat(name); err == nil {
+			s.spooled += info.Size()
+		}
+	}
+
+	states, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	for _, state := range states {
+		var upload clientUpload
+		if err := readJsonFile(state, &upload); err != nil {
+			log.Println("can't read multipart upload state", state, err)
+			continue
+		}
+
+		var stored []CompletedPart
+		for _, part := range upload.Parts {
+			// last part is spooled locally until the upload is completed
+			if part.PartNumber != upload.LastPart {
+				stored = append(stored, part)
+			}
+		}
+
+		resumable, err := partsInStorage(s.storage, upload.Bucket, upload.Key, upload.ID, stored)
+		if err != nil && !errors.Is(err, errUploadNotFound) {
+			log.Println("can't check multipart upload", upload.ID, err)
+			continue
+		}
+		if resumable {
+			log.Println("multipart upload", upload.ID, "of", upload.Key, "can be resumed with", len(upload.Parts), "parts")
+			continue
+		}
+
+		log.Println("multipart upload", upload.ID, "of", upload.Key, "is missing parts in storage, removing")
+		s.storage.AbortMultipart(upload.Bucket, upload.Key, upload.ID)
+		s.remove(&upload)
+	}
+}
+
+// Aborts uploads which haven't received a part for maxAge
+func (s *clientUploadStore) Expire(maxAge time.Duration) {
+	states, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	for _, state := range states {
+		if info, err := os.Stat(state); err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+
+		var upload clientUpload
+		if err := readJsonFile(state, &upload); err != nil {
+			log.Println("can't read multipart upload state", state, err)
+			continue
+		}
+		if err := s.Abort(upload.Bucket, upload.Key, upload.ID); err != nil && !errors.Is(err, errUploadNotFound) {
+			log.Println("failed to abort expired multipart upload", upload.ID, err)
+			continue
+		}
+		log.Println("multipart upload", upload.ID, "of", upload.Key, "expired")
+	}
+}
+
+func (s *clientUploadStore) Abort(bucket, key, id string) error {
+	defer s.lock(id)()
+
+	upload, err := s.Get(bucket, key, id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.storage.AbortMultipart(bucket, key, id); err != nil && !errors.Is(err, errUploadNotFound) {
+		return err
+	}
+	s.remove(upload)
+	return nil
+}
+
+// Writes spooled parts to HMAC, and their cleartext to digests, in order for
+// as long as there are no gaps
+func (s *clientUploadStore) hashParts(upload *clientUpload) error {
+	encKey, hmacKey := s.keys.forTenant(upload.Tenant)
+	mac, err := restoreResumableMac(hmacKey, upload.MacState)
+	if err != nil {
+		return err
+	}
+	digests, err := upload.restoreDigests()
+	if err != nil {
+		return err
+	}
+
+	for {
+		next := upload.HashedParts + 1
+		if _, received := upload.Parts[next]; !received {
+			break
+		}
+
+		spooled, err := os.Open(s.spoolPath(upload.ID, next))
+		if err != nil {
+			return err
+		}
+		err = hashPart(encKey, upload, next, spooled, mac, digests)
+		spooled.Close()
+		if err != nil {
+			return err
+		}
+
+		upload.HashedParts = next
+		if next == upload.LastPart {
+			// kept until the upload is completed
+			break
+		}
+		s.removeSpooled(spooled.Name())
+	}
+
+	if upload.MacState, err = mac.State(); err != nil {
+		return err
+	}
+	if digests != nil {
+		upload.Digests, err = digests.State()
+	}
+	return err
+}
+
+// Writes ciphertext of a part to mac and, when there are digests, decrypts it
+// for them
+func hashPart(encKey []byte, upload *clientUpload, part int, encrypted io.Reader, mac *resumableMac, digests *resumableDigests) error {
+	if digests == nil {
+		_, err := io.Copy(mac, encrypted)
+		return err
+	}
+
+	ctr, err := newCTRAt(encKey, upload.IV, int64(part-1)*upload.PartSize)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(digests, cipher.StreamReader{S: ctr, R: io.TeeReader(encrypted, mac)})
+	return err
+}
+
+// Digest trailer and HMAC sum are appended to the last part
+func (s *clientUploadStore) uploadLastPart(upload *clientUpload, tail []byte) (ETag, error) {
+	spooled, err := os.Open(s.spoolPath(upload.ID, upload.LastPart))
+	if err != nil {
+		return "", err
+	}
+	defer spooled.Close()
+
+	size := fileSize(spooled) + int64(len(tail))
+	var data io.Reader = io.MultiReader(spooled, bytes.NewReader(tail))
+	if upload.LastPart == 1 {
+		data = io.MultiReader(bytes.NewReader(upload.IV), data)
+		size += int64(IV_SIZE)
+	}
+
+	return s.storage.UploadPart(upload.Bucket, upload.Key, upload.ID, upload.LastPart, size, data)
+}
+
+func (s *clientUploadStore) verifyPart(upload *clientUpload, part int, size int64, input io.Reader) (*CompletedPart, error) {
+	encKey, _ := s.keys.forTenant(upload.Tenant)
+	ctr, err := newCTRAt(encKey, upload.IV, int64(part-1)*upload.PartSize)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := md5.New()
+	if part == 1 && size == upload.PartSize {
+		hash.Write(upload.IV)
+	}
+	if _, err := io.Copy(hash, cipher.StreamReader{S: ctr, R: input}); err != nil {
+		return nil, err
+	}
+
+	existing := upload.Parts[part]
+	expected := existing.ETag
+	if part == upload.LastPart {
+		// last part is not in storage yet, only spooled
+		spooled, _, err := md5File(s.spoolPath(upload.ID, part))
+		if err != nil {
+			return nil, err
+		}
+		expected = md5ETag(spooled)
+	}
+
+	if existing.Size != size || !md5ETag(hash.Sum(nil)).Matches(expected) {
+		return nil, errPartChanged
+	}
+	return &existing, nil
+}
+
+func (u *clientUpload) restoreDigests() (*resumableDigests, error) {
+	if u.Digests == nil {
+		return nil, nil
+	}
+	return restoreResumableDigests(*u.Digests)
+}
+
+// Bytes between the encrypted content and its HMAC
+func (u *clientUpload) trailerSize() int64 {
+	if u.Digests == nil {
+		return 0
+	}
+	return digestTrailerSize
+}
+
+func (s *clientUploadStore) save(upload *clientUpload) error {
+	return writeJsonFile(s.statePath(upload.ID), upload)
+}
+
+func (s *clientUploadStore) remove(upload *clientUpload) {
+	spooled, _ := filepath.Glob(filepath.Join(s.dir, filepath.Base(upload.ID)+".[0-9]*"))
+	for _, name := range spooled {
+		s.removeSpooled(name)
+	}
+	os.Remove(s.statePath(upload.ID))
+
+	s.mu.Lock()
+	delete(s.locks, upload.ID)
+	s.mu.Unlock()
+}
+
+func (s *clientUploadStore) reserveSpool(size int64, force bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !force && s.spooled+size > s.spoolLimit {
+		return false
+	}
+	s.spooled += size
+	return true
+}
+
+func (s *clientUploadStore) releaseSpool(size int64) {
+	s.mu.Lock()
+	s.spooled -= size
+	s.mu.Unlock()
+}
+
+func (s *clientUploadStore) removeSpooled(name string) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(name); err == nil {
+		s.releaseSpool(info.Size())
+	}
+}
+
+func fileSize(f *os.File) int64 {
+	stat, err := f.Stat()
+	if err != nil {
+		return -1
+	}
+	return stat.Size()
+}
@@ -0,0 +1,187 @@
+package minioproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func uploadInParts(t *testing.T, app *App, filename string, content []byte, order []int) string {
+	w := doRequest(app, http.MethodPost, "/files/"+filename+"?uploads", nil)
+	var info multipartUploadInfo
+	json.NewDecoder(w.Body).Decode(&info)
+	if w.Code != http.StatusOK || len(info.UploadID) == 0 {
+		t.Fatal("expected upload to be initiated, got", w.Code, w.Body)
+	}
+
+	var wg sync.WaitGroup
+	for _, part := range order {
+		start := int64(part-1) * info.PartSize
+		end := min(start+info.PartSize, int64(len(content)))
+
+		wg.Add(1)
+		go func(part int) {
+			defer wg.Done()
+			path := "/files/" + filename + "?uploadId=" + info.UploadID + "&partNumber=" + strconv.Itoa(part)
+			if w := doRequest(app, http.MethodPut, path, content[start:end]); w.Code != http.StatusOK {
+				t.Error("part", part, "upload failed", w.Code, w.Body)
+			}
+		}(part)
+	}
+	wg.Wait()
+
+	return info.UploadID
+}
+
+func TestClientMultipartUpload(t *testing.T) {
+	app := newStatefulTestApp(t, newMemoryStorage(), t.TempDir(), genRandBytes(32), genRandBytes(32))
+
+	cases := map[string][]byte{
+		"short-last-part.dat": genRandBytes(2*minPartSize + 1234),
+		"full-last-part.dat":  genRandBytes(2 * minPartSize),
+		"single-part.dat":     []byte("hello world"),
+	}
+
+	for filename, content := range cases {
+		parts := int(ceilDiv(int64(len(content)), minPartSize))
+		order := []int{}
+		for part := parts; part > 0; part-- {
+			order = append(order, part)
+		}
+		uploadID := uploadInParts(t, app, filename, content, order)
+
+		w := doRequest(app, http.MethodGet, "/files/"+filename+"?uploadId="+uploadID, nil)
+		var info multipartUploadInfo
+		json.NewDecoder(w.Body).Decode(&info)
+		if len(info.Parts) != parts || info.Parts[0].PartNumber != 1 {
+			t.Error(filename, "expected", parts, "parts to be listed, got", info.Parts)
+		}
+
+		if w := doRequest(app, http.MethodPost, "/files/"+filename+"?uploadId="+uploadID, nil); w.Code != http.StatusAccepted {
+			t.Fatal(filename, "complete failed", w.Code, w.Body)
+		}
+
+		w = doRequest(app, http.MethodGet, "/files/"+filename, nil)
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Error(filename, "expected to download file uploaded in parts, got", w.Code)
+		}
+		if digest := fileDigest(string(content)); w.Header().Get("Repr-Digest") != digest || w.Header().Get("Content-Digest") != digest {
+			t.Error(filename, "expected digests of file uploaded in parts, got", w.Header())
+		}
+	}
+}
+
+func TestClientMultipartMissingPart(t *testing.T) {
+	app := newStatefulTestApp(t, newMemoryStorage(), t.TempDir(), genRandBytes(32), genRandBytes(32))
+	content := genRandBytes(2*minPartSize + 1234)
+
+	uploadID := uploadInParts(t, app, "missing.dat", content, []int{1, 3})
+	if w := doRequest(app, http.MethodPost, "/files/missing.dat?uploadId="+uploadID, nil); w.Code != http.StatusBadRequest {
+		t.Error("expected upload with a missing part not to complete, got", w.Code)
+	}
+
+	// retrying a part with the same content is fine, different content is not
+	path := "/files/missing.dat?uploadId=" + uploadID + "&partNumber=1"
+	if w := doRequest(app, http.MethodPut, path, content[:minPartSize]); w.Code != http.StatusOK {
+		t.Error("expected retried part to be accepted, got", w.Code, w.Body)
+	}
+	if w := doRequest(app, http.MethodPut, path, genRandBytes(minPartSize)); w.Code != http.StatusConflict {
+		t.Error("expected changed part to be rejected, got", w.Code)
+	}
+
+	if w := doRequest(app, http.MethodDelete, "/files/missing.dat?uploadId="+uploadID, nil); w.Code != http.StatusNoContent {
+		t.Error("expected upload to be aborted, got", w.Code, w.Body)
+	}
+}
+
+func TestClientMultipartCreateOnly(t *testing.T) {
+	app := newStatefulTestApp(t, newMemoryStorage(), t.TempDir(), genRandBytes(32), genRandBytes(32))
+	app.createOnly = true
+
+	first := uploadInParts(t, app, "race.dat", []byte("first"), []int{1})
+	second := uploadInParts(t, app, "race.dat", []byte("second"), []int{1})
+
+	if w := doRequest(app, http.MethodPost, "/files/race.dat?uploadId="+first, nil); w.Code != http.StatusAccepted {
+		t.Fatal("complete failed", w.Code, w.Body)
+	}
+	if w := doRequest(app, http.MethodPost, "/files/race.dat?uploadId="+second, nil); w.Code != http.StatusConflict {
+		t.Error("expected upload started before the file existed not to replace it, got", w.Code)
+	}
+	if w := doRequest(app, http.MethodGet, "/files/race.dat", nil); w.Body.String() != "first" {
+		t.Error("unexpected content", w.Body)
+	}
+}
+
+func TestClientMultipartSpoolLimits(t *testing.T) {
+	storage := newMemoryStorage()
+	keys := keyring{encKey: genRandBytes(32), hmacKey: genRandBytes(32)}
+	store, err := newClientUploadStore(t.TempDir(), storage, keys, minPartSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := store.Initiate("test", "big.dat", "", "application/octet-stream", nil, minPartSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := genRandBytes(5 * minPartSize)
+	uploadPart := func(part int) error {
+		data := content[(part-1)*minPartSize : part*minPartSize]
+		_, err := store.UploadPart("test", "big.dat", upload.ID, part, minPartSize, bytes.NewReader(data))
+		return err
+	}
+
+	if _, err := store.UploadPart("test", "big.dat", upload.ID, maxSpooledParts+2, 1, bytes.NewReader([]byte("x"))); !errors.Is(err, errPartTooFarAhead) {
+		t.Error("expected part too far ahead to be refused, got", err)
+	}
+	if err := uploadPart(3); err != nil {
+		t.Fatal("expected part to be spooled, got", err)
+	}
+	if err := uploadPart(2); !errors.Is(err, errSpoolFull) {
+		t.Error("expected part over the spool limit to be refused, got", err)
+	}
+	// missing parts are always accepted and free spooled parts after them
+	if err := uploadPart(1); err != nil {
+		t.Fatal("expected next part to be accepted, got", err)
+	}
+	if err := uploadPart(2); err != nil {
+		t.Fatal("expected next part to be accepted, got", err)
+	}
+	if err := uploadPart(5); err != nil {
+		t.Error("expected spool to have been freed, got", err)
+	}
+}
+
+func TestClientMultipartExpiry(t *testing.T) {
+	storage := newMemoryStorage()
+	dir := t.TempDir()
+	keys := keyring{encKey: genRandBytes(32), hmacKey: genRandBytes(32)}
+	store, err := newClientUploadStore(dir, storage, keys, minPartSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := store.Initiate("test", "abandoned.dat", "", "application/octet-stream", nil, minPartSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Expire(time.Hour)
+	if _, err := store.Get("test", "abandoned.dat", upload.ID); err != nil {
+		t.Fatal("expected recent upload to be kept, got", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(store.statePath(upload.ID), old, old)
+	store.Expire(time.Hour)
+	if _, err := store.Get("test", "abandoned.dat", upload.ID); !errors.Is(err, errUploadNotFound) {
+		t.Error("expected abandoned upload to be removed, got", err)
+	}
+	if len(storage.uploads) != 0 {
+		t.Error("expected abandoned upload to be aborted in storage")
+	}
+}
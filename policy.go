@@ -0,0 +1,208 @@
+package minioproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+const (
+	// policy file is checked for changes this often
+	policyReloadInterval = 5 * time.Second
+	// principal of requests when authentication is disabled
+	anonymousPrincipal = "anonymous"
+)
+
+// Rule of a policy file. Principals, actions and keys are globs where *
+// matches any characters, slashes included, and ? a single one.
+type policyRule struct {
+	// shown by the explain endpoint, defaults to the position of the rule
+	ID     string `json:"id"`
+	Effect string `json:"effect"`
+	// ids of API keys, or sub claims of JWTs
+	Principals []string `json:"principals"`
+	// Scope* constants
+	Actions []string `json:"actions"`
+	Keys    []string `json:"keys"`
+}
+
+type policyFile struct {
+	Rules []policyRule `json:"rules"`
+}
+
+type policyDecision struct {
+	Allowed   bool   `json:"allowed"`
+	Principal string `json:"principal"`
+	Action    string `json:"action"`
+	Key       string `json:"key"`
+	// rule the decision was made by
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Evaluates rules of a policy file, reloading it when it changes. Requests
+// are denied unless a rule allows them, deny rules win over allow rules.
+type policyEngine struct {
+	path string
+
+	mu      sync.RWMutex
+	rules   []policyRule
+	modTime time.Time
+}
+
+func newPolicyEngine(ctx context.Context, path string) (*policyEngine, error) {
+	engine := &policyEngine{path: path}
+	if err := engine.reload(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(policyReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// invalid changes are ignored, previous rules stay in place
+				if err := engine.reload(); err != nil {
+					log.Println("failed to reload policy file", path, err)
+				}
+			}
+		}
+	}()
+	return engine, nil
+}
+
+// Loads the policy file again if it has been modified
+func (e *policyEngine) reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	e.mu.RLock()
+	unchanged := info.ModTime().Equal(e.modTime)
+	e.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	var file policyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	for i := range file.Rules {
+		if len(file.Rules[i].ID) == 0 {
+			file.Rules[i].ID = fmt.Sprintf("rule %d", i)
+		}
+		if err := file.Rules[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.modTime.IsZero() {
+		log.Println("reloaded policy file", e.path, "with", len(file.Rules), "rules")
+	}
+	e.rules, e.modTime = file.Rules, info.ModTime()
+	return nil
+}
+
+func (r policyRule) validate() error {
+	if r.Effect != PolicyAllow && r.Effect != PolicyDeny {
+		return fmt.Errorf("%s: effect has to be %q or %q", r.ID, PolicyAllow, PolicyDeny)
+	}
+	if len(r.Principals) == 0 || len(r.Actions) == 0 || len(r.Keys) == 0 {
+		return fmt.Errorf("%s: principals, actions and keys can't be empty, use \"*\" to match all", r.ID)
+	}
+	for _, action := range r.Actions {
+		if action != "*" && !isScope(action) {
+			return fmt.Errorf("%s: unknown action %q", r.ID, action)
+		}
+	}
+	return nil
+}
+
+func (r policyRule) matches(principal, action, key string) bool {
+	return matchesAny(r.Principals, principal) && matchesAny(r.Actions, action) && matchesAny(r.Keys, key)
+}
+
+func (e *policyEngine) Evaluate(principal, action, key string) policyDecision {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	decision := policyDecision{Principal: principal, Action: action, Key: key}
+	var allowedBy string
+	for _, rule := range e.rules {
+		if !rule.matches(principal, action, key) {
+			continue
+		}
+		if rule.Effect == PolicyDeny {
+			decision.Rule = rule.ID
+			decision.Reason = "denied by " + rule.ID
+			return decision
+		}
+		if len(allowedBy) == 0 {
+			allowedBy = rule.ID
+		}
+	}
+
+	if len(allowedBy) == 0 {
+		decision.Reason = "no rule allows it"
+		return decision
+	}
+	decision.Allowed = true
+	decision.Rule = allowedBy
+	decision.Reason = "allowed by " + allowedBy
+	return decision
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// * matches any characters, / included, ? a single one
+func globMatch(pattern, value string) bool {
+	p, v := 0, 0
+	// where to continue from when a * has to match more characters
+	starP, starV := -1, -1
+	for p < len(pattern) || v < len(value) {
+		if p < len(pattern) {
+			switch c := pattern[p]; {
+			case c == '*':
+				starP, starV = p, v+1
+				p++
+				continue
+			case v < len(value) && (c == '?' || c == value[v]):
+				p++
+				v++
+				continue
+			}
+		}
+		if starV > 0 && starV <= len(value) {
+			p, v = starP, starV
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package minioproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicy = `{"rules": [
+	{"id": "team-a", "effect": "allow", "principals": ["team-a"], "actions": ["read", "write"], "keys": ["uploads/a/*"]},
+	{"id": "reporting", "effect": "allow", "principals": ["reporting"], "actions": ["read"], "keys": ["reports/*"]},
+	{"id": "everyone", "effect": "allow", "principals": ["*"], "actions": ["*"], "keys": ["legal-*"]},
+	{"id": "legal-hold", "effect": "deny", "principals": ["*"], "actions": ["delete"], "keys": ["legal-*"]}
+]}`
+
+func writePolicy(t *testing.T, path, policy string, modTime time.Time) {
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// file system timestamps can be too coarse to notice quick changes
+	os.Chtimes(path, modTime, modTime)
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, value string
+		match          bool
+	}{
+		{"uploads/a/*", "uploads/a/b/c.png", true},
+		{"uploads/a/*", "uploads/b/c.png", false},
+		{"*.png", "a/b.png", true},
+		{"*.png", "a.png.txt", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*a*b", "xxaybzb", true},
+		{"*", "", true},
+		{"exact", "exact", true},
+	}
+	for _, c := range cases {
+		if globMatch(c.pattern, c.value) != c.match {
+			t.Error("expected", c.pattern, "matching", c.value, "to be", c.match)
+		}
+	}
+}
+
+func TestPolicyEvaluation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, testPolicy, time.Now().Add(-time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	engine, err := newPolicyEngine(ctx, path)
+	if err != nil {
+		t.Fatal("can't load policy", err)
+	}
+
+	cases := []struct {
+		principal, action, key string
+		allowed                bool
+		rule                   string
+	}{
+		{"team-a", ScopeWrite, "uploads/a/1.png", true, "team-a"},
+		{"team-a", ScopeWrite, "uploads/b/1.png", false, ""},
+		{"reporting", ScopeRead, "reports/q1.csv", true, "reporting"},
+		{"reporting", ScopeWrite, "reports/q1.csv", false, ""},
+		{"team-a", ScopeRead, "legal-contract.pdf", true, "everyone"},
+		{"team-a", ScopeDelete, "legal-contract.pdf", false, "legal-hold"},
+	}
+	for _, c := range cases {
+		decision := engine.Evaluate(c.principal, c.action, c.key)
+		if decision.Allowed != c.allowed || decision.Rule != c.rule {
+			t.Error("unexpected decision for", c.principal, c.action, c.key, decision)
+		}
+	}
+
+	writePolicy(t, path, `{"rules": [{"effect": "maybe"}]}`, time.Now().Add(-30*time.Second))
+	if err := engine.reload(); err == nil {
+		t.Error("expected invalid policy to be rejected")
+	}
+	if !engine.Evaluate("team-a", ScopeWrite, "uploads/a/1.png").Allowed {
+		t.Error("expected previous rules to stay in place")
+	}
+
+	writePolicy(t, path, `{"rules": [{"effect": "allow", "principals": ["team-a"], "actions": ["*"], "keys": ["*"]}]}`, time.Now())
+	if err := engine.reload(); err != nil {
+		t.Fatal("can't reload policy", err)
+	}
+	if decision := engine.Evaluate("team-a", ScopeDelete, "legal-contract.pdf"); !decision.Allowed || decision.Rule != "rule 0" {
+		t.Error("expected reloaded rules to be used, got", decision)
+	}
+}
+
+func TestPolicyExplain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, `{"rules": [
+		{"id": "uploads", "effect": "allow", "principals": ["team-a"], "actions": ["*"], "keys": ["uploads-*"]}
+	]}`, time.Now())
+
+	app, err := New(Config{
+		ServerAddr: ":4040",
+		BucketName: "test",
+		EncKey:     genRandBytes(32),
+		HmacKey:    genRandBytes(32),
+		Storage:    newMemoryStorage(),
+		APIKeys: []APIKey{
+			{ID: "team-a", Hash: hashKey("a-key"), Scopes: []string{ScopeRead, ScopeWrite, ScopeList}},
+		},
+		PolicyFile: path,
+	})
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+
+	if w := authRequest(app, http.MethodPut, "/files/uploads-1.txt", "a-key", []byte("1")); w.Code != http.StatusAccepted {
+		t.Fatal("expected upload allowed by policy to work, got", w.Code, w.Body)
+	}
+	if w := authRequest(app, http.MethodPut, "/files/other.txt", "a-key", []byte("2")); w.Code != http.StatusForbidden {
+		t.Error("expected upload not allowed by policy to be denied, got", w.Code)
+	}
+
+	var decision policyDecision
+	w := authRequest(app, http.MethodGet, "/_policy/explain?action=write&key=uploads-2.txt", "a-key", nil)
+	json.NewDecoder(w.Body).Decode(&decision)
+	if !decision.Allowed || decision.Principal != "team-a" || decision.Rule != "uploads" {
+		t.Error("expected explain to show the allowing rule, got", w.Code, decision)
+	}
+
+	decision = policyDecision{}
+	w = authRequest(app, http.MethodGet, "/_policy/explain?action=delete&key=uploads-2.txt", "a-key", nil)
+	json.NewDecoder(w.Body).Decode(&decision)
+	if decision.Allowed || len(decision.Rule) > 0 || len(decision.Reason) == 0 {
+		t.Error("expected explain to show missing scope, got", decision)
+	}
+}
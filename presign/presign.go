@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,33 +23,54 @@ const defaultRegion = "us-east-1"
 const serviceName = "s3"
 const serviceRequestType = "aws4_request"
 
+// How buckets are addressed in urls
+const (
+	// virtual-host for domain names with a dot, path for IPs and single label
+	// hosts like localhost or docker service names
+	AddressingAuto = ""
+	// http://endpoint/bucket/key
+	AddressingPath = "path"
+	// http://bucket.endpoint/key
+	AddressingVirtualHost = "virtual-host"
+)
+
+type Credentials struct {
+	AccessKeyID     string
+	AccessKeySecret string
+	// set for temporary credentials
+	SessionToken string
+}
+
+// Source of credentials which can change over time
+type CredentialsProvider interface {
+	Credentials() Credentials
+}
+
 type Signer struct {
 	AccessKeyID     string
 	AccessKeySecret string
-	Region          string
-	Endpoint        string
+	SessionToken    string
+	// used instead of static credentials above when set
+	Provider CredentialsProvider
+
+	Region   string
+	Endpoint string
+	// one of Addressing* constants
+	Addressing string
 
 	// for tests
 	t time.Time
 }
 
 func (s *Signer) Presign(method, bucket, filename, duration string, extraQueryOptions url.Values) string {
-	region := s.Region
-	if len(region) == 0 {
-		region = defaultRegion
-	}
-
+	region := s.region()
+	creds := s.credentials()
 	qp := url.Values{}
-
-	now := time.Now().UTC()
-	if !s.t.IsZero() {
-		now = s.t
-	}
+	now := s.now()
 
 	endpoint := s.Endpoint
 	u, _ := url.Parse(endpoint)
-	// for real S3/minio instances buckets are part of the host url, not path
-	if !isIp(u.Hostname()) {
+	if s.virtualHost(u.Hostname()) && len(bucket) != 0 {
 		endpoint = u.Scheme + "://" + bucket + "." + u.Host
 		u, _ = u.Parse(endpoint)
 		bucket = ""
@@ -64,7 +87,10 @@ func (s *Signer) Presign(method, bucket, filename, duration string, extraQueryOp
 		serviceName,
 		serviceRequestType,
 	}, "/")
-	qp.Add("X-Amz-Credential", s.AccessKeyID+"/"+scope)
+	qp.Add("X-Amz-Credential", creds.AccessKeyID+"/"+scope)
+	if len(creds.SessionToken) > 0 {
+		qp.Add("X-Amz-Security-Token", creds.SessionToken)
+	}
 
 	for k, v := range extraQueryOptions {
 		qp.Add(k, v[0])
@@ -90,13 +116,8 @@ func (s *Signer) Presign(method, bucket, filename, duration string, extraQueryOp
 	toSign.WriteRune('\n')
 	toSign.WriteString(sha256Hash(canonReq.String()))
 
-	dateKey := hmacSha256([]byte("AWS4"+s.AccessKeySecret), []byte(now.Format(timeFormatYMD)))
-	dateRegionKey := hmacSha256(dateKey, []byte(region))
-	dateRegionServiceKey := hmacSha256(dateRegionKey, []byte("s3"))
-	signingKey := hmacSha256(dateRegionServiceKey, []byte("aws4_request"))
-
 	// tada
-	signature := hex.EncodeToString(hmacSha256(signingKey, []byte(toSign.String())))
+	signature := hex.EncodeToString(hmacSha256(signingKey(creds, now, region, serviceName), []byte(toSign.String())))
 
 	urlWithPath := endpoint
 	if len(bucket) != 0 {
@@ -108,6 +129,112 @@ func (s *Signer) Presign(method, bucket, filename, duration string, extraQueryOp
 	return fmt.Sprintf("%s?%s&X-Amz-Signature=%s", urlWithPath, qp.Encode(), signature)
 }
 
+// Url of a file without signature, bucket is addressed the same way as in
+// presigned urls. Use with Sign.
+func (s *Signer) URL(bucket, filename string) string {
+	u, _ := url.Parse(s.Endpoint)
+	if len(bucket) == 0 {
+		return s.Endpoint + "/" + filename
+	}
+	if s.virtualHost(u.Hostname()) {
+		return u.Scheme + "://" + bucket + "." + u.Host + "/" + filename
+	}
+	return s.Endpoint + "/" + bucket + "/" + filename
+}
+
+// Signs request with the Authorization header as documented at
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+// All headers set on the request are signed, payload is the request body.
+func (s *Signer) Sign(req *http.Request, service string, payload []byte) {
+	region := s.region()
+	creds := s.credentials()
+	now := s.now()
+
+	payloadHash := sha256Hash(string(payload))
+	req.Header.Set("X-Amz-Date", now.Format(timeFormatISO8061))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(creds.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	var canonReq strings.Builder
+	canonReq.WriteString(req.Method + "\n")
+	canonReq.WriteString(path + "\n")
+	canonReq.WriteString(strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20") + "\n")
+	for _, name := range names {
+		canonReq.WriteString(name + ":" + headers[name] + "\n")
+	}
+	canonReq.WriteString("\n" + signedHeaders + "\n")
+	canonReq.WriteString(payloadHash)
+
+	scope := strings.Join([]string{
+		now.Format(timeFormatYMD),
+		region,
+		service,
+		serviceRequestType,
+	}, "/")
+
+	var toSign strings.Builder
+	toSign.WriteString("AWS4-HMAC-SHA256\n")
+	toSign.WriteString(now.Format(timeFormatISO8061))
+	toSign.WriteRune('\n')
+	toSign.WriteString(scope)
+	toSign.WriteRune('\n')
+	toSign.WriteString(sha256Hash(canonReq.String()))
+
+	signature := hex.EncodeToString(hmacSha256(signingKey(creds, now, region, service), []byte(toSign.String())))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func (s *Signer) credentials() Credentials {
+	if s.Provider != nil {
+		return s.Provider.Credentials()
+	}
+	return Credentials{
+		AccessKeyID:     s.AccessKeyID,
+		AccessKeySecret: s.AccessKeySecret,
+		SessionToken:    s.SessionToken,
+	}
+}
+
+func (s *Signer) region() string {
+	if len(s.Region) == 0 {
+		return defaultRegion
+	}
+	return s.Region
+}
+
+func (s *Signer) now() time.Time {
+	if !s.t.IsZero() {
+		return s.t
+	}
+	return time.Now().UTC()
+}
+
+func signingKey(creds Credentials, now time.Time, region, service string) []byte {
+	dateKey := hmacSha256([]byte("AWS4"+creds.AccessKeySecret), []byte(now.Format(timeFormatYMD)))
+	dateRegionKey := hmacSha256(dateKey, []byte(region))
+	dateRegionServiceKey := hmacSha256(dateRegionKey, []byte(service))
+	return hmacSha256(dateRegionServiceKey, []byte(serviceRequestType))
+}
+
 func sha256Hash(data string) string {
 	h := sha256.New()
 	h.Write([]byte(data))
@@ -120,6 +247,18 @@ func hmacSha256(key []byte, data []byte) []byte {
 	return mac.Sum(nil)
 }
 
+func (s *Signer) virtualHost(hostname string) bool {
+	switch s.Addressing {
+	case AddressingPath:
+		return false
+	case AddressingVirtualHost:
+		return true
+	default:
+		// for real S3/minio instances buckets are part of the host url, not path
+		return !isIp(hostname) && strings.Contains(hostname, ".")
+	}
+}
+
 func isIp(str string) bool {
 	return net.ParseIP(str) != nil
 }
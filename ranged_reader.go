@@ -0,0 +1,131 @@
+package minioproxy
+
+import (
+	"errors"
+	"io"
+	"log"
+)
+
+const defaultDownloadWorkers = 4
+
+// attempts per segment before the download fails
+const segmentAttempts = 3
+
+type segmentResult struct {
+	data []byte
+	err  error
+}
+
+// Downloads a file as segments of segmentSize fetched concurrently from
+// storage, and returns them in order. At most workers segments are being
+// downloaded or waiting to be read, which limits memory used per download
+// to about workers*segmentSize.
+//
+// NOTE HMAC of encrypted files is calculated over the whole file, so
+// segments can't be verified on their own, only the transfer is parallel.
+// Every segment has to come from the version of the file with etag, reading
+// fails with errPreconditionFailed if the file is replaced in the meantime.
+type rangedReader struct {
+	storage     Storage
+	bucket      string
+	key         string
+	etag        ETag
+	size        int64
+	segmentSize int64
+
+	// segments in order of the file, each one is filled in by its fetcher
+	segments chan chan segmentResult
+	current  []byte
+	err      error
+	done     chan struct{}
+}
+
+func newRangedReader(storage Storage, bucket, key string, etag ETag, size, segmentSize int64, workers int) *rangedReader {
+	r := &rangedReader{
+		storage:     storage,
+		bucket:      bucket,
+		key:         key,
+		etag:        etag,
+		size:        size,
+		segmentSize: segmentSize,
+		segments:    make(chan chan segmentResult, max(workers-1, 0)),
+		done:        make(chan struct{}),
+	}
+
+	go r.dispatch()
+	return r
+}
+
+func (r *rangedReader) dispatch() {
+	defer close(r.segments)
+
+	for offset := int64(0); offset < r.size; offset += r.segmentSize {
+		result := make(chan segmentResult, 1)
+		// blocks while enough segments are in flight
+		select {
+		case r.segments <- result:
+		case <-r.done:
+			return
+		}
+
+		go func(offset int64) {
+			result <- r.fetch(offset, min(r.segmentSize, r.size-offset))
+		}(offset)
+	}
+}
+
+func (r *rangedReader) fetch(offset, length int64) segmentResult {
+	var err error
+	for attempt := 1; attempt <= segmentAttempts; attempt++ {
+		var file *File
+		file, err = r.storage.GetRange(r.bucket, r.key, offset, length, r.etag)
+		if err == nil {
+			data := make([]byte, length)
+			_, err = io.ReadFull(file.Data, data)
+			file.Data.Close()
+			if err == nil {
+				return segmentResult{data: data}
+			}
+		}
+
+		if errors.Is(err, errFileNotFound) || errors.Is(err, errAccessForbidden) || errors.Is(err, errPreconditionFailed) {
+			break
+		}
+		log.Println("failed to fetch", r.key, "at", offset, "attempt", attempt, err)
+	}
+
+	return segmentResult{err: err}
+}
+
+func (r *rangedReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		next, ok := <-r.segments
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		select {
+		case segment := <-next:
+			r.current, r.err = segment.data, segment.err
+		case <-r.done:
+			r.err = errors.New("reader closed")
+		}
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *rangedReader) Close() error {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	return nil
+}
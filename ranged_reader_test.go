@@ -0,0 +1,71 @@
+package minioproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// fails first request for every range
+type flakyRangeStorage struct {
+	*memoryStorage
+	mu     sync.Mutex
+	failed map[int64]bool
+}
+
+func (s *flakyRangeStorage) GetRange(bucket, key string, offset, length int64, ifMatch ETag) (*File, error) {
+	s.mu.Lock()
+	failed := s.failed[offset]
+	s.failed[offset] = true
+	s.mu.Unlock()
+
+	if !failed {
+		return nil, errors.New("connection reset")
+	}
+	return s.memoryStorage.GetRange(bucket, key, offset, length, ifMatch)
+}
+
+func TestRangedReader(t *testing.T) {
+	storage := &flakyRangeStorage{memoryStorage: newMemoryStorage(), failed: make(map[int64]bool)}
+	content := genRandBytes(10*1024 + 123)
+	etag, _ := storage.Put("test", "file", "", nil, Precondition{}, int64(len(content)), bytes.NewReader(content))
+	reader := newRangedReader(storage, "test", "file", etag, int64(len(content)), 1024, 3)
+	defer reader.Close()
+
+	read, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal("failed to read", err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Error("expected segments to be read in order")
+	}
+
+	reader = newRangedReader(storage, "test", "missing", "", int64(len(content)), 1024, 3)
+	defer reader.Close()
+	if _, err := io.ReadAll(reader); !errors.Is(err, errFileNotFound) {
+		t.Error("expected missing file to fail, got", err)
+	}
+
+	// file replaced after the download started
+	storage.Put("test", "file", "", nil, Precondition{}, int64(len(content)), bytes.NewReader(genRandBytes(len(content))))
+	reader = newRangedReader(storage, "test", "file", etag, int64(len(content)), 1024, 3)
+	defer reader.Close()
+	if _, err := io.ReadAll(reader); !errors.Is(err, errPreconditionFailed) {
+		t.Error("expected segments of another version to be refused, got", err)
+	}
+}
+
+func TestRangedDownload(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.downloadSegmentSize = 1024
+	content := genRandBytes(10 * 1024)
+
+	doRequest(app, http.MethodPut, "/files/large.bin", content)
+	w := doRequest(app, http.MethodGet, "/files/large.bin", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Error("expected to download file in segments, got", w.Code)
+	}
+}
@@ -0,0 +1,192 @@
+package minioproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShareExpiry = time.Hour
+	maxShareExpiry     = 7 * 24 * time.Hour
+)
+
+var errShareInvalid = errors.New("invalid share link")
+var errShareExpired = errors.New("share link has expired")
+var errShareUsedUp = errors.New("share link has been used up")
+
+// Download link signed by the proxy, all fields are part of the signature
+type shareLink struct {
+	ID     string
+	Tenant string
+	// name of the file as the client sees it
+	Key     string
+	Expires time.Time
+	// 0 for no limit
+	MaxDownloads int
+	// only this client can use the link when set
+	IP string
+	// Content-Disposition filename when set
+	Name string
+}
+
+func (l shareLink) query() url.Values {
+	query := url.Values{}
+	query.Set("link", l.ID)
+	query.Set("expires", strconv.FormatInt(l.Expires.Unix(), 10))
+	if len(l.Tenant) > 0 {
+		query.Set("tenant", l.Tenant)
+	}
+	if l.MaxDownloads > 0 {
+		query.Set("downloads", strconv.Itoa(l.MaxDownloads))
+	}
+	if len(l.IP) > 0 {
+		query.Set("ip", l.IP)
+	}
+	if len(l.Name) > 0 {
+		query.Set("name", l.Name)
+	}
+	return query
+}
+
+// Signs share links and upload tickets, and counts how many times the ones
+// with a limit have been used
+type shareStore struct {
+	key []byte
+	// uses are kept in memory only when empty
+	statePath string
+
+	mu   sync.Mutex
+	uses map[string]*shareUses
+}
+
+type shareUses struct {
+	Count int
+	// forgotten once the link expires
+	Expires time.Time
+}
+
+func newShareStore(key []byte, statePath string) (*shareStore, error) {
+	s := &shareStore{key: key, statePath: statePath, uses: make(map[string]*shareUses)}
+	if len(statePath) > 0 {
+		if err := readJsonFile(statePath, &s.uses); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *shareStore) signature(key string, query url.Values) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(key + "\n" + query.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Path and query of the link
+func (s *shareStore) URL(link shareLink) string {
+	query := link.query()
+	query.Set("signature", s.signature(link.Key, query))
+	return "/files/" + url.PathEscape(link.Key) + "?" + query.Encode()
+}
+
+// Checks the request is made with a valid link for the file
+func (s *shareStore) Verify(r *http.Request, filename string) (*shareLink, error) {
+	query := r.URL.Query()
+	signature := query.Get("signature")
+	query.Del("signature")
+	if !hmac.Equal([]byte(signature), []byte(s.signature(filename, query))) {
+		return nil, errShareInvalid
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, errShareInvalid
+	}
+	link := &shareLink{
+		ID:      query.Get("link"),
+		Tenant:  query.Get("tenant"),
+		Key:     filename,
+		Expires: time.Unix(expires, 0),
+		IP:      query.Get("ip"),
+		Name:    query.Get("name"),
+	}
+	link.MaxDownloads, _ = strconv.Atoi(query.Get("downloads"))
+
+	if time.Now().After(link.Expires) {
+		return nil, errShareExpired
+	}
+	if len(link.IP) > 0 {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !net.ParseIP(link.IP).Equal(net.ParseIP(host)) {
+			return nil, fmt.Errorf("%w: not valid for %s", errShareInvalid, host)
+		}
+	}
+	return link, nil
+}
+
+// Records a download, failing once the link is used up. The use is taken
+// before the file is sent so concurrent downloads can't go over the limit,
+// and given back with Release if it isn't sent after all.
+func (s *shareStore) Download(link *shareLink) error {
+	if link.MaxDownloads == 0 {
+		return nil
+	}
+	return s.use(link.ID, link.Expires, link.MaxDownloads)
+}
+
+func (s *shareStore) use(id string, expires time.Time, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uses, ok := s.uses[id]
+	if !ok {
+		uses = &shareUses{Expires: expires}
+		s.uses[id] = uses
+	}
+	if uses.Count >= limit {
+		return errShareUsedUp
+	}
+	uses.Count++
+
+	s.saveLocked()
+	return nil
+}
+
+func (s *shareStore) Release(link *shareLink) {
+	if link.MaxDownloads == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uses, ok := s.uses[link.ID]; ok && uses.Count > 0 {
+		uses.Count--
+		s.saveLocked()
+	}
+}
+
+func (s *shareStore) saveLocked() {
+	now := time.Now()
+	for id, uses := range s.uses {
+		if now.After(uses.Expires) {
+			delete(s.uses, id)
+		}
+	}
+
+	if len(s.statePath) == 0 {
+		return
+	}
+	if err := writeJsonFile(s.statePath, s.uses); err != nil {
+		log.Println("failed to save uses of share links", err)
+	}
+}
@@ -0,0 +1,130 @@
+package minioproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newShareTestApp(t *testing.T) *App {
+	app, err := New(Config{
+		ServerAddr:      ":4040",
+		BucketName:      "test",
+		EncKey:          genRandBytes(32),
+		HmacKey:         genRandBytes(32),
+		ShareKey:        genRandBytes(32),
+		Storage:         newMemoryStorage(),
+		UploadStatePath: t.TempDir(),
+		APIKeys:         []APIKey{{ID: "admin", Hash: hashKey("admin-key"), Scopes: []string{ScopeRead, ScopeWrite}}},
+	})
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+
+	for _, name := range []string{"report.pdf", "secret.pdf"} {
+		if w := authRequest(app, http.MethodPut, "/files/"+name, "admin-key", []byte(name+" content")); w.Code != http.StatusAccepted {
+			t.Fatal("upload failed", w.Code, w.Body)
+		}
+	}
+	return app
+}
+
+func createShareLink(t *testing.T, app *App, filename string, req shareRequest) string {
+	body, _ := json.Marshal(req)
+	w := authRequest(app, http.MethodPost, "/files/"+filename+"?share", "admin-key", body)
+	var resp shareResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusCreated || len(resp.URL) == 0 {
+		t.Fatal("can't create share link", w.Code, resp)
+	}
+	return resp.URL
+}
+
+func TestShareLinkDownloads(t *testing.T) {
+	app := newShareTestApp(t)
+	link := createShareLink(t, app, "report.pdf", shareRequest{MaxDownloads: 2, Filename: "Q3 report.pdf"})
+
+	for i := 0; i < 2; i++ {
+		w := authRequest(app, http.MethodGet, link, "", nil)
+		if w.Code != http.StatusOK || w.Body.String() != "report.pdf content" {
+			t.Fatal("expected link to work without credentials, got", w.Code, w.Body)
+		}
+		if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="Q3 report.pdf"` {
+			t.Error("unexpected Content-Disposition", disposition)
+		}
+	}
+	if w := authRequest(app, http.MethodGet, link, "", nil); w.Code != http.StatusGone {
+		t.Error("expected used up link to be rejected, got", w.Code)
+	}
+
+	if w := authRequest(app, http.MethodGet, "/files/report.pdf", "", nil); w.Code != http.StatusUnauthorized {
+		t.Error("expected downloads without link to need credentials, got", w.Code)
+	}
+}
+
+func TestShareLinkCountsSentFiles(t *testing.T) {
+	app := newShareTestApp(t)
+	link := createShareLink(t, app, "report.pdf", shareRequest{MaxDownloads: 1})
+	etag := authRequest(app, http.MethodHead, link, "", nil).Header().Get("ETag")
+
+	if w := conditionalRequest(app, http.MethodGet, link, "If-None-Match", etag, nil); w.Code != http.StatusNotModified {
+		t.Fatal("expected conditional download to be not modified, got", w.Code)
+	}
+
+	app.storage.Delete("test", "report.pdf", Precondition{})
+	if w := authRequest(app, http.MethodGet, link, "", nil); w.Code != http.StatusNotFound {
+		t.Fatal("expected missing file not to be found, got", w.Code)
+	}
+
+	authRequest(app, http.MethodPut, "/files/report.pdf", "admin-key", []byte("report.pdf content"))
+	if w := authRequest(app, http.MethodGet, link, "", nil); w.Code != http.StatusOK {
+		t.Error("expected responses without the file not to use up the link, got", w.Code)
+	}
+	if w := authRequest(app, http.MethodGet, link, "", nil); w.Code != http.StatusGone {
+		t.Error("expected download of the file to use up the link, got", w.Code)
+	}
+}
+
+func TestShareLinkTampering(t *testing.T) {
+	app := newShareTestApp(t)
+	link := createShareLink(t, app, "report.pdf", shareRequest{})
+
+	cases := map[string]string{
+		"other file":      strings.Replace(link, "report.pdf", "secret.pdf", 1),
+		"changed expiry":  strings.Replace(link, "expires=", "expires=9", 1),
+		"added downloads": link + "&downloads=100",
+	}
+	for name, tampered := range cases {
+		if w := authRequest(app, http.MethodGet, tampered, "", nil); w.Code != http.StatusForbidden {
+			t.Error("expected", name, "to be rejected, got", w.Code)
+		}
+	}
+	if w := authRequest(app, http.MethodDelete, link, "", nil); w.Code != http.StatusForbidden {
+		t.Error("expected link to only allow downloads, got", w.Code)
+	}
+
+	bound := createShareLink(t, app, "report.pdf", shareRequest{IP: "203.0.113.7"})
+	if w := authRequest(app, http.MethodGet, bound, "", nil); w.Code != http.StatusForbidden {
+		t.Error("expected link bound to another client to be rejected, got", w.Code)
+	}
+	// requests made by httptest come from 192.0.2.1
+	bound = createShareLink(t, app, "report.pdf", shareRequest{IP: "192.0.2.1"})
+	if w := authRequest(app, http.MethodGet, bound, "", nil); w.Code != http.StatusOK {
+		t.Error("expected link bound to the client to work, got", w.Code)
+	}
+}
+
+func TestShareLinkExpiry(t *testing.T) {
+	app := newShareTestApp(t)
+	expired := app.shares.URL(shareLink{ID: "x", Key: "report.pdf", Expires: time.Now().Add(-time.Second)})
+	if w := authRequest(app, http.MethodGet, expired, "", nil); w.Code != http.StatusGone {
+		t.Error("expected expired link to be rejected, got", w.Code)
+	}
+
+	body, _ := json.Marshal(shareRequest{ExpiresIn: int((8 * 24 * time.Hour).Seconds())})
+	if w := authRequest(app, http.MethodPost, "/files/report.pdf?share", "admin-key", body); w.Code != http.StatusBadRequest {
+		t.Error("expected too long expiry to be rejected, got", w.Code)
+	}
+}
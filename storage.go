@@ -0,0 +1,180 @@
+package minioproxy
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/josip/minioproxy/presign"
+)
+
+var errUploadNotFound = errors.New("upload not found")
+var errInvalidPart = errors.New("invalid part")
+var errInvalidRange = errors.New("invalid range")
+var errNotModified = errors.New("not modified")
+var errPreconditionFailed = errors.New("precondition failed")
+
+// Storage is a backend encrypted files are kept in. minioClient is the default
+// implementation, local filesystem and in-memory backends are useful for
+// development and tests.
+type Storage interface {
+	Get(bucket, key string) (*File, error)
+	// Returns length bytes of the file starting at offset, File.ContentLength
+	// is the length of the range. Fails with errPreconditionFailed if the file
+	// no longer has etag ifMatch, any version is returned when it's empty.
+	GetRange(bucket, key string, offset, length int64, ifMatch ETag) (*File, error)
+	// Same as Get but fails with errNotModified if the file still has the etag
+	GetIfNoneMatch(bucket, key string, etag ETag) (*File, error)
+	// Same as Get but File.Data is always nil
+	Head(bucket, key string) (*File, error)
+	// metadata is stored with the file and returned by Get and Head, names are
+	// lowercase. Fails with errPreconditionFailed when cond doesn't hold.
+	Put(bucket, key, contentType string, metadata map[string]string, cond Precondition, contentLength int64, input io.Reader) (ETag, error)
+	// Fails with errPreconditionFailed when cond doesn't hold
+	Delete(bucket, key string, cond Precondition) error
+	List(bucket, prefix string) ([]ObjectInfo, error)
+
+	InitiateMultipart(bucket, key, contentType string, metadata map[string]string) (string, error)
+	UploadPart(bucket, key, uploadID string, part int, size int64, input io.Reader) (ETag, error)
+	ListParts(bucket, key, uploadID string) ([]CompletedPart, error)
+	CompleteMultipart(bucket, key, uploadID string, parts []CompletedPart, cond Precondition) (ETag, error)
+	AbortMultipart(bucket, key, uploadID string) error
+}
+
+type File struct {
+	ContentType   string
+	ContentLength int64
+	ETag          ETag
+	LastModified  time.Time
+	// nil when the file has none
+	Metadata map[string]string
+
+	Data io.ReadCloser
+}
+
+// Version of the file a write expects to replace, the zero value allows any
+type Precondition struct {
+	// file has to have this etag
+	IfMatch ETag
+	// file must not exist
+	IfNoneMatch bool
+}
+
+// current is nil when the file doesn't exist
+func (cond Precondition) check(current *File) error {
+	if cond.IfNoneMatch && current != nil {
+		return errPreconditionFailed
+	}
+	if len(cond.IfMatch) > 0 && (current == nil || !current.ETag.Matches(cond.IfMatch)) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         ETag
+	LastModified time.Time
+	// nil when the file has none or storage doesn't list it
+	Metadata map[string]string
+}
+
+const (
+	StorageMinio  = "minio"
+	StorageFS     = "fs"
+	StorageMemory = "memory"
+)
+
+func newStorage(ctx context.Context, cfg Config, transport http.RoundTripper) (Storage, error) {
+	if cfg.Storage != nil {
+		return cfg.Storage, nil
+	}
+
+	switch cfg.StorageBackend {
+	case "", StorageMinio:
+		creds, err := newCredentialsProvider(ctx, cfg, &http.Client{Transport: transport})
+		if err != nil {
+			return nil, err
+		}
+		return newConfiguredMinioClient(cfg, cfg.Endpoint, cfg.Region, creds, transport), nil
+	case StorageFS:
+		return newFSStorage(cfg.StoragePath)
+	case StorageMemory:
+		return newMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
+
+func newReplicaStorages(cfg Config, transport http.RoundTripper) []Storage {
+	storages := make([]Storage, 0, len(cfg.Replicas))
+	for _, replica := range cfg.Replicas {
+		if replica.Storage != nil {
+			storages = append(storages, replica.Storage)
+		} else {
+			creds := staticCredentials{presign.Credentials{AccessKeyID: replica.AccessKey, AccessKeySecret: replica.SecretKey}}
+			storages = append(storages, newConfiguredMinioClient(cfg, replica.Endpoint, replica.Region, creds, transport))
+		}
+	}
+	return storages
+}
+
+// Region is detected from the buckets by startup checks when not set
+func newConfiguredMinioClient(cfg Config, endpoint, region string, creds presign.CredentialsProvider, transport http.RoundTripper) *minioClient {
+	client := newMinioClient(endpoint, "", "", transport)
+	client.signer.Provider = creds
+	client.signer.Region = region
+	client.signer.Addressing = cfg.Addressing
+	return client
+}
+
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func sortParts(parts []CompletedPart) {
+	slices.SortFunc(parts, func(a, b CompletedPart) int {
+		return cmp.Compare(a.PartNumber, b.PartNumber)
+	})
+}
+
+// ETags are compared without surrounding quotes as clients tend to drop them
+func (etag ETag) Matches(other ETag) bool {
+	return strings.Trim(string(etag), `"`) == strings.Trim(string(other), `"`)
+}
+
+// ETags are computed the same way S3 does it for non-encrypted objects
+func md5ETag(sum []byte) ETag {
+	return ETag(`"` + hex.EncodeToString(sum) + `"`)
+}
+
+func multipartETag(partSums [][]byte) ETag {
+	hash := md5.New()
+	for _, sum := range partSums {
+		hash.Write(sum)
+	}
+	return ETag(fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(hash.Sum(nil)), len(partSums)))
+}
+
+// Fails if the input had a different length than announced, same as minio
+// would reject such a request
+func checkLength(expected, actual int64) error {
+	if expected >= 0 && expected != actual {
+		return fmt.Errorf("expected %d bytes, got %d", expected, actual)
+	}
+	return nil
+}
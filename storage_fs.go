@@ -0,0 +1,461 @@
+package minioproxy
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Keeps files on the local filesystem using following layout:
+//
+//	{root}/{bucket}/objects/{key}        file contents
+//	{root}/{bucket}/meta/{key}.json      content type and etag
+//	{root}/{bucket}/uploads/{id}/        upload info and one file per part
+type fsStorage struct {
+	root string
+	// files are replaced one at a time, readers hold the read lock so they see
+	// metadata and content of the same version
+	mu sync.RWMutex
+}
+
+type fsMeta struct {
+	ContentType string
+	ETag        ETag
+	Metadata    map[string]string `json:",omitempty"`
+}
+
+type fsUpload struct {
+	Key         string
+	ContentType string
+	Metadata    map[string]string `json:",omitempty"`
+}
+
+func newFSStorage(root string) (*fsStorage, error) {
+	if len(root) == 0 {
+		return nil, errors.New("missing storage path")
+	}
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &fsStorage{root: root}, nil
+}
+
+// keys are cleaned as absolute paths so they can't escape the bucket
+func (s *fsStorage) path(bucket, kind, key string) string {
+	return filepath.Join(s.root, filepath.Base(bucket), kind, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s *fsStorage) Get(bucket, key string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, err := s.head(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.Open(s.path(bucket, "objects", key))
+	if err != nil {
+		return nil, fsError(err)
+	}
+	file.Data = data
+	return file, nil
+}
+
+func (s *fsStorage) GetIfNoneMatch(bucket, key string, etag ETag) (*File, error) {
+	file, err := s.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if file.ETag.Matches(etag) {
+		file.Data.Close()
+		return nil, errNotModified
+	}
+	return file, nil
+}
+
+func (s *fsStorage) GetRange(bucket, key string, offset, length int64, ifMatch ETag) (*File, error) {
+	file, err := s.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := (Precondition{IfMatch: ifMatch}).check(file); err != nil {
+		file.Data.Close()
+		return nil, err
+	}
+	if offset < 0 || length < 0 || offset+length > file.ContentLength {
+		file.Data.Close()
+		return nil, errInvalidRange
+	}
+
+	data := file.Data.(*os.File)
+	file.ContentLength = length
+	file.Data = struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(data, offset, length), data}
+	return file, nil
+}
+
+func (s *fsStorage) Head(bucket, key string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.head(bucket, key)
+}
+
+// must be called while holding the lock
+func (s *fsStorage) head(bucket, key string) (*File, error) {
+	stat, err := os.Stat(s.path(bucket, "objects", key))
+	if err != nil {
+		return nil, fsError(err)
+	}
+	if stat.IsDir() {
+		return nil, errFileNotFound
+	}
+
+	var meta fsMeta
+	if err := readJsonFile(s.path(bucket, "meta", key+".json"), &meta); err != nil {
+		return nil, fsError(err)
+	}
+
+	return &File{
+		ContentType:   meta.ContentType,
+		ContentLength: stat.Size(),
+		ETag:          meta.ETag,
+		LastModified:  stat.ModTime(),
+		Metadata:      meta.Metadata,
+	}, nil
+}
+
+func (s *fsStorage) Put(bucket, key, contentType string, metadata map[string]string, cond Precondition, contentLength int64, input io.Reader) (ETag, error) {
+	sum, size, tmpName, err := s.writeTemp(bucket, input)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpName)
+
+	if err := checkLength(contentLength, size); err != nil {
+		return "", err
+	}
+
+	etag := md5ETag(sum)
+	return etag, s.commit(bucket, key, tmpName, fsMeta{ContentType: contentType, ETag: etag, Metadata: metadata}, cond)
+}
+
+func (s *fsStorage) Delete(bucket, key string, cond Precondition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLocked(bucket, key, cond); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(bucket, "objects", key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	os.Remove(s.path(bucket, "meta", key+".json"))
+	return nil
+}
+
+func (s *fsStorage) List(bucket, prefix string) ([]ObjectInfo, error) {
+	objectsDir := s.path(bucket, "objects", "")
+	var infos []ObjectInfo
+
+	// WalkDir visits files in lexical order so the result is sorted
+	err := filepath.WalkDir(objectsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(objectsDir, p)
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		file, err := s.Head(bucket, key)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, ObjectInfo{
+			Key:          key,
+			Size:         file.ContentLength,
+			ETag:         file.ETag,
+			LastModified: file.LastModified,
+			Metadata:     file.Metadata,
+		})
+		return nil
+	})
+
+	return infos, err
+}
+
+func (s *fsStorage) InitiateMultipart(bucket, key, contentType string, metadata map[string]string) (string, error) {
+	uploadID, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	dir := s.path(bucket, "uploads", uploadID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	info := fsUpload{Key: key, ContentType: contentType, Metadata: metadata}
+	if err := writeJsonFile(filepath.Join(dir, "upload.json"), info); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+func (s *fsStorage) UploadPart(bucket, key, uploadID string, part int, size int64, input io.Reader) (ETag, error) {
+	if _, err := s.upload(bucket, key, uploadID); err != nil {
+		return "", err
+	}
+
+	sum, written, tmpName, err := s.writeTemp(bucket, input)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpName)
+
+	if err := checkLength(size, written); err != nil {
+		return "", err
+	}
+
+	partPath := filepath.Join(s.path(bucket, "uploads", uploadID), strconv.Itoa(part))
+	if err := os.Rename(tmpName, partPath); err != nil {
+		return "", err
+	}
+	return md5ETag(sum), nil
+}
+
+func (s *fsStorage) ListParts(bucket, key, uploadID string) ([]CompletedPart, error) {
+	if _, err := s.upload(bucket, key, uploadID); err != nil {
+		return nil, err
+	}
+
+	dir := s.path(bucket, "uploads", uploadID)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []CompletedPart
+	for _, entry := range entries {
+		partNumber, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		sum, size, err := md5File(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, CompletedPart{
+			PartNumber: partNumber,
+			ETag:       md5ETag(sum),
+			Size:       size,
+		})
+	}
+	sortParts(parts)
+
+	return parts, nil
+}
+
+func (s *fsStorage) CompleteMultipart(bucket, key, uploadID string, parts []CompletedPart, cond Precondition) (ETag, error) {
+	upload, err := s.upload(bucket, key, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	dir := s.path(bucket, "uploads", uploadID)
+	tmp, err := os.CreateTemp(filepath.Join(s.root, filepath.Base(bucket)), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var sums [][]byte
+	for _, part := range parts {
+		sum, err := appendPart(tmp, filepath.Join(dir, strconv.Itoa(part.PartNumber)))
+		if err != nil {
+			return "", errors.Join(fmt.Errorf("%w %d", errInvalidPart, part.PartNumber), err)
+		}
+		if !md5ETag(sum).Matches(part.ETag) {
+			return "", fmt.Errorf("%w %d", errInvalidPart, part.PartNumber)
+		}
+		sums = append(sums, sum)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	etag := multipartETag(sums)
+	if err := s.commit(bucket, key, tmp.Name(), fsMeta{ContentType: upload.ContentType, ETag: etag, Metadata: upload.Metadata}, cond); err != nil {
+		return "", err
+	}
+
+	return etag, os.RemoveAll(dir)
+}
+
+func (s *fsStorage) AbortMultipart(bucket, key, uploadID string) error {
+	if _, err := s.upload(bucket, key, uploadID); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.path(bucket, "uploads", uploadID))
+}
+
+func (s *fsStorage) upload(bucket, key, uploadID string) (*fsUpload, error) {
+	var upload fsUpload
+	err := readJsonFile(filepath.Join(s.path(bucket, "uploads", uploadID), "upload.json"), &upload)
+	if err != nil || upload.Key != key {
+		return nil, errUploadNotFound
+	}
+	return &upload, nil
+}
+
+// Writes input to a temporary file within the bucket so it can be later
+// atomically renamed to its final destination
+func (s *fsStorage) writeTemp(bucket string, input io.Reader) ([]byte, int64, string, error) {
+	dir := filepath.Join(s.root, filepath.Base(bucket))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, 0, "", err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer tmp.Close()
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), input)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, 0, "", err
+	}
+
+	return hash.Sum(nil), size, tmp.Name(), nil
+}
+
+func (s *fsStorage) commit(bucket, key, tmpName string, meta fsMeta, cond Precondition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLocked(bucket, key, cond); err != nil {
+		return err
+	}
+
+	objectPath := s.path(bucket, "objects", key)
+	metaPath := s.path(bucket, "meta", key+".json")
+	for _, p := range []string{objectPath, metaPath} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpName, objectPath); err != nil {
+		return err
+	}
+	return writeJsonFile(metaPath, meta)
+}
+
+func fsError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return errFileNotFound
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return errAccessForbidden
+	}
+	return err
+}
+
+func appendPart(dest io.Writer, partPath string) ([]byte, error) {
+	part, err := os.Open(partPath)
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(dest, hash), part); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func md5File(name string) ([]byte, int64, error) {
+	sum, err := appendPart(io.Discard, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sum, stat.Size(), nil
+}
+
+func readJsonFile(name string, v any) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Writes into a temporary file first so readers never see partial contents
+func writeJsonFile(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (s *fsStorage) checkLocked(bucket, key string, cond Precondition) error {
+	if cond == (Precondition{}) {
+		return nil
+	}
+	current, err := s.head(bucket, key)
+	if errors.Is(err, errFileNotFound) {
+		current = nil
+	} else if err != nil {
+		return err
+	}
+	return cond.check(current)
+}
@@ -0,0 +1,307 @@
+package minioproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	contentType  string
+	etag         ETag
+	lastModified time.Time
+	metadata     map[string]string
+	data         []byte
+}
+
+type memoryUpload struct {
+	bucket      string
+	key         string
+	contentType string
+	metadata    map[string]string
+	parts       map[int][]byte
+}
+
+// Keeps all files in memory, intended for tests and local development
+type memoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+	uploads map[string]*memoryUpload
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		objects: make(map[string]*memoryObject),
+		uploads: make(map[string]*memoryUpload),
+	}
+}
+
+func (s *memoryStorage) Get(bucket, key string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, exists := s.objects[bucket+"/"+key]
+	if !exists {
+		return nil, errFileNotFound
+	}
+
+	file := obj.file()
+	file.Data = io.NopCloser(bytes.NewReader(obj.data))
+	return file, nil
+}
+
+func (s *memoryStorage) GetIfNoneMatch(bucket, key string, etag ETag) (*File, error) {
+	s.mu.RLock()
+	obj, exists := s.objects[bucket+"/"+key]
+	s.mu.RUnlock()
+
+	if exists && obj.etag.Matches(etag) {
+		return nil, errNotModified
+	}
+	return s.Get(bucket, key)
+}
+
+func (s *memoryStorage) GetRange(bucket, key string, offset, length int64, ifMatch ETag) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, exists := s.objects[bucket+"/"+key]
+	if !exists {
+		return nil, errFileNotFound
+	}
+	if err := (Precondition{IfMatch: ifMatch}).check(obj.file()); err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 || offset+length > int64(len(obj.data)) {
+		return nil, errInvalidRange
+	}
+
+	file := obj.file()
+	file.ContentLength = length
+	file.Data = io.NopCloser(bytes.NewReader(obj.data[offset : offset+length]))
+	return file, nil
+}
+
+func (s *memoryStorage) Head(bucket, key string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, exists := s.objects[bucket+"/"+key]
+	if !exists {
+		return nil, errFileNotFound
+	}
+	return obj.file(), nil
+}
+
+func (s *memoryStorage) Put(bucket, key, contentType string, metadata map[string]string, cond Precondition, contentLength int64, input io.Reader) (ETag, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return "", err
+	}
+	if err := checkLength(contentLength, int64(len(data))); err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(data)
+	obj := &memoryObject{
+		contentType:  contentType,
+		etag:         md5ETag(sum[:]),
+		lastModified: time.Now(),
+		metadata:     maps.Clone(metadata),
+		data:         data,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLocked(bucket, key, cond); err != nil {
+		return "", err
+	}
+	s.objects[bucket+"/"+key] = obj
+	return obj.etag, nil
+}
+
+func (s *memoryStorage) Delete(bucket, key string, cond Precondition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLocked(bucket, key, cond); err != nil {
+		return err
+	}
+	delete(s.objects, bucket+"/"+key)
+	return nil
+}
+
+func (s *memoryStorage) List(bucket, prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var infos []ObjectInfo
+	for id, obj := range s.objects {
+		key, found := strings.CutPrefix(id, bucket+"/")
+		if !found || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		infos = append(infos, ObjectInfo{
+			Key:          key,
+			Size:         int64(len(obj.data)),
+			ETag:         obj.etag,
+			LastModified: obj.lastModified,
+			Metadata:     maps.Clone(obj.metadata),
+		})
+	}
+
+	slices.SortFunc(infos, func(a, b ObjectInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return infos, nil
+}
+
+func (s *memoryStorage) InitiateMultipart(bucket, key, contentType string, metadata map[string]string) (string, error) {
+	uploadID, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.uploads[uploadID] = &memoryUpload{
+		bucket:      bucket,
+		key:         key,
+		contentType: contentType,
+		metadata:    maps.Clone(metadata),
+		parts:       make(map[int][]byte),
+	}
+	s.mu.Unlock()
+
+	return uploadID, nil
+}
+
+func (s *memoryStorage) UploadPart(bucket, key, uploadID string, part int, size int64, input io.Reader) (ETag, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return "", err
+	}
+	if err := checkLength(size, int64(len(data))); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, err := s.upload(bucket, key, uploadID)
+	if err != nil {
+		return "", err
+	}
+	upload.parts[part] = data
+
+	sum := md5.Sum(data)
+	return md5ETag(sum[:]), nil
+}
+
+func (s *memoryStorage) ListParts(bucket, key, uploadID string) ([]CompletedPart, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	upload, err := s.upload(bucket, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]CompletedPart, 0, len(upload.parts))
+	for partNumber, data := range upload.parts {
+		sum := md5.Sum(data)
+		parts = append(parts, CompletedPart{
+			PartNumber: partNumber,
+			ETag:       md5ETag(sum[:]),
+			Size:       int64(len(data)),
+		})
+	}
+	sortParts(parts)
+
+	return parts, nil
+}
+
+func (s *memoryStorage) CompleteMultipart(bucket, key, uploadID string, parts []CompletedPart, cond Precondition) (ETag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, err := s.upload(bucket, key, uploadID)
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkLocked(bucket, key, cond); err != nil {
+		return "", err
+	}
+
+	var data []byte
+	var sums [][]byte
+	for _, part := range parts {
+		partData, exists := upload.parts[part.PartNumber]
+		if !exists {
+			return "", fmt.Errorf("%w %d", errInvalidPart, part.PartNumber)
+		}
+		sum := md5.Sum(partData)
+		if !md5ETag(sum[:]).Matches(part.ETag) {
+			return "", fmt.Errorf("%w %d", errInvalidPart, part.PartNumber)
+		}
+
+		data = append(data, partData...)
+		sums = append(sums, sum[:])
+	}
+
+	obj := &memoryObject{
+		contentType:  upload.contentType,
+		etag:         multipartETag(sums),
+		lastModified: time.Now(),
+		metadata:     upload.metadata,
+		data:         data,
+	}
+	s.objects[bucket+"/"+key] = obj
+	delete(s.uploads, uploadID)
+
+	return obj.etag, nil
+}
+
+func (s *memoryStorage) AbortMultipart(bucket, key, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.upload(bucket, key, uploadID); err != nil {
+		return err
+	}
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+// must be called while holding the lock
+func (s *memoryStorage) upload(bucket, key, uploadID string) (*memoryUpload, error) {
+	upload, exists := s.uploads[uploadID]
+	if !exists || upload.bucket != bucket || upload.key != key {
+		return nil, errUploadNotFound
+	}
+	return upload, nil
+}
+
+func (s *memoryStorage) checkLocked(bucket, key string, cond Precondition) error {
+	if obj, exists := s.objects[bucket+"/"+key]; exists {
+		return cond.check(obj.file())
+	}
+	return cond.check(nil)
+}
+
+func (obj *memoryObject) file() *File {
+	return &File{
+		ContentType:   obj.contentType,
+		ContentLength: int64(len(obj.data)),
+		ETag:          obj.etag,
+		LastModified:  obj.lastModified,
+		Metadata:      maps.Clone(obj.metadata),
+	}
+}
@@ -0,0 +1,654 @@
+package minioproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	ReplicationAsync = "async"
+	ReplicationSync  = "sync"
+)
+
+// how often pending writes are retried at most
+const maxReplicaRetryDelay = 5 * time.Minute
+
+// Writes to primary storage, and mirrors every change to replicas. In sync
+// mode uploads are written to replicas as they are streamed to the primary,
+// part by part for multipart uploads. Otherwise mirroring copies whatever the
+// primary has at the time, so a failed or outdated write can always be
+// repaired by running it again. Writes which failed to be mirrored are kept in
+// a queue and repaired until they succeed.
+//
+// Reads are served by replicas when the primary fails.
+type replicatedStorage struct {
+	Storage
+	replicas []Storage
+	sync     bool
+	// repair queue is persisted here when set
+	statePath string
+	// serializes writes of the queue, saved is queueVersion last written
+	saveMu sync.Mutex
+	saved  int
+	// copies files to replicas, large files as multipart uploads with parts
+	// of about chunkSize. With 0 only files too large for a single request
+	// are split.
+	uploader  *uploader
+	chunkSize int64
+
+	mu      sync.Mutex
+	pending map[string]*replicaOp
+	running map[string]bool
+	// one per replica
+	wake []chan struct{}
+	// multipart uploads mirrored in sync mode by upload id in primary
+	uploads map[string]*mirroredUpload
+	// incremented whenever keys are added to or removed from pending
+	queueVersion int
+
+	replicated int64
+	failed     int64
+	lastLag    time.Duration
+}
+
+// Multipart upload mirrored to replicas part by part. Uploads started before
+// a restart are completed in the primary only and then copied.
+type mirroredUpload struct {
+	// upload id in every replica, empty once mirroring to it failed
+	ids []string
+	// etags of parts in every replica
+	parts []map[int]ETag
+}
+
+// Key needs to be copied from primary to replica
+type replicaOp struct {
+	Replica int
+	Bucket  string
+	Key     string
+	// first change which hasn't been mirrored yet
+	Since       time.Time
+	Attempts    int
+	NextAttempt time.Time
+
+	// incremented on every change so changes made while mirroring aren't lost
+	version int
+}
+
+type replicationStats struct {
+	Mode       string `json:"mode"`
+	Replicas   int    `json:"replicas"`
+	Pending    int    `json:"pending"`
+	Replicated int64  `json:"replicated"`
+	Failed     int64  `json:"failed"`
+	// age of the oldest change not yet mirrored
+	LagSeconds float64 `json:"lagSeconds"`
+	// how long it took for the last mirrored change
+	LastLagSeconds float64 `json:"lastLagSeconds"`
+}
+
+func newReplicatedStorage(ctx context.Context, primary Storage, replicas []Storage, mode, statePath string, uploader *uploader, chunkSize int64) *replicatedStorage {
+	s := &replicatedStorage{
+		Storage:   primary,
+		replicas:  replicas,
+		sync:      mode == ReplicationSync,
+		statePath: statePath,
+		uploader:  uploader,
+		chunkSize: chunkSize,
+		pending:   make(map[string]*replicaOp),
+		running:   make(map[string]bool),
+		uploads:   make(map[string]*mirroredUpload),
+	}
+	s.load()
+
+	for i := range replicas {
+		s.wake = append(s.wake, make(chan struct{}, 1))
+		go s.work(ctx, i)
+	}
+	return s
+}
+
+func (s *replicatedStorage) Get(bucket, key string) (*File, error) {
+	return failover(s, func(storage Storage) (*File, error) {
+		return storage.Get(bucket, key)
+	})
+}
+
+func (s *replicatedStorage) GetIfNoneMatch(bucket, key string, etag ETag) (*File, error) {
+	return failover(s, func(storage Storage) (*File, error) {
+		return storage.GetIfNoneMatch(bucket, key, etag)
+	})
+}
+
+func (s *replicatedStorage) GetRange(bucket, key string, offset, length int64, ifMatch ETag) (*File, error) {
+	return failover(s, func(storage Storage) (*File, error) {
+		return storage.GetRange(bucket, key, offset, length, ifMatch)
+	})
+}
+
+func (s *replicatedStorage) Head(bucket, key string) (*File, error) {
+	return failover(s, func(storage Storage) (*File, error) {
+		return storage.Head(bucket, key)
+	})
+}
+
+func (s *replicatedStorage) List(bucket, prefix string) ([]ObjectInfo, error) {
+	return failover(s, func(storage Storage) ([]ObjectInfo, error) {
+		return storage.List(bucket, prefix)
+	})
+}
+
+func (s *replicatedStorage) Put(bucket, key, contentType string, metadata map[string]string, cond Precondition, contentLength int64, input io.Reader) (ETag, error) {
+	if !s.sync {
+		etag, err := s.Storage.Put(bucket, key, contentType, metadata, cond, contentLength, input)
+		if err == nil {
+			s.changed(bucket, key)
+		}
+		return etag, err
+	}
+
+	writes := make([]func(io.Reader) (ETag, error), len(s.replicas))
+	for i, replica := range s.replicas {
+		replica := replica
+		writes[i] = func(input io.Reader) (ETag, error) {
+			return replica.Put(bucket, key, contentType, metadata, Precondition{}, contentLength, input)
+		}
+	}
+	etag, err, results := teeWrite(input, func(input io.Reader) (ETag, error) {
+		return s.Storage.Put(bucket, key, contentType, metadata, cond, contentLength, input)
+	}, writes)
+	s.mirrored(bucket, key, err == nil, teeErrors(results))
+	return etag, err
+}
+
+func (s *replicatedStorage) Delete(bucket, key string, cond Precondition) error {
+	err := s.Storage.Delete(bucket, key, cond)
+	if err == nil {
+		s.changed(bucket, key)
+	}
+	return err
+}
+
+func (s *replicatedStorage) InitiateMultipart(bucket, key, contentType string, metadata map[string]string) (string, error) {
+	uploadID, err := s.Storage.InitiateMultipart(bucket, key, contentType, metadata)
+	if err != nil || !s.sync {
+		return uploadID, err
+	}
+
+	upload := &mirroredUpload{ids: make([]string, len(s.replicas)), parts: make([]map[int]ETag, len(s.replicas))}
+	for i, replica := range s.replicas {
+		upload.parts[i] = make(map[int]ETag)
+		if upload.ids[i], err = replica.InitiateMultipart(bucket, key, contentType, metadata); err != nil {
+			log.Printf("failed to mirror upload of %s to replica %d: %s\n", key, i, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.uploads[uploadID] = upload
+	s.mu.Unlock()
+	return uploadID, nil
+}
+
+func (s *replicatedStorage) UploadPart(bucket, key, uploadID string, part int, size int64, input io.Reader) (ETag, error) {
+	s.mu.Lock()
+	upload, mirrored := s.uploads[uploadID]
+	var ids []string
+	if mirrored {
+		ids = slices.Clone(upload.ids)
+	}
+	s.mu.Unlock()
+	if !mirrored {
+		return s.Storage.UploadPart(bucket, key, uploadID, part, size, input)
+	}
+
+	writes := make([]func(io.Reader) (ETag, error), len(s.replicas))
+	for i, replica := range s.replicas {
+		replica, id := replica, ids[i]
+		if len(id) > 0 {
+			writes[i] = func(input io.Reader) (ETag, error) {
+				return replica.UploadPart(bucket, key, id, part, size, input)
+			}
+		}
+	}
+	etag, err, results := teeWrite(input, func(input io.Reader) (ETag, error) {
+		return s.Storage.UploadPart(bucket, key, uploadID, part, size, input)
+	}, writes)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, result := range results {
+		switch {
+		case writes[i] == nil:
+		case result.err != nil:
+			// the file is copied to the replica once the upload is completed
+			log.Printf("failed to mirror part %d of %s to replica %d: %s\n", part, key, i, result.err)
+			go s.replicas[i].AbortMultipart(bucket, key, ids[i])
+			upload.ids[i] = ""
+		default:
+			upload.parts[i][part] = result.etag
+		}
+	}
+	return etag, err
+}
+
+func (s *replicatedStorage) CompleteMultipart(bucket, key, uploadID string, parts []CompletedPart, cond Precondition) (ETag, error) {
+	etag, err := s.Storage.CompleteMultipart(bucket, key, uploadID, parts, cond)
+	if err != nil {
+		return etag, err
+	}
+
+	s.mu.Lock()
+	upload, mirrored := s.uploads[uploadID]
+	delete(s.uploads, uploadID)
+	s.mu.Unlock()
+	if !mirrored {
+		s.changed(bucket, key)
+		return etag, nil
+	}
+
+	errs := make([]error, len(s.replicas))
+	for i, replica := range s.replicas {
+		errs[i] = s.completeMirror(replica, bucket, key, upload.ids[i], upload.parts[i], parts)
+	}
+	s.mirrored(bucket, key, true, errs)
+	return etag, nil
+}
+
+// Completes the upload in a replica with the same parts as in the primary
+func (s *replicatedStorage) completeMirror(replica Storage, bucket, key, id string, etags map[int]ETag, parts []CompletedPart) error {
+	if len(id) == 0 {
+		return errNotMirrored
+	}
+
+	mirroredParts := make([]CompletedPart, len(parts))
+	for i, part := range parts {
+		etag, exists := etags[part.PartNumber]
+		if !exists {
+			replica.AbortMultipart(bucket, key, id)
+			return fmt.Errorf("%w: part %d is missing", errNotMirrored, part.PartNumber)
+		}
+		mirroredParts[i] = CompletedPart{PartNumber: part.PartNumber, ETag: etag, Size: part.Size}
+	}
+
+	_, err := replica.CompleteMultipart(bucket, key, id, mirroredParts, Precondition{})
+	if err != nil {
+		replica.AbortMultipart(bucket, key, id)
+	}
+	return err
+}
+
+func (s *replicatedStorage) AbortMultipart(bucket, key, uploadID string) error {
+	s.mu.Lock()
+	upload, mirrored := s.uploads[uploadID]
+	delete(s.uploads, uploadID)
+	s.mu.Unlock()
+
+	if mirrored {
+		for i, id := range upload.ids {
+			if len(id) > 0 {
+				s.replicas[i].AbortMultipart(bucket, key, id)
+			}
+		}
+	}
+	return s.Storage.AbortMultipart(bucket, key, uploadID)
+}
+
+// Health of the primary followed by replicas
+func (s *replicatedStorage) Health() []backendHealth {
+	var health []backendHealth
+	for _, storage := range append([]Storage{s.Storage}, s.replicas...) {
+		if reporter, ok := storage.(healthReporter); ok {
+			health = append(health, reporter.Health()...)
+		}
+	}
+	return health
+}
+
+func (s *replicatedStorage) Stats() replicationStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := replicationStats{
+		Mode:           ReplicationAsync,
+		Replicas:       len(s.replicas),
+		Pending:        len(s.pending),
+		Replicated:     s.replicated,
+		Failed:         s.failed,
+		LastLagSeconds: s.lastLag.Seconds(),
+	}
+	if s.sync {
+		stats.Mode = ReplicationSync
+	}
+	for _, op := range s.pending {
+		stats.LagSeconds = max(stats.LagSeconds, time.Since(op.Since).Seconds())
+	}
+	return stats
+}
+
+// Queues key to be mirrored to all replicas, in sync mode it's mirrored
+// right away and only failed writes are left in the queue
+func (s *replicatedStorage) changed(bucket, key string) {
+	replicas := make([]int, len(s.replicas))
+	for i := range replicas {
+		replicas[i] = i
+	}
+	ids := s.queue(bucket, key, replicas)
+
+	if !s.sync {
+		for _, i := range replicas {
+			s.notify(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			s.replicate(id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// Records the outcome of writing to replicas together with the primary,
+// replicas which didn't end up with the same version as the primary are
+// queued to be repaired
+func (s *replicatedStorage) mirrored(bucket, key string, written bool, errs []error) {
+	var stale []int
+	for i, err := range errs {
+		// a replica could have been written even if the primary failed at the end
+		if (err == nil) != written {
+			stale = append(stale, i)
+		}
+		if err != nil && written && !errors.Is(err, errNotMirrored) {
+			log.Printf("failed to mirror %s to replica %d: %s\n", key, i, err)
+		}
+	}
+
+	ids := s.queue(bucket, key, stale)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !written {
+		// repaired right away
+		for _, i := range stale {
+			s.notify(i)
+		}
+		return
+	}
+	s.replicated += int64(len(errs) - len(stale))
+	s.failed += int64(len(stale))
+	for _, id := range ids {
+		op := s.pending[id]
+		op.Attempts = 1
+		op.NextAttempt = time.Now().Add(retryDelay(op.Attempts))
+	}
+}
+
+func (s *replicatedStorage) queue(bucket, key string, replicas []int) []string {
+	now := time.Now()
+	ids := make([]string, len(replicas))
+
+	s.mu.Lock()
+	for n, i := range replicas {
+		ids[n] = replicaOpID(i, bucket, key)
+		op, exists := s.pending[ids[n]]
+		if !exists {
+			op = &replicaOp{Replica: i, Bucket: bucket, Key: key, Since: now}
+			s.pending[ids[n]] = op
+			s.queueVersion++
+		}
+		op.version++
+		op.Attempts = 0
+		op.NextAttempt = now
+	}
+	s.mu.Unlock()
+
+	s.save()
+	return ids
+}
+
+func (s *replicatedStorage) notify(replica int) {
+	select {
+	case s.wake[replica] <- struct{}{}:
+	default:
+	}
+}
+
+// Mirrors queued changes of a replica, failed ones are retried with backoff
+func (s *replicatedStorage) work(ctx context.Context, replica int) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake[replica]:
+		case <-ticker.C:
+		}
+
+		for _, id := range s.due(replica) {
+			s.replicate(id)
+		}
+	}
+}
+
+func (s *replicatedStorage) due(replica int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var ids []string
+	for id, op := range s.pending {
+		if op.Replica == replica && !s.running[id] && !op.NextAttempt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (s *replicatedStorage) replicate(id string) {
+	s.mu.Lock()
+	op, exists := s.pending[id]
+	if !exists || s.running[id] {
+		// whoever is running it will see the new version and run it again
+		s.mu.Unlock()
+		return
+	}
+	s.running[id] = true
+	version := op.version
+	s.mu.Unlock()
+
+	err := s.copy(s.replicas[op.Replica], op.Bucket, op.Key)
+
+	s.mu.Lock()
+	delete(s.running, id)
+
+	if err != nil {
+		s.failed++
+		op.Attempts++
+		op.NextAttempt = time.Now().Add(retryDelay(op.Attempts))
+		log.Printf("failed to mirror %s to replica %d, attempt %d: %s\n", op.Key, op.Replica, op.Attempts, err)
+	} else if op.version == version {
+		s.replicated++
+		s.lastLag = time.Since(op.Since)
+		delete(s.pending, id)
+		s.queueVersion++
+	}
+	again := err == nil && op.version != version
+	s.mu.Unlock()
+
+	if again {
+		s.notify(op.Replica)
+	}
+	s.save()
+}
+
+// Makes replica have the same version of the key as primary
+func (s *replicatedStorage) copy(replica Storage, bucket, key string) error {
+	file, err := s.Storage.Get(bucket, key)
+	if errors.Is(err, errFileNotFound) {
+		return replica.Delete(bucket, key, Precondition{})
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Data.Close()
+
+	_, err = s.uploader.withStorage(replica).Upload(bucket, key, file.ContentType, file.Metadata, Precondition{}, file.ContentLength, s.chunkSize, file.Data)
+	return err
+}
+
+func (s *replicatedStorage) load() {
+	if len(s.statePath) == 0 {
+		return
+	}
+
+	var ops []*replicaOp
+	if err := readJsonFile(s.statePath, &ops); err != nil {
+		return
+	}
+	for _, op := range ops {
+		if op.Replica < len(s.replicas) {
+			s.pending[replicaOpID(op.Replica, op.Bucket, op.Key)] = op
+		}
+	}
+	log.Println("loaded", len(s.pending), "writes to mirror to replicas")
+}
+
+// Writes the queue when keys were added to or removed from it since it was
+// last written, outside of mu so writes to storage don't wait for the file.
+// Attempts aren't saved on their own, after a restart writes are just retried
+// sooner.
+func (s *replicatedStorage) save() {
+	if len(s.statePath) == 0 {
+		return
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	version := s.queueVersion
+	if version == s.saved {
+		s.mu.Unlock()
+		return
+	}
+	ops := make([]replicaOp, 0, len(s.pending))
+	for _, op := range s.pending {
+		ops = append(ops, *op)
+	}
+	s.mu.Unlock()
+
+	if err := writeJsonFile(s.statePath, ops); err != nil {
+		log.Println("failed to save replication queue", err)
+		return
+	}
+	s.saved = version
+}
+
+func replicaOpID(replica int, bucket, key string) string {
+	return fmt.Sprintf("%d/%s/%s", replica, bucket, key)
+}
+
+func retryDelay(attempts int) time.Duration {
+	return min(time.Second<<min(attempts, 16), maxReplicaRetryDelay)
+}
+
+// Storage failures are retried on replicas, errors which are about the file
+// itself are not
+func failover[T any](s *replicatedStorage, read func(Storage) (T, error)) (T, error) {
+	result, err := read(s.Storage)
+	for i := 0; i < len(s.replicas) && isStorageFailure(err); i++ {
+		log.Println("primary storage failed, reading from replica", i, err)
+		result, err = read(s.replicas[i])
+	}
+	return result, err
+}
+
+func isStorageFailure(err error) bool {
+	return err != nil &&
+		!errors.Is(err, errFileNotFound) &&
+		!errors.Is(err, errAccessForbidden) &&
+		!errors.Is(err, errNotModified) &&
+		!errors.Is(err, errPreconditionFailed) &&
+		!errors.Is(err, errInvalidRange)
+}
+
+var errNotMirrored = errors.New("write wasn't mirrored")
+
+type teeResult struct {
+	etag ETag
+	err  error
+}
+
+// Writes input to primary and to every replica at the same time, replicas
+// which fail are left behind without failing the others. nil replica writes
+// are skipped and fail with errNotMirrored. Replicas fail if the primary does.
+func teeWrite(input io.Reader, primary func(io.Reader) (ETag, error), replicas []func(io.Reader) (ETag, error)) (ETag, error, []teeResult) {
+	results := make([]teeResult, len(replicas))
+	pipes := make([]*io.PipeWriter, len(replicas))
+	var wg sync.WaitGroup
+	for i, write := range replicas {
+		if write == nil {
+			results[i].err = errNotMirrored
+			continue
+		}
+
+		r, w := io.Pipe()
+		pipes[i] = w
+		wg.Add(1)
+		go func(i int, write func(io.Reader) (ETag, error), r *io.PipeReader) {
+			defer wg.Done()
+			etag, err := write(r)
+			// unblocks the primary if the replica stopped reading early
+			r.CloseWithError(errNotMirrored)
+			results[i] = teeResult{etag: etag, err: err}
+		}(i, write, r)
+	}
+
+	etag, err := primary(io.TeeReader(input, fanoutWriter(pipes)))
+	for _, w := range pipes {
+		if w == nil {
+			continue
+		}
+		if err != nil {
+			w.CloseWithError(err)
+		} else {
+			w.Close()
+		}
+	}
+	wg.Wait()
+	return etag, err, results
+}
+
+func teeErrors(results []teeResult) []error {
+	errs := make([]error, len(results))
+	for i, result := range results {
+		errs[i] = result.err
+	}
+	return errs
+}
+
+// Writes to all pipes, the ones which fail are dropped
+type fanoutWriter []*io.PipeWriter
+
+func (f fanoutWriter) Write(p []byte) (int, error) {
+	for i, w := range f {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			w.CloseWithError(err)
+			f[i] = nil
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,257 @@
+package minioproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+var errStorageDown = errors.New("storage is down")
+
+// memory storage which can be switched off
+type unreliableStorage struct {
+	*memoryStorage
+	down atomic.Bool
+	gets atomic.Int32
+}
+
+func (s *unreliableStorage) Get(bucket, key string) (*File, error) {
+	s.gets.Add(1)
+	if s.down.Load() {
+		return nil, errStorageDown
+	}
+	return s.memoryStorage.Get(bucket, key)
+}
+
+func (s *unreliableStorage) UploadPart(bucket, key, uploadID string, part int, size int64, input io.Reader) (ETag, error) {
+	if s.down.Load() {
+		return "", errStorageDown
+	}
+	return s.memoryStorage.UploadPart(bucket, key, uploadID, part, size, input)
+}
+
+func (s *unreliableStorage) Put(bucket, key, contentType string, metadata map[string]string, cond Precondition, contentLength int64, input io.Reader) (ETag, error) {
+	if s.down.Load() {
+		return "", errStorageDown
+	}
+	return s.memoryStorage.Put(bucket, key, contentType, metadata, cond, contentLength, input)
+}
+
+func (s *unreliableStorage) Delete(bucket, key string, cond Precondition) error {
+	if s.down.Load() {
+		return errStorageDown
+	}
+	return s.memoryStorage.Delete(bucket, key, cond)
+}
+
+func newReplicatedTestStorage(t *testing.T, mode string) (*replicatedStorage, *unreliableStorage, *unreliableStorage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	primary := &unreliableStorage{memoryStorage: newMemoryStorage()}
+	replica := &unreliableStorage{memoryStorage: newMemoryStorage()}
+	storage := newReplicatedStorage(ctx, primary, []Storage{replica}, mode, "", newUploader(primary, 2, 64*1024*1024), 0)
+	return storage, primary, replica
+}
+
+func TestSyncReplication(t *testing.T) {
+	storage, primary, replica := newReplicatedTestStorage(t, ReplicationSync)
+	content := []byte("mirrored")
+
+	if _, err := storage.Put("test", "a", "text/plain", nil, Precondition{}, int64(len(content)), bytes.NewReader(content)); err != nil {
+		t.Fatal("put failed", err)
+	}
+	if file, err := replica.memoryStorage.Get("test", "a"); err != nil || file.ContentType != "text/plain" {
+		t.Error("expected file to be mirrored, got", err)
+	}
+
+	// reads fail over to the replica
+	primary.down.Store(true)
+	file, err := storage.Get("test", "a")
+	if err != nil {
+		t.Fatal("expected to read from replica, got", err)
+	}
+	if data, _ := io.ReadAll(file.Data); !bytes.Equal(data, content) {
+		t.Error("expected replica to have same contents")
+	}
+	primary.down.Store(false)
+
+	storage.Delete("test", "a", Precondition{})
+	if _, err := replica.memoryStorage.Get("test", "a"); !errors.Is(err, errFileNotFound) {
+		t.Error("expected delete to be mirrored, got", err)
+	}
+}
+
+func TestReplicationRepair(t *testing.T) {
+	storage, _, replica := newReplicatedTestStorage(t, ReplicationSync)
+	replica.down.Store(true)
+
+	content := []byte("queued")
+	if _, err := storage.Put("test", "a", "", nil, Precondition{}, int64(len(content)), bytes.NewReader(content)); err != nil {
+		t.Fatal("failed mirror should not fail the write", err)
+	}
+	if stats := storage.Stats(); stats.Pending != 1 || stats.Failed != 1 {
+		t.Fatal("expected failed write to be queued, got", stats)
+	}
+
+	replica.down.Store(false)
+	storage.replicate(replicaOpID(0, "test", "a"))
+	if stats := storage.Stats(); stats.Pending != 0 || stats.Replicated != 1 {
+		t.Error("expected queued write to be repaired, got", stats)
+	}
+	if _, err := replica.memoryStorage.Get("test", "a"); err != nil {
+		t.Error("expected file to be mirrored, got", err)
+	}
+}
+
+func TestReplicationQueueIsSaved(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	statePath := filepath.Join(t.TempDir(), "replication.json")
+	primary := newMemoryStorage()
+	replica := &unreliableStorage{memoryStorage: newMemoryStorage()}
+	replica.down.Store(true)
+	newStorage := func() *replicatedStorage {
+		return newReplicatedStorage(ctx, primary, []Storage{replica}, ReplicationSync, statePath, newUploader(primary, 2, 64*1024*1024), 0)
+	}
+
+	storage := newStorage()
+	if _, err := storage.Put("test", "a", "", nil, Precondition{}, 1, bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatal("put failed", err)
+	}
+	if stats := newStorage().Stats(); stats.Pending != 1 {
+		t.Fatal("expected queued write to be loaded after a restart, got", stats)
+	}
+
+	os.Remove(statePath)
+	storage.replicate(replicaOpID(0, "test", "a"))
+	if _, err := os.Stat(statePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("expected failed attempts not to rewrite the queue, got", err)
+	}
+
+	replica.down.Store(false)
+	storage.replicate(replicaOpID(0, "test", "a"))
+	var ops []replicaOp
+	if err := readJsonFile(statePath, &ops); err != nil || len(ops) != 0 {
+		t.Error("expected repaired write to be removed from the saved queue, got", ops, err)
+	}
+}
+
+func uploadTestParts(t *testing.T, storage Storage, key string, parts ...[]byte) {
+	uploadID, err := storage.InitiateMultipart("test", key, "", nil)
+	if err != nil {
+		t.Fatal("initiate failed", err)
+	}
+	var completed []CompletedPart
+	for i, data := range parts {
+		etag, err := storage.UploadPart("test", key, uploadID, i+1, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal("part upload failed", err)
+		}
+		completed = append(completed, CompletedPart{PartNumber: i + 1, ETag: etag, Size: int64(len(data))})
+	}
+	if _, err := storage.CompleteMultipart("test", key, uploadID, completed, Precondition{}); err != nil {
+		t.Fatal("complete failed", err)
+	}
+}
+
+func TestSyncReplicationTeesUploads(t *testing.T) {
+	storage, primary, replica := newReplicatedTestStorage(t, ReplicationSync)
+
+	content := []byte("streamed")
+	if _, err := storage.Put("test", "a", "", nil, Precondition{}, int64(len(content)), bytes.NewReader(content)); err != nil {
+		t.Fatal("put failed", err)
+	}
+	uploadTestParts(t, storage, "b", []byte("first "), []byte("second"))
+
+	for key, expected := range map[string]string{"a": "streamed", "b": "first second"} {
+		file, err := replica.memoryStorage.Get("test", key)
+		if err != nil {
+			t.Fatal("expected", key, "to be mirrored, got", err)
+		}
+		if data, _ := io.ReadAll(file.Data); string(data) != expected {
+			t.Error("unexpected content of", key, string(data))
+		}
+	}
+	if gets := primary.gets.Load(); gets != 0 {
+		t.Error("expected uploads to be mirrored without reading them from the primary, got", gets, "reads")
+	}
+	if stats := storage.Stats(); stats.Pending != 0 || stats.Replicated != 2 {
+		t.Error("unexpected stats", stats)
+	}
+	if len(replica.uploads) != 0 {
+		t.Error("expected mirrored upload to be completed")
+	}
+}
+
+func TestSyncReplicationRepairsFailedParts(t *testing.T) {
+	storage, _, replica := newReplicatedTestStorage(t, ReplicationSync)
+
+	uploadID, _ := storage.InitiateMultipart("test", "a", "", nil)
+	etag1, _ := storage.UploadPart("test", "a", uploadID, 1, 5, bytes.NewReader([]byte("hello")))
+	replica.down.Store(true)
+	etag2, err := storage.UploadPart("test", "a", uploadID, 2, 6, bytes.NewReader([]byte(" world")))
+	if err != nil {
+		t.Fatal("failed mirror should not fail the part", err)
+	}
+	parts := []CompletedPart{{PartNumber: 1, ETag: etag1, Size: 5}, {PartNumber: 2, ETag: etag2, Size: 6}}
+	if _, err := storage.CompleteMultipart("test", "a", uploadID, parts, Precondition{}); err != nil {
+		t.Fatal("complete failed", err)
+	}
+	if stats := storage.Stats(); stats.Pending != 1 {
+		t.Fatal("expected replica to be queued for repair, got", stats)
+	}
+
+	replica.down.Store(false)
+	storage.replicate(replicaOpID(0, "test", "a"))
+	file, err := replica.memoryStorage.Get("test", "a")
+	if err != nil {
+		t.Fatal("expected file to be repaired, got", err)
+	}
+	if data, _ := io.ReadAll(file.Data); string(data) != "hello world" {
+		t.Error("unexpected content", string(data))
+	}
+}
+
+// refuses files larger than a part in a single request
+type partLimitedStorage struct {
+	*memoryStorage
+	parts atomic.Int32
+}
+
+func (s *partLimitedStorage) Put(bucket, key, contentType string, metadata map[string]string, cond Precondition, contentLength int64, input io.Reader) (ETag, error) {
+	if contentLength > minPartSize {
+		return "", errors.New("entity too large")
+	}
+	return s.memoryStorage.Put(bucket, key, contentType, metadata, cond, contentLength, input)
+}
+
+func (s *partLimitedStorage) UploadPart(bucket, key, uploadID string, part int, size int64, input io.Reader) (ETag, error) {
+	s.parts.Add(1)
+	return s.memoryStorage.UploadPart(bucket, key, uploadID, part, size, input)
+}
+
+func TestReplicationCopiesLargeFilesInParts(t *testing.T) {
+	storage, primary, _ := newReplicatedTestStorage(t, ReplicationAsync)
+	storage.chunkSize = minPartSize
+	replica := &partLimitedStorage{memoryStorage: newMemoryStorage()}
+
+	content := genRandBytes(minChunkedFileSize + 1)
+	primary.memoryStorage.Put("test", "big", "", nil, Precondition{}, int64(len(content)), bytes.NewReader(content))
+	if err := storage.copy(replica, "test", "big"); err != nil {
+		t.Fatal("copy failed", err)
+	}
+	if parts := replica.parts.Load(); parts < 2 {
+		t.Error("expected large file to be copied in parts, got", parts)
+	}
+	file, _ := replica.memoryStorage.Get("test", "big")
+	if data, _ := io.ReadAll(file.Data); !bytes.Equal(data, content) {
+		t.Error("expected copy to have same content")
+	}
+}
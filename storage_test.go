@@ -0,0 +1,184 @@
+package minioproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testStorages(t *testing.T) map[string]Storage {
+	fs, err := newFSStorage(t.TempDir())
+	if err != nil {
+		t.Fatal("can't create fs storage", err)
+	}
+
+	return map[string]Storage{
+		StorageMemory: newMemoryStorage(),
+		StorageFS:     fs,
+	}
+}
+
+func TestStoragePutGetDelete(t *testing.T) {
+	for name, s := range testStorages(t) {
+		data := []byte("hello world")
+		etag, err := s.Put("bucket", "dir/hello.txt", "text/plain", nil, Precondition{}, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(name, "put failed:", err)
+		}
+
+		file, err := s.Get("bucket", "dir/hello.txt")
+		if err != nil {
+			t.Fatal(name, "get failed:", err)
+		}
+		downloaded, _ := io.ReadAll(file.Data)
+		file.Data.Close()
+		if !bytes.Equal(data, downloaded) || file.ETag != etag || file.ContentType != "text/plain" {
+			t.Error(name, "downloaded file doesn't match uploaded one", file)
+		}
+
+		infos, err := s.List("bucket", "dir/")
+		if err != nil || len(infos) != 1 || infos[0].Key != "dir/hello.txt" {
+			t.Error(name, "expected to list uploaded file, got", infos, err)
+		}
+
+		if err := s.Delete("bucket", "dir/hello.txt", Precondition{}); err != nil {
+			t.Error(name, "delete failed:", err)
+		}
+		if _, err := s.Head("bucket", "dir/hello.txt"); !errors.Is(err, errFileNotFound) {
+			t.Error(name, "expected file to be deleted, got", err)
+		}
+	}
+}
+
+func TestStorageRejectsShortInput(t *testing.T) {
+	for name, s := range testStorages(t) {
+		if _, err := s.Put("bucket", "short.txt", "text/plain", nil, Precondition{}, 100, bytes.NewReader([]byte("hello"))); err == nil {
+			t.Error(name, "expected put with wrong content length to fail")
+		}
+		if _, err := s.Head("bucket", "short.txt"); !errors.Is(err, errFileNotFound) {
+			t.Error(name, "expected failed put not to create a file, got", err)
+		}
+	}
+}
+
+func TestStorageMultipart(t *testing.T) {
+	for name, s := range testStorages(t) {
+		uploadID, err := s.InitiateMultipart("bucket", "parts.dat", "application/octet-stream", nil)
+		if err != nil {
+			t.Fatal(name, "initiate failed:", err)
+		}
+
+		data := genRandBytes(300)
+		var parts []CompletedPart
+		// parts are uploaded out of order
+		for _, i := range []int{2, 0, 1} {
+			partData := data[i*100 : (i+1)*100]
+			etag, err := s.UploadPart("bucket", "parts.dat", uploadID, i+1, 100, bytes.NewReader(partData))
+			if err != nil {
+				t.Fatal(name, "upload part failed:", err)
+			}
+			parts = append(parts, CompletedPart{PartNumber: i + 1, ETag: etag})
+		}
+
+		listed, err := s.ListParts("bucket", "parts.dat", uploadID)
+		if err != nil || len(listed) != 3 || listed[0].PartNumber != 1 || listed[2].Size != 100 {
+			t.Error(name, "unexpected parts listed", listed, err)
+		}
+
+		sortParts(parts)
+		if _, err := s.CompleteMultipart("bucket", "parts.dat", uploadID, parts, Precondition{}); err != nil {
+			t.Fatal(name, "complete failed:", err)
+		}
+
+		file, err := s.Get("bucket", "parts.dat")
+		if err != nil {
+			t.Fatal(name, "get failed:", err)
+		}
+		downloaded, _ := io.ReadAll(file.Data)
+		file.Data.Close()
+		if !bytes.Equal(data, downloaded) {
+			t.Error(name, "expected parts to be joined in order")
+		}
+
+		if _, err := s.ListParts("bucket", "parts.dat", uploadID); !errors.Is(err, errUploadNotFound) {
+			t.Error(name, "expected upload to be gone after completion, got", err)
+		}
+	}
+}
+
+func TestStorageAbortMultipart(t *testing.T) {
+	for name, s := range testStorages(t) {
+		uploadID, _ := s.InitiateMultipart("bucket", "aborted.dat", "application/octet-stream", nil)
+		s.UploadPart("bucket", "aborted.dat", uploadID, 1, 5, bytes.NewReader([]byte("hello")))
+
+		if err := s.AbortMultipart("bucket", "aborted.dat", uploadID); err != nil {
+			t.Error(name, "abort failed:", err)
+		}
+		if _, err := s.UploadPart("bucket", "aborted.dat", uploadID, 2, 5, bytes.NewReader([]byte("world"))); !errors.Is(err, errUploadNotFound) {
+			t.Error(name, "expected upload to be gone after abort, got", err)
+		}
+	}
+}
+
+func TestStorageMetadata(t *testing.T) {
+	for name, s := range testStorages(t) {
+		metadata := map[string]string{"proxy-meta": "sealed"}
+		data := []byte("hello world")
+		if _, err := s.Put("bucket", "meta.txt", "text/plain", metadata, Precondition{}, int64(len(data)), bytes.NewReader(data)); err != nil {
+			t.Fatal(name, "put failed:", err)
+		}
+		if file, err := s.Head("bucket", "meta.txt"); err != nil || file.Metadata["proxy-meta"] != "sealed" {
+			t.Error(name, "expected metadata to be stored, got", file, err)
+		}
+		if infos, err := s.List("bucket", "meta"); err != nil || len(infos) != 1 || infos[0].Metadata["proxy-meta"] != "sealed" {
+			t.Error(name, "expected metadata to be listed, got", infos, err)
+		}
+
+		uploadID, _ := s.InitiateMultipart("bucket", "parts.txt", "text/plain", metadata)
+		etag, _ := s.UploadPart("bucket", "parts.txt", uploadID, 1, int64(len(data)), bytes.NewReader(data))
+		if _, err := s.CompleteMultipart("bucket", "parts.txt", uploadID, []CompletedPart{{PartNumber: 1, ETag: etag}}, Precondition{}); err != nil {
+			t.Fatal(name, "complete failed:", err)
+		}
+		if file, err := s.Head("bucket", "parts.txt"); err != nil || file.Metadata["proxy-meta"] != "sealed" {
+			t.Error(name, "expected metadata of multipart upload to be stored, got", file, err)
+		}
+	}
+}
+
+func TestFSStorageConsistentReads(t *testing.T) {
+	s, err := newFSStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("bucket", "a.txt", "text/plain", nil, Precondition{}, 3, bytes.NewReader([]byte("old")))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			data := []byte(strings.Repeat("x", i%7+1))
+			s.Put("bucket", "a.txt", "text/plain", nil, Precondition{}, int64(len(data)), bytes.NewReader(data))
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		file, err := s.Get("bucket", "a.txt")
+		if err != nil {
+			t.Fatal("get failed:", err)
+		}
+		data, _ := io.ReadAll(file.Data)
+		file.Data.Close()
+		sum := md5.Sum(data)
+		if !md5ETag(sum[:]).Matches(file.ETag) {
+			t.Fatal("read content of another version than its etag", file.ETag, string(data))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package minioproxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var errNoTenant = errors.New("clients need a tenant once tenants are used")
+
+// Where files of a tenant are kept. Tenants which are not configured keep
+// their files in BucketName under a prefix named after them.
+type TenantConfig struct {
+	ID string `json:"id"`
+	// defaults to BucketName
+	Bucket string `json:"bucket,omitempty"`
+	// prepended to names of files, defaults to "{ID}/" unless Bucket is set
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func validateTenantID(id string) error {
+	if !tenantIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid tenant id %q", id)
+	}
+	return nil
+}
+
+// Bucket and prefix files of the tenant are kept in
+func (t TenantConfig) location(defaultBucket string) (string, string) {
+	switch {
+	case len(t.Bucket) > 0:
+		return t.Bucket, t.Prefix
+	case len(t.Prefix) > 0:
+		return defaultBucket, t.Prefix
+	}
+	return defaultBucket, t.ID + "/"
+}
+
+// Tenants can't share a bucket unless their prefixes keep them apart. Tenants
+// which aren't configured can use any id, so prefixes in the default bucket
+// can't overlap "{ID}/" of any of them.
+func validateTenantLocations(tenants []TenantConfig, defaultBucket string) []error {
+	var errs []error
+	for i, a := range tenants {
+		bucketA, prefixA := a.location(defaultBucket)
+		for _, b := range tenants[i+1:] {
+			bucketB, prefixB := b.location(defaultBucket)
+			if bucketA == bucketB && (strings.HasPrefix(prefixA, prefixB) || strings.HasPrefix(prefixB, prefixA)) {
+				errs = append(errs, fmt.Errorf("files of tenants %q and %q overlap", a.ID, b.ID))
+			}
+		}
+		if bucketA == defaultBucket && len(prefixA) == 0 {
+			errs = append(errs, fmt.Errorf("tenant %q needs a prefix to use the default bucket", a.ID))
+		} else if bucketA == defaultBucket && overlapsTenantPrefixes(a.ID, prefixA) {
+			errs = append(errs, fmt.Errorf("prefix of tenant %q overlaps prefixes of tenants which aren't configured", a.ID))
+		}
+	}
+	return errs
+}
+
+// Prefixes of tenants which aren't configured are a valid id and a slash.
+// Prefixes with a valid id before the first slash overlap them, and so do
+// ones without a slash which could be the start of an id. Prefixes under
+// "{ID}/" of the tenant itself don't, its id is configured.
+func overlapsTenantPrefixes(id, prefix string) bool {
+	if strings.HasPrefix(prefix, id+"/") {
+		return false
+	}
+	segment, _, _ := strings.Cut(prefix, "/")
+	return validateTenantID(segment) == nil
+}
+
+// Names of written files can't reach outside the prefix of the tenant
+func validateFilename(filename string) error {
+	if len(filename) == 0 || filename == "." || filename == ".." || strings.Contains(filename, "/") {
+		return fmt.Errorf("invalid filename %q", filename)
+	}
+	return nil
+}
+
+func loadTenants(cfg Config) ([]TenantConfig, error) {
+	if len(cfg.TenantsFile) == 0 {
+		return cfg.Tenants, nil
+	}
+
+	data, err := os.ReadFile(cfg.TenantsFile)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []TenantConfig
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %w", cfg.TenantsFile, err)
+	}
+	for _, tenant := range tenants {
+		if err := validateTenantID(tenant.ID); err != nil {
+			return nil, err
+		}
+	}
+	tenants = append(append([]TenantConfig{}, cfg.Tenants...), tenants...)
+	if errs := validateTenantLocations(tenants, cfg.BucketName); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return tenants, nil
+}
+
+// Master keys tenant keys are derived from
+type keyring struct {
+	encKey  []byte
+	hmacKey []byte
+}
+
+// Keys of tenants are derived with HKDF so files of one tenant can't be
+// decrypted with keys of another. Requests without a tenant use the master
+// keys.
+func (k keyring) forTenant(tenant string) (encKey, hmacKey []byte) {
+	if len(tenant) == 0 {
+		return k.encKey, k.hmacKey
+	}
+	return deriveKey(k.encKey, "enc", tenant), deriveKey(k.hmacKey, "hmac", tenant)
+}
+
+func deriveKey(master []byte, purpose, tenant string) []byte {
+	key := make([]byte, len(master))
+	io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("minio-proxy "+purpose+" "+tenant)), key)
+	return key
+}
+
+// Files of the tenant a request is made for
+type tenant struct {
+	id      string
+	bucket  string
+	prefix  string
+	encKey  []byte
+	hmacKey []byte
+}
+
+// Name of the file in storage
+func (t *tenant) key(filename string) string {
+	return t.prefix + filename
+}
+
+func (app *App) tenant(r *http.Request) *tenant {
+	var id string
+	if p := requestPrincipal(r); p != nil {
+		id = p.tenant
+	}
+
+	t := &tenant{id: id, bucket: app.bucketName}
+	if len(id) > 0 {
+		cfg, ok := app.tenants[id]
+		if !ok {
+			cfg = TenantConfig{ID: id}
+		}
+		t.bucket, t.prefix = cfg.location(app.bucketName)
+	}
+	t.encKey, t.hmacKey = app.keys.forTenant(id)
+	return t
+}
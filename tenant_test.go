@@ -0,0 +1,170 @@
+package minioproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	storage := newMemoryStorage()
+	scopes := []string{ScopeRead, ScopeWrite, ScopeDelete, ScopeList}
+	cfg := Config{
+		ServerAddr:      ":4040",
+		BucketName:      "test",
+		EncKey:          genRandBytes(32),
+		HmacKey:         genRandBytes(32),
+		Storage:         storage,
+		ShareKey:        genRandBytes(32),
+		UploadStatePath: t.TempDir(),
+		APIKeys: []APIKey{
+			{ID: "acme-app", Hash: hashKey("acme-key"), Scopes: scopes, Tenant: "acme"},
+			{ID: "globex-app", Hash: hashKey("globex-key"), Scopes: scopes, Tenant: "globex"},
+			{ID: "admin", Hash: hashKey("admin-key"), Scopes: scopes},
+		},
+		Tenants: []TenantConfig{{ID: "globex", Bucket: "globex-files"}},
+	}
+	// a client without a tenant would see files of all tenants in the bucket
+	if _, err := New(cfg); !errors.Is(err, errNoTenant) {
+		t.Fatal("expected keys without a tenant to be refused, got", err)
+	}
+	cfg.APIKeys = cfg.APIKeys[:2]
+	app, err := New(cfg)
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+
+	if w := authRequest(app, http.MethodPut, "/files/report.txt", "acme-key", []byte("acme report")); w.Code != http.StatusAccepted {
+		t.Fatal("upload failed", w.Code, w.Body)
+	}
+	if w := authRequest(app, http.MethodPut, "/files/report.txt", "globex-key", []byte("globex report")); w.Code != http.StatusAccepted {
+		t.Fatal("upload failed", w.Code, w.Body)
+	}
+
+	if _, err := storage.Head("test", "acme/report.txt"); err != nil {
+		t.Error("expected tenant file to be stored under its prefix", err)
+	}
+	if _, err := storage.Head("globex-files", "report.txt"); err != nil {
+		t.Error("expected tenant file to be stored in its bucket", err)
+	}
+
+	w := authRequest(app, http.MethodGet, "/files/report.txt", "acme-key", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "acme report" {
+		t.Error("expected tenant to read its own file, got", w.Code, w.Body)
+	}
+
+	var files []fileInfo
+	json.NewDecoder(authRequest(app, http.MethodGet, "/files", "acme-key", nil).Body).Decode(&files)
+	if len(files) != 1 || files[0].ID != "report.txt" {
+		t.Error("expected tenant to list its files without prefix, got", files)
+	}
+
+	// links issued without a tenant don't work once tenants are used
+	link := app.shares.URL(shareLink{ID: "old", Key: "report.txt", Expires: time.Now().Add(time.Hour)})
+	if w := authRequest(app, http.MethodGet, link, "", nil); w.Code != http.StatusForbidden {
+		t.Error("expected link without a tenant to be refused, got", w.Code)
+	}
+
+	// copying a file to another tenant doesn't make it readable there
+	stored, _ := storage.Get("test", "acme/report.txt")
+	encrypted, _ := io.ReadAll(stored.Data)
+	storage.Put("globex-files", "copied.txt", "text/plain", nil, Precondition{}, int64(len(encrypted)), bytes.NewReader(encrypted))
+	if w := authRequest(app, http.MethodGet, "/files/copied.txt", "globex-key", nil); w.Code == http.StatusOK {
+		t.Error("expected file of another tenant not to decrypt")
+	}
+}
+
+func TestTenantPrefixCollision(t *testing.T) {
+	scopes := []string{ScopeRead, ScopeWrite, ScopeList}
+	cfg := Config{
+		ServerAddr: ":4040",
+		BucketName: "test",
+		EncKey:     genRandBytes(32),
+		HmacKey:    genRandBytes(32),
+		Storage:    newMemoryStorage(),
+		APIKeys: []APIKey{
+			// "b" isn't configured, its files are under "b/"
+			{ID: "b-app", Hash: hashKey("b-key"), Scopes: scopes, Tenant: "b"},
+			{ID: "avatars-app", Hash: hashKey("avatars-key"), Scopes: scopes, Tenant: "avatars"},
+		},
+		Tenants: []TenantConfig{{ID: "avatars", Prefix: "b/"}},
+	}
+	if _, err := New(cfg); err == nil {
+		t.Fatal("expected prefix overlapping a tenant which isn't configured to be refused")
+	}
+
+	cfg.Tenants = []TenantConfig{{ID: "avatars", Prefix: "_b/"}}
+	app, err := New(cfg)
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+	authRequest(app, http.MethodPut, "/files/a.png", "avatars-key", []byte("avatar"))
+	if w := authRequest(app, http.MethodGet, "/files", "b-key", nil); strings.Contains(w.Body.String(), "a.png") {
+		t.Error("expected files of configured tenant not to be listed for another tenant, got", w.Body)
+	}
+	authRequest(app, http.MethodPut, "/files/a.png", "b-key", []byte("other"))
+	if w := authRequest(app, http.MethodGet, "/files/a.png", "avatars-key", nil); w.Body.String() != "avatar" {
+		t.Error("expected file of configured tenant not to be replaced by another tenant, got", w.Code, w.Body)
+	}
+}
+
+func TestTenantLocations(t *testing.T) {
+	cases := []struct {
+		tenants []TenantConfig
+		valid   bool
+	}{
+		{[]TenantConfig{{ID: "acme"}, {ID: "globex", Prefix: "_customers/globex/"}}, true},
+		{[]TenantConfig{{ID: "globex", Prefix: "globex/files/"}}, true},
+		{[]TenantConfig{{ID: "globex", Prefix: "customers/globex/"}}, false},
+		{[]TenantConfig{{ID: "globex", Prefix: "glob"}}, false},
+		{[]TenantConfig{{ID: "acme", Bucket: "shared", Prefix: "acme/"}, {ID: "globex", Bucket: "shared", Prefix: "globex/"}}, true},
+		{[]TenantConfig{{ID: "acme", Bucket: "acme-files"}, {ID: "globex", Bucket: "globex-files"}}, true},
+		{[]TenantConfig{{ID: "acme"}, {ID: "globex", Prefix: "acme/globex/"}}, false},
+		{[]TenantConfig{{ID: "acme", Prefix: "_a"}, {ID: "globex", Prefix: "_ab/"}}, false},
+		{[]TenantConfig{{ID: "acme", Bucket: "shared"}, {ID: "globex", Bucket: "shared", Prefix: "globex/"}}, false},
+		{[]TenantConfig{{ID: "acme", Bucket: "test"}}, false},
+	}
+	for _, c := range cases {
+		if errs := validateTenantLocations(c.tenants, "test"); (len(errs) == 0) != c.valid {
+			t.Error("expected", c.tenants, "valid", c.valid, "got", errs)
+		}
+	}
+}
+
+func TestFilenameValidation(t *testing.T) {
+	app, _ := newTestApp(t)
+	for _, filename := range []string{"..", "a/b", "../acme/report.txt"} {
+		if w := doRequest(app, http.MethodPost, "/files?prefix="+url.QueryEscape(filename), []byte("x")); w.Code != http.StatusBadRequest {
+			t.Error("expected prefix", filename, "to be refused, got", w.Code)
+		}
+		if err := validateFilename(filename); err == nil {
+			t.Error("expected", filename, "to be invalid")
+		}
+	}
+	if w := doRequest(app, http.MethodPut, "/files/..%2Fsecret", []byte("x")); w.Code == http.StatusAccepted {
+		t.Error("expected escaped / to be refused")
+	}
+}
+
+func TestTenantKeyDerivation(t *testing.T) {
+	keys := keyring{encKey: genRandBytes(32), hmacKey: genRandBytes(32)}
+
+	encA, hmacA := keys.forTenant("a")
+	encA2, _ := keys.forTenant("a")
+	encB, hmacB := keys.forTenant("b")
+	if !bytes.Equal(encA, encA2) {
+		t.Error("expected keys to be derived the same way every time")
+	}
+	if bytes.Equal(encA, encB) || bytes.Equal(hmacA, hmacB) || bytes.Equal(encA, keys.encKey) || bytes.Equal(encA, hmacA) {
+		t.Error("expected every tenant to get different keys")
+	}
+	if enc, hmac := keys.forTenant(""); !bytes.Equal(enc, keys.encKey) || !bytes.Equal(hmac, keys.hmacKey) {
+		t.Error("expected master keys without a tenant")
+	}
+}
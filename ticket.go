@@ -0,0 +1,141 @@
+package minioproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTicketExpiry = 15 * time.Minute
+	maxTicketExpiry     = 24 * time.Hour
+)
+
+var errTicketInvalid = errors.New("invalid upload ticket")
+var errTicketUsed = errors.New("upload ticket has already been used")
+var errTicketContentType = errors.New("content type is not allowed by upload ticket")
+var errTicketTooLarge = fmt.Errorf("%w for upload ticket", errFileTooLarge)
+
+// Allows a single upload without other credentials, signed by the proxy
+type uploadTicket struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant,omitempty"`
+	// client which asked for the ticket, policies are checked as if it uploaded
+	// the file
+	Issuer string `json:"issuer,omitempty"`
+	// file to upload, or prefix the name of the file has to start with
+	Key    string `json:"key,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	// bytes of cleartext, 0 for no limit
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// media types, or type/* wildcards, any type when empty
+	ContentTypes []string `json:"contentTypes,omitempty"`
+	Expires      int64    `json:"expires"`
+}
+
+// Ticket is its JSON and signature, base64 encoded and joined with a dot
+func (s *shareStore) Ticket(ticket uploadTicket) string {
+	payload, _ := json.Marshal(ticket)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.ticketSignature(encoded))
+}
+
+func (s *shareStore) ticketSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("ticket\n" + payload))
+	return mac.Sum(nil)
+}
+
+// Checks the ticket was made by the proxy and hasn't expired
+func (s *shareStore) VerifyTicket(token string) (*uploadTicket, error) {
+	payload, encodedSignature, _ := strings.Cut(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, s.ticketSignature(payload)) {
+		return nil, errTicketInvalid
+	}
+
+	var ticket uploadTicket
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &ticket) != nil {
+		return nil, errTicketInvalid
+	}
+
+	if time.Now().After(time.Unix(ticket.Expires, 0)) {
+		return nil, fmt.Errorf("%w: expired", errTicketInvalid)
+	}
+	return &ticket, nil
+}
+
+// Tickets can be used once, uploads which fail after they started need a new one
+func (s *shareStore) UseTicket(ticket *uploadTicket) error {
+	if err := s.use(ticket.ID, time.Unix(ticket.Expires, 0), 1); err != nil {
+		return errTicketUsed
+	}
+	return nil
+}
+
+func (t *uploadTicket) allowsFile(filename string) bool {
+	if len(t.Key) > 0 {
+		return filename == t.Key
+	}
+	return strings.HasPrefix(filename, t.Prefix)
+}
+
+func (t *uploadTicket) allowsContentType(contentType string) bool {
+	if len(t.ContentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range t.ContentTypes {
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails reads once more than MaxSize bytes have been read, for bodies without
+// a Content-Length
+type ticketLimitReader struct {
+	input     io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (t *uploadTicket) limit(input io.Reader) *ticketLimitReader {
+	return &ticketLimitReader{input: input, remaining: t.MaxSize}
+}
+
+func (r *ticketLimitReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		// one more byte tells if there's more data than allowed
+		var probe [1]byte
+		n, err := r.input.Read(probe[:])
+		if n > 0 {
+			r.exceeded = true
+			return 0, errTicketTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.input.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package minioproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createUploadTicket(t *testing.T, app *App, req ticketRequest) ticketResponse {
+	body, _ := json.Marshal(req)
+	w := authRequest(app, http.MethodPost, "/tickets", "admin-key", body)
+	var resp ticketResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusCreated || len(resp.Ticket) == 0 {
+		t.Fatal("can't create upload ticket", w.Code, resp)
+	}
+	return resp
+}
+
+func ticketUpload(app *App, url, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, url, body)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadTicket(t *testing.T) {
+	app := newShareTestApp(t)
+	ticket := createUploadTicket(t, app, ticketRequest{Key: "avatar.png", MaxSize: 100, ContentTypes: []string{"image/*"}})
+
+	if w := ticketUpload(app, ticket.URL, "text/html", strings.NewReader("<script>")); w.Code != http.StatusUnsupportedMediaType {
+		t.Error("expected content type not allowed by ticket to be rejected, got", w.Code)
+	}
+	if w := ticketUpload(app, strings.Replace(ticket.URL, "avatar.png", "other.png", 1), "image/png", strings.NewReader("png")); w.Code != http.StatusForbidden {
+		t.Error("expected ticket not to allow uploads of other files, got", w.Code)
+	}
+
+	if w := ticketUpload(app, ticket.URL, "image/png", strings.NewReader("png")); w.Code != http.StatusAccepted {
+		t.Fatal("expected upload with ticket to work, got", w.Code, w.Body)
+	}
+	if w := authRequest(app, http.MethodGet, "/files/avatar.png", "admin-key", nil); w.Body.String() != "png" {
+		t.Error("unexpected content of uploaded file", w.Body)
+	}
+	if w := ticketUpload(app, ticket.URL, "image/png", strings.NewReader("png")); w.Code != http.StatusGone {
+		t.Error("expected ticket to work once, got", w.Code)
+	}
+
+	if w := authRequest(app, http.MethodGet, ticket.URL, "", nil); w.Code != http.StatusForbidden {
+		t.Error("expected ticket not to allow downloads, got", w.Code)
+	}
+}
+
+func TestUploadTicketLimits(t *testing.T) {
+	app := newShareTestApp(t)
+
+	ticket := createUploadTicket(t, app, ticketRequest{Prefix: "avatars-", MaxSize: 4})
+	if w := ticketUpload(app, "/files/avatars-1?ticket="+ticket.Ticket, "image/png", strings.NewReader("too large")); w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("expected upload larger than Content-Length allowed by ticket to be rejected, got", w.Code)
+	}
+
+	// without Content-Length the size is checked while streaming
+	ticket = createUploadTicket(t, app, ticketRequest{Prefix: "avatars-", MaxSize: 4})
+	if w := ticketUpload(app, "/files/avatars-2?ticket="+ticket.Ticket, "image/png", io.MultiReader(strings.NewReader("too large"))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("expected streamed upload larger than allowed by ticket to be rejected, got", w.Code)
+	}
+	if w := authRequest(app, http.MethodGet, "/files/avatars-2", "admin-key", nil); w.Code != http.StatusNotFound {
+		t.Error("expected rejected upload not to be stored, got", w.Code)
+	}
+
+	expired := app.shares.Ticket(uploadTicket{ID: "x", Key: "avatar.png", Expires: time.Now().Add(-time.Second).Unix()})
+	if w := ticketUpload(app, "/files/avatar.png?ticket="+expired, "image/png", strings.NewReader("png")); w.Code != http.StatusForbidden {
+		t.Error("expected expired ticket to be rejected, got", w.Code)
+	}
+	tampered := strings.Replace(ticket.Ticket, ".", "x.", 1)
+	if w := ticketUpload(app, "/files/avatars-3?ticket="+tampered, "image/png", strings.NewReader("png")); w.Code != http.StatusForbidden {
+		t.Error("expected tampered ticket to be rejected, got", w.Code)
+	}
+
+	body, _ := json.Marshal(ticketRequest{Key: "a", Prefix: "b"})
+	if w := authRequest(app, http.MethodPost, "/tickets", "admin-key", body); w.Code != http.StatusBadRequest {
+		t.Error("expected ticket with key and prefix to be rejected, got", w.Code)
+	}
+}
+
+func TestUploadTicketForm(t *testing.T) {
+	app := newShareTestApp(t)
+	ticket := createUploadTicket(t, app, ticketRequest{Prefix: "photo-", MaxSize: 10})
+
+	upload := func(files map[string]string) int {
+		body, contentType := formBody(t, files)
+		r := httptest.NewRequest(http.MethodPost, "/files?ticket="+ticket.Ticket, body)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		app.router.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := upload(map[string]string{"other.jpg": "jpg"}); code != http.StatusForbidden {
+		t.Error("expected files outside of the prefix to be rejected, got", code)
+	}
+	if code := upload(map[string]string{"photo-1.jpg": "a bit too large"}); code != http.StatusRequestEntityTooLarge {
+		t.Error("expected file larger than allowed to be rejected, got", code)
+	}
+
+	// size limit of the ticket can't be multiplied with more files
+	ticket = createUploadTicket(t, app, ticketRequest{Prefix: "photo-", MaxSize: 10})
+	if code := upload(map[string]string{"photo-1.jpg": "jpg", "photo-2.jpg": "jpg"}); code != http.StatusBadRequest {
+		t.Error("expected form with more files to be rejected, got", code)
+	}
+
+	ticket = createUploadTicket(t, app, ticketRequest{Prefix: "photo-", MaxSize: 10})
+	if code := upload(map[string]string{"photo-1.jpg": "jpg"}); code != http.StatusAccepted {
+		t.Fatal("expected form upload with ticket to work, got", code)
+	}
+	if code := upload(map[string]string{"photo-3.jpg": "jpg"}); code != http.StatusGone {
+		t.Error("expected ticket to work for a single form, got", code)
+	}
+}
@@ -0,0 +1,135 @@
+package minioproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	defaultTLSTimeout  = 10 * time.Second
+	// time to wait for MinIO to start responding, body can take longer
+	defaultResponseTimeout = 30 * time.Second
+	defaultIdleConnTimeout = 90 * time.Second
+	defaultMaxIdleConns    = 100
+)
+
+// Settings of connections to MinIO, zero values use defaults
+type TransportConfig struct {
+	// PEM encoded certificates to trust in addition to system ones
+	CAFile string
+	// PEM encoded certificate and key presented to MinIO (mTLS)
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// idle connections kept open across all endpoints and per endpoint
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// 0 for no limit
+	MaxConnsPerHost int
+	IdleConnTimeout time.Duration
+
+	DialTimeout     time.Duration
+	TLSTimeout      time.Duration
+	ResponseTimeout time.Duration
+
+	// HTTP proxy to connect through, uses HTTP_PROXY and HTTPS_PROXY
+	// environment variables when empty
+	Proxy string
+}
+
+func newTransport(cfg TransportConfig) (*http.Transport, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if len(cfg.Proxy) > 0 {
+		proxyUrl, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		proxy = http.ProxyURL(proxyUrl)
+	}
+
+	maxIdleConns := withDefault(cfg.MaxIdleConns, defaultMaxIdleConns)
+	dialer := &net.Dialer{
+		Timeout:   withDefault(cfg.DialTimeout, defaultDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   withDefault(cfg.MaxIdleConnsPerHost, maxIdleConns),
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       withDefault(cfg.IdleConnTimeout, defaultIdleConnTimeout),
+		TLSHandshakeTimeout:   withDefault(cfg.TLSTimeout, defaultTLSTimeout),
+		ResponseHeaderTimeout: withDefault(cfg.ResponseTimeout, defaultResponseTimeout),
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+func (cfg *TransportConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(cfg.CAFile) > 0 {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(cfg.ClientCertFile) > 0 || len(cfg.ClientKeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (cfg *TransportConfig) validate() []error {
+	var errs []error
+	if (len(cfg.ClientCertFile) > 0) != (len(cfg.ClientKeyFile) > 0) {
+		errs = append(errs, errors.New("both ClientCertFile and ClientKeyFile are needed for client certificates"))
+	}
+	if len(cfg.Proxy) > 0 {
+		if _, err := url.Parse(cfg.Proxy); err != nil {
+			errs = append(errs, errors.New("transport proxy is not a valid url"))
+		}
+	}
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConnsPerHost < 0 || cfg.MaxConnsPerHost < 0 {
+		errs = append(errs, errors.New("transport connection limits can't be negative"))
+	}
+	return errs
+}
+
+func withDefault[T int | time.Duration](value, fallback T) T {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
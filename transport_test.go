@@ -0,0 +1,99 @@
+package minioproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePem(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newClientCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writePem(t, "client.crt", "CERTIFICATE", cert), writePem(t, "client.key", "EC PRIVATE KEY", keyDer)
+}
+
+func TestTransportCustomCAAndClientCert(t *testing.T) {
+	minio := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	minio.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	minio.StartTLS()
+	defer minio.Close()
+
+	caFile := writePem(t, "ca.crt", "CERTIFICATE", minio.Certificate().Raw)
+	certFile, keyFile := newClientCert(t)
+
+	// server certificate is not trusted by default
+	client := newMinioClient(minio.URL, "key", "secret", nil)
+	if _, err := client.Head("test", "file"); err == nil || err == errFileNotFound {
+		t.Error("expected unknown CA to be rejected, got", err)
+	}
+
+	transport, err := newTransport(TransportConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = newMinioClient(minio.URL, "key", "secret", transport)
+	if _, err := client.Head("test", "file"); err != errAccessForbidden {
+		t.Error("expected request without client certificate to be refused, got", err)
+	}
+
+	transport, err = newTransport(TransportConfig{CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = newMinioClient(minio.URL, "key", "secret", transport)
+	if _, err := client.Head("test", "file"); err != errFileNotFound {
+		t.Error("expected request with client certificate to go through, got", err)
+	}
+}
+
+func TestTransportConfigValidation(t *testing.T) {
+	cfg := TransportConfig{ClientCertFile: "client.crt"}
+	if errs := cfg.validate(); len(errs) != 1 {
+		t.Error("expected missing client key to be invalid, got", errs)
+	}
+
+	if _, err := newTransport(TransportConfig{CAFile: "missing.crt"}); err == nil {
+		t.Error("expected missing CA file to fail")
+	}
+}
@@ -0,0 +1,462 @@
+package minioproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTusOffsetMismatch = errors.New("upload offset does not match")
+var errTusLocked = errors.New("upload is being written to")
+
+// State of a resumable upload, persisted after every change so uploads can
+// continue after a restart. Cleartext is encrypted as it's received, exactly
+// as encryptStream would do it, and staged on disk until there is enough of it
+// for a multipart upload part.
+type tusUpload struct {
+	ID     string
+	Bucket string
+	Key    string
+	// keys of the tenant are used to encrypt the file
+	Tenant      string
+	ContentType string
+	// checked by storage when the upload is completed
+	Precondition Precondition
+	// size of cleartext
+	Length int64
+	// cleartext received so far
+	Offset int64
+
+	UploadID string
+	PartSize int64
+	Parts    []CompletedPart
+	// encrypted bytes in the staging file not yet uploaded as a part
+	Staged int64
+
+	IV       []byte
+	MacState []byte
+	// digests of cleartext received so far, sealed into the file after the
+	// content, nil for uploads created without a digest trailer
+	Digests *resumableDigestState
+}
+
+type tusStore struct {
+	dir     string
+	storage Storage
+	keys    keyring
+
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func newTusStore(dir string, storage Storage, keys keyring) (*tusStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &tusStore{
+		dir:     dir,
+		storage: storage,
+		keys:    keys,
+		locked:  make(map[string]bool),
+	}, nil
+}
+
+func (s *tusStore) statePath(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".json")
+}
+
+func (s *tusStore) stagingPath(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".staged")
+}
+
+// Metadata is sealed by the caller and has to have fileMeta.DigestTrailer set
+func (s *tusStore) Create(bucket, key, tenant, contentType string, metadata map[string]string, cond Precondition, length, chunkSize int64) (*tusUpload, error) {
+	encryptedLength := length + int64(ENC_META_SIZE) + digestTrailerSize
+	// parts are staged on disk, not in memory
+	partSize, err := partSizeFor(encryptedLength, chunkSize, maxPartSize)
+	if err != nil {
+		return nil, err
+	}
+	if partSize == 0 {
+		// small files are uploaded as a single part
+		partSize = max(encryptedLength, 1)
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+	iv, err := genIv()
+	if err != nil {
+		return nil, err
+	}
+	_, hmacKey := s.keys.forTenant(tenant)
+	mac := newResumableMac(hmacKey)
+	mac.Write(iv)
+	macState, err := mac.State()
+	if err != nil {
+		return nil, err
+	}
+	digests, err := newResumableDigests().State()
+	if err != nil {
+		return nil, err
+	}
+
+	uploadID, err := s.storage.InitiateMultipart(bucket, key, contentType, metadata)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to initiate upload"), err)
+	}
+
+	upload := &tusUpload{
+		ID:           id,
+		Bucket:       bucket,
+		Key:          key,
+		Tenant:       tenant,
+		ContentType:  contentType,
+		Precondition: cond,
+		Length:       length,
+		UploadID:     uploadID,
+		PartSize:     partSize,
+		IV:           iv,
+		MacState:     macState,
+		Digests:      digests,
+	}
+
+	// IV is the first thing in the encrypted file
+	if err := os.WriteFile(s.stagingPath(id), iv, 0o600); err != nil {
+		return nil, err
+	}
+	upload.Staged = int64(len(iv))
+
+	if err := s.save(upload); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (s *tusStore) Get(id string) (*tusUpload, error) {
+	var upload tusUpload
+	if err := readJsonFile(s.statePath(id), &upload); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errUploadNotFound
+		}
+		return nil, err
+	}
+
+	return &upload, nil
+}
+
+// Encrypts and stages data received from the client. Data is processed until
+// input fails or ends, whatever has been received is kept so the client can
+// resume from the returned offset.
+func (s *tusStore) Write(id string, offset int64, input io.Reader) (*tusUpload, error) {
+	if !s.lock(id) {
+		return nil, errTusLocked
+	}
+	defer s.unlock(id)
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Offset != offset {
+		return upload, errTusOffsetMismatch
+	}
+
+	staging, err := s.openStaging(upload)
+	if err != nil {
+		return upload, err
+	}
+	defer staging.Close()
+
+	encKey, hmacKey := s.keys.forTenant(upload.Tenant)
+	ctr, err := newCTRAt(encKey, upload.IV, upload.Offset)
+	if err != nil {
+		return upload, err
+	}
+	mac, err := restoreResumableMac(hmacKey, upload.MacState)
+	if err != nil {
+		return upload, err
+	}
+	digests, err := s.restoreDigests(upload)
+	if err != nil {
+		return upload, err
+	}
+
+	buf := make([]byte, ENC_BUFFER_SIZE)
+	var readErr error
+	for upload.Offset < upload.Length && readErr == nil {
+		// reads never cross part boundaries so the staging file holds at most one part
+		limit := min(int64(len(buf)), upload.PartSize-upload.Staged, upload.Length-upload.Offset)
+		var n int
+		n, readErr = input.Read(buf[:limit])
+
+		if digests != nil {
+			digests.Write(buf[:n])
+		}
+		ctr.XORKeyStream(buf[:n], buf[:n])
+		mac.Write(buf[:n])
+		if _, err := staging.Write(buf[:n]); err != nil {
+			return upload, err
+		}
+		upload.Offset += int64(n)
+		upload.Staged += int64(n)
+
+		if upload.Staged == upload.PartSize {
+			if err := s.flushPart(upload, staging, mac, digests); err != nil {
+				return upload, err
+			}
+		}
+	}
+	if readErr != nil && readErr != io.EOF {
+		log.Println("tus upload", id, "interrupted at", upload.Offset, readErr)
+	}
+
+	if upload.Offset == upload.Length {
+		return upload, s.finish(upload, staging, mac, digests)
+	}
+
+	return upload, s.saveState(upload, mac, digests)
+}
+
+// Completes an upload which has received all of its data, for retrying a
+// completion which failed at the end of Write. Uploads still missing data are
+// returned as they are.
+func (s *tusStore) Complete(id string) (*tusUpload, error) {
+	upload, err := s.Get(id)
+	if err != nil || upload.Offset < upload.Length {
+		return upload, err
+	}
+
+	if !s.lock(id) {
+		return nil, errTusLocked
+	}
+	defer s.unlock(id)
+	// state could have changed before it was locked
+	upload, err = s.Get(id)
+	if err != nil {
+		return upload, err
+	}
+
+	staging, err := s.openStaging(upload)
+	if err != nil {
+		return upload, err
+	}
+	defer staging.Close()
+
+	_, hmacKey := s.keys.forTenant(upload.Tenant)
+	mac, err := restoreResumableMac(hmacKey, upload.MacState)
+	if err != nil {
+		return upload, err
+	}
+	digests, err := s.restoreDigests(upload)
+	if err != nil {
+		return upload, err
+	}
+	return upload, s.finish(upload, staging, mac, digests)
+}
+
+// Checks uploads left from before a restart against storage, uploads which
+// can't be resumed are removed
+func (s *tusStore) Recover() {
+	states, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	for _, state := range states {
+		upload, err := s.Get(strings.TrimSuffix(filepath.Base(state), ".json"))
+		if err != nil {
+			log.Println("can't read tus upload state", state, err)
+			continue
+		}
+
+		resumable, err := partsInStorage(s.storage, upload.Bucket, upload.Key, upload.UploadID, upload.Parts)
+		if err != nil && !errors.Is(err, errUploadNotFound) {
+			log.Println("can't check tus upload", upload.ID, err)
+			continue
+		}
+		if resumable {
+			log.Println("tus upload", upload.ID, "of", upload.Key, "can be resumed at", upload.Offset)
+			continue
+		}
+
+		log.Println("tus upload", upload.ID, "of", upload.Key, "is missing parts in storage, removing")
+		s.storage.AbortMultipart(upload.Bucket, upload.Key, upload.UploadID)
+		s.remove(upload.ID)
+	}
+}
+
+// Terminates uploads which haven't received data for maxAge
+func (s *tusStore) Expire(maxAge time.Duration) {
+	states, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	for _, state := range states {
+		if info, err := os.Stat(state); err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+
+		id := strings.TrimSuffix(filepath.Base(state), ".json")
+		if err := s.Terminate(id); err != nil {
+			if !errors.Is(err, errTusLocked) && !errors.Is(err, errUploadNotFound) {
+				log.Println("failed to terminate expired tus upload", id, err)
+			}
+			continue
+		}
+		log.Println("tus upload", id, "expired")
+	}
+}
+
+func (s *tusStore) Terminate(id string) error {
+	if !s.lock(id) {
+		return errTusLocked
+	}
+	defer s.unlock(id)
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.storage.AbortMultipart(upload.Bucket, upload.Key, upload.UploadID); err != nil && !errors.Is(err, errUploadNotFound) {
+		return err
+	}
+	return s.remove(id)
+}
+
+// Appends the digest trailer and HMAC sum to the last part and completes the
+// multipart upload. Can be retried if it fails, the tail is the same every
+// time and parts of it which have already been stored are not written again.
+func (s *tusStore) finish(upload *tusUpload, staging *os.File, mac *resumableMac, digests *resumableDigests) error {
+	tail, err := s.tail(upload, mac, digests)
+	if err != nil {
+		return err
+	}
+	written := upload.Staged
+	for _, part := range upload.Parts {
+		written += part.Size
+	}
+	tail = tail[written-upload.Length-int64(IV_SIZE):]
+
+	// tail could be split between two parts if the last part is almost full
+	for len(tail) > 0 || upload.Staged > 0 {
+		n := min(int64(len(tail)), upload.PartSize-upload.Staged)
+		if _, err := staging.Write(tail[:n]); err != nil {
+			return err
+		}
+		upload.Staged += n
+		tail = tail[n:]
+
+		if err := s.flushPart(upload, staging, mac, digests); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.storage.CompleteMultipart(upload.Bucket, upload.Key, upload.UploadID, upload.Parts, upload.Precondition)
+	if err != nil {
+		return err
+	}
+
+	log.Println("tus upload", upload.ID, "of", upload.Key, "completed")
+	return s.remove(upload.ID)
+}
+
+func (s *tusStore) tail(upload *tusUpload, mac *resumableMac, digests *resumableDigests) ([]byte, error) {
+	encKey, _ := s.keys.forTenant(upload.Tenant)
+	return resumableTail(encKey, upload.IV, upload.Length, mac, digests)
+}
+
+// Uploads staged data as the next part, staging file is truncated afterwards
+func (s *tusStore) flushPart(upload *tusUpload, staging *os.File, mac *resumableMac, digests *resumableDigests) error {
+	if upload.Staged == 0 {
+		return nil
+	}
+
+	part := len(upload.Parts) + 1
+	data := io.NewSectionReader(staging, 0, upload.Staged)
+	etag, err := s.storage.UploadPart(upload.Bucket, upload.Key, upload.UploadID, part, upload.Staged, data)
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d: %w", part, err)
+	}
+
+	upload.Parts = append(upload.Parts, CompletedPart{PartNumber: part, ETag: etag, Size: upload.Staged})
+	upload.Staged = 0
+	// state is saved first, if truncating fails it will be done on the next write
+	if err := s.saveState(upload, mac, digests); err != nil {
+		return err
+	}
+	if err := staging.Truncate(0); err != nil {
+		return err
+	}
+	_, err = staging.Seek(0, io.SeekStart)
+	return err
+}
+
+// Opens staging file for appending, anything written after the state has
+// been last saved is discarded
+func (s *tusStore) openStaging(upload *tusUpload) (*os.File, error) {
+	staging, err := os.OpenFile(s.stagingPath(upload.ID), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := staging.Truncate(upload.Staged); err != nil {
+		staging.Close()
+		return nil, err
+	}
+	if _, err := staging.Seek(upload.Staged, io.SeekStart); err != nil {
+		staging.Close()
+		return nil, err
+	}
+	return staging, nil
+}
+
+func (s *tusStore) saveState(upload *tusUpload, mac *resumableMac, digests *resumableDigests) error {
+	macState, err := mac.State()
+	if err != nil {
+		return err
+	}
+	upload.MacState = macState
+	if digests != nil {
+		if upload.Digests, err = digests.State(); err != nil {
+			return err
+		}
+	}
+	return s.save(upload)
+}
+
+func (s *tusStore) restoreDigests(upload *tusUpload) (*resumableDigests, error) {
+	if upload.Digests == nil {
+		return nil, nil
+	}
+	return restoreResumableDigests(*upload.Digests)
+}
+
+func (s *tusStore) save(upload *tusUpload) error {
+	return writeJsonFile(s.statePath(upload.ID), upload)
+}
+
+func (s *tusStore) remove(id string) error {
+	os.Remove(s.stagingPath(id))
+	return os.Remove(s.statePath(id))
+}
+
+func (s *tusStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.locked[id] {
+		return false
+	}
+	s.locked[id] = true
+	return true
+}
+
+func (s *tusStore) unlock(id string) {
+	s.mu.Lock()
+	delete(s.locked, id)
+	s.mu.Unlock()
+}
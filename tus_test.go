@@ -0,0 +1,194 @@
+package minioproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"testing/iotest"
+)
+
+func newStatefulTestApp(t *testing.T, storage Storage, stateDir string, encKey, hmacKey []byte) *App {
+	app, err := New(Config{
+		ServerAddr:        ":4040",
+		BucketName:        "test",
+		EncKey:            encKey,
+		HmacKey:           hmacKey,
+		UploadChunkSizeMb: MIN_CHUNK_SIZE_MB,
+		Storage:           storage,
+		UploadStatePath:   stateDir,
+	})
+	if err != nil {
+		t.Fatal("can't create app", err)
+	}
+	return app
+}
+
+func tusRequest(app *App, method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	return w
+}
+
+func tusPatch(app *App, location string, offset int, body io.Reader) *httptest.ResponseRecorder {
+	return tusRequest(app, http.MethodPatch, location, body, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+func TestTusResumableUpload(t *testing.T) {
+	storage := newMemoryStorage()
+	stateDir := t.TempDir()
+	encKey, hmacKey := genRandBytes(32), genRandBytes(32)
+	app := newStatefulTestApp(t, storage, stateDir, encKey, hmacKey)
+	content := genRandBytes(minChunkedFileSize + 1234)
+
+	w := tusRequest(app, http.MethodPost, "/tus", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("big.dat")),
+	})
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || len(location) == 0 {
+		t.Fatal("expected upload to be created, got", w.Code, w.Body)
+	}
+
+	// first request is interrupted half way through the first part
+	interrupted := io.MultiReader(bytes.NewReader(content[:3*1024*1024]), iotest.ErrReader(errors.New("connection reset")))
+	tusPatch(app, location, 0, interrupted)
+
+	w = tusRequest(app, http.MethodHead, location, nil, nil)
+	offset, _ := strconv.Atoi(w.Header().Get("Upload-Offset"))
+	if offset != 3*1024*1024 {
+		t.Fatal("expected received data to be kept, got offset", offset)
+	}
+
+	if w := tusPatch(app, location, 0, bytes.NewReader(content)); w.Code != http.StatusConflict {
+		t.Error("expected wrong offset to be rejected, got", w.Code)
+	}
+
+	// proxy restarts
+	app = newStatefulTestApp(t, storage, stateDir, encKey, hmacKey)
+	if w := tusPatch(app, location, offset, bytes.NewReader(content[offset:10*1024*1024])); w.Code != http.StatusNoContent {
+		t.Fatal("expected upload to continue after restart, got", w.Code, w.Body)
+	}
+	if w := tusPatch(app, location, 10*1024*1024, bytes.NewReader(content[10*1024*1024:])); w.Code != http.StatusNoContent {
+		t.Fatal("expected upload to complete, got", w.Code, w.Body)
+	}
+
+	w = doRequest(app, http.MethodGet, "/files/big.dat", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Error("expected to download file uploaded with tus, got", w.Code)
+	}
+	if digest := w.Header().Get("Repr-Digest"); digest != fileDigest(string(content)) {
+		t.Error("expected digests of the file to be sealed in it, got", digest)
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `inline; filename=big.dat` {
+		t.Error("expected filename to be sealed in metadata, got", disposition)
+	}
+	if len(storage.uploads) != 0 {
+		t.Error("expected multipart upload to be completed")
+	}
+}
+
+// fails completing multipart uploads until fixed
+type failingCompleteStorage struct {
+	*memoryStorage
+	failing bool
+}
+
+func (s *failingCompleteStorage) CompleteMultipart(bucket, key, uploadID string, parts []CompletedPart, cond Precondition) (ETag, error) {
+	if s.failing {
+		return "", errors.New("complete failed")
+	}
+	return s.memoryStorage.CompleteMultipart(bucket, key, uploadID, parts, cond)
+}
+
+func TestTusRetriesCompletion(t *testing.T) {
+	storage := &failingCompleteStorage{newMemoryStorage(), true}
+	app := newStatefulTestApp(t, storage, t.TempDir(), genRandBytes(32), genRandBytes(32))
+
+	w := tusRequest(app, http.MethodPost, "/tus", nil, map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("hello.txt")),
+	})
+	location := w.Header().Get("Location")
+
+	if w := tusPatch(app, location, 0, bytes.NewReader([]byte("hello world"))); w.Code == http.StatusNoContent {
+		t.Fatal("expected failed completion to be reported")
+	}
+	if w := tusRequest(app, http.MethodHead, location, nil, nil); w.Code == http.StatusOK {
+		t.Error("expected HEAD not to report a failed upload as finished")
+	}
+
+	storage.failing = false
+	w = tusRequest(app, http.MethodHead, location, nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "11" {
+		t.Fatal("expected HEAD to complete the upload, got", w.Code, w.Body)
+	}
+	if w := doRequest(app, http.MethodGet, "/files/hello.txt", nil); w.Body.String() != "hello world" {
+		t.Error("expected completed upload to be downloadable, got", w.Code, w.Body)
+	}
+}
+
+func TestTusTermination(t *testing.T) {
+	storage := newMemoryStorage()
+	app := newStatefulTestApp(t, storage, t.TempDir(), genRandBytes(32), genRandBytes(32))
+
+	w := tusRequest(app, http.MethodPost, "/tus", nil, map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("hello.txt")),
+	})
+	location := w.Header().Get("Location")
+
+	if w := tusRequest(app, http.MethodDelete, location, nil, nil); w.Code != http.StatusNoContent {
+		t.Error("expected upload to be terminated, got", w.Code, w.Body)
+	}
+	if w := tusRequest(app, http.MethodHead, location, nil, nil); w.Code != http.StatusNotFound {
+		t.Error("expected terminated upload to be gone, got", w.Code)
+	}
+	if len(storage.uploads) != 0 {
+		t.Error("expected multipart upload to be aborted")
+	}
+}
+
+func TestTusVersionRequired(t *testing.T) {
+	app := newStatefulTestApp(t, newMemoryStorage(), t.TempDir(), genRandBytes(32), genRandBytes(32))
+
+	if w := doRequest(app, http.MethodPost, "/tus", nil); w.Code != http.StatusPreconditionFailed {
+		t.Error("expected request without Tus-Resumable to be rejected, got", w.Code)
+	}
+}
+
+func TestTusCreateOnly(t *testing.T) {
+	app := newStatefulTestApp(t, newMemoryStorage(), t.TempDir(), genRandBytes(32), genRandBytes(32))
+	app.createOnly = true
+
+	var locations []string
+	for i := 0; i < 2; i++ {
+		w := tusRequest(app, http.MethodPost, "/tus", nil, map[string]string{
+			"Upload-Length":   "5",
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("race.txt")),
+		})
+		locations = append(locations, w.Header().Get("Location"))
+	}
+
+	if w := tusPatch(app, locations[0], 0, bytes.NewReader([]byte("first"))); w.Code != http.StatusNoContent {
+		t.Fatal("upload failed", w.Code, w.Body)
+	}
+	if w := tusPatch(app, locations[1], 0, bytes.NewReader([]byte("later"))); w.Code != http.StatusConflict {
+		t.Error("expected upload started before the file existed not to replace it, got", w.Code)
+	}
+	if w := doRequest(app, http.MethodGet, "/files/race.txt", nil); w.Body.String() != "first" {
+		t.Error("unexpected content", w.Body)
+	}
+}
@@ -0,0 +1,369 @@
+package minioproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+type chunk struct {
+	Part int
+	Data []byte
+	Size int64
+}
+
+type partResult struct {
+	Part CompletedPart
+	Err  error
+}
+
+type readResult struct {
+	Chunks int
+	Err    error
+}
+
+// Uploads files to storage, shared by all requests so memory and number of
+// parallel part uploads can be limited across all of them
+type uploader struct {
+	storage   Storage
+	buffers   *bufferPool
+	scheduler *partScheduler
+	// optional, records multipart uploads so they can be cleaned up after a crash
+	journal *uploadJournal
+}
+
+type multipartUpload struct {
+	Bucket        string
+	Filename      string
+	ContentType   string
+	Metadata      map[string]string
+	Precondition  Precondition
+	ContentLength int64
+	ChunkSize     int64
+	Chunks        int
+
+	uploader *uploader
+	uploadID string
+	// first part when it was read to find out if the file needs more, see
+	// uploadStream
+	first []byte
+}
+
+var errUploadAlreadyStarted = errors.New("upload already started")
+var errFileTooLarge = errors.New("file is too large")
+
+// S3 limits for multipart uploads
+const minPartSize = MIN_CHUNK_SIZE_MB * 1024 * 1024
+const maxPartSize = maxChunkedFileSizeMB * 1024 * 1024
+const maxParts = 10_000
+const maxFileSize = maxParts * maxPartSize
+
+const defaultUploadWorkers = 16
+const defaultUploadMemoryLimitMB = 512
+
+// parts of a single upload that can be read ahead while waiting for workers
+const maxQueuedParts = 4
+
+func newUploader(storage Storage, workers int, memoryLimit int64) *uploader {
+	return &uploader{
+		storage:   storage,
+		buffers:   newBufferPool(memoryLimit),
+		scheduler: newPartScheduler(workers),
+	}
+}
+
+// Uploader writing to another storage, sharing memory and workers with u.
+// Its uploads aren't journaled, they'd be cleaned up in the wrong storage.
+func (u *uploader) withStorage(storage Storage) *uploader {
+	return &uploader{storage: storage, buffers: u.buffers, scheduler: u.scheduler}
+}
+
+// Uploads a file in one go or, if it's large enough, in chunks of about
+// chunkSize. See partSizeFor.
+func (u *uploader) Upload(bucket, filename, contentType string, metadata map[string]string, cond Precondition, contentLength, chunkSize int64, input io.Reader) (ETag, error) {
+	if contentLength < 0 {
+		return u.uploadStream(bucket, filename, contentType, metadata, cond, chunkSize, input)
+	}
+
+	partSize, err := partSizeFor(contentLength, chunkSize, u.buffers.Limit())
+	if err != nil {
+		return "", err
+	}
+
+	chunks := chunksForFile(contentLength, partSize)
+	if chunks <= 1 {
+		// NOTE if input is coming from encryptStream, data will be still written
+		// to the request's body in blocks of ENC_BUFFER_SIZE
+		return u.storage.Put(bucket, filename, contentType, metadata, cond, contentLength, input)
+	}
+
+	mu := multipartUpload{
+		uploader:      u,
+		Bucket:        bucket,
+		Filename:      filename,
+		ContentType:   contentType,
+		Metadata:      metadata,
+		Precondition:  cond,
+		ContentLength: contentLength,
+		ChunkSize:     partSize,
+		Chunks:        chunks,
+	}
+	return mu.Upload(input)
+}
+
+// Uploads input of unknown length. Files which fit in a single part are
+// uploaded in one go, others in parts of chunkSize, up to maxParts of them.
+func (u *uploader) uploadStream(bucket, filename, contentType string, metadata map[string]string, cond Precondition, chunkSize int64, input io.Reader) (ETag, error) {
+	partSize := min(max(chunkSize, minPartSize), maxPartSize, u.buffers.Limit())
+
+	first := u.buffers.Get(partSize)
+	n, err := io.ReadFull(input, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		defer u.buffers.Put(first)
+		return u.storage.Put(bucket, filename, contentType, metadata, cond, int64(n), bytes.NewReader(first[:n]))
+	}
+	if err != nil {
+		u.buffers.Put(first)
+		return "", err
+	}
+
+	mu := multipartUpload{
+		uploader:      u,
+		Bucket:        bucket,
+		Filename:      filename,
+		ContentType:   contentType,
+		Metadata:      metadata,
+		Precondition:  cond,
+		ContentLength: -1,
+		ChunkSize:     partSize,
+		Chunks:        maxParts,
+		first:         first,
+	}
+	return mu.Upload(input)
+}
+
+// Preferred chunkSize is used as long as the file fits in maxParts, otherwise
+// parts are made larger, up to maxPartSize or maxSize when it's smaller, which
+// limits the size of files too. Files smaller than minChunkedFileSize and files
+// which can be uploaded in one request when chunking is disabled get 0.
+func partSizeFor(contentLength, chunkSize, maxSize int64) (int64, error) {
+	maxSize = min(maxSize, maxPartSize)
+	if limit := maxParts * maxSize; contentLength > limit {
+		return 0, fmt.Errorf("%w, max size is %d bytes", errFileTooLarge, limit)
+	}
+	if contentLength < minChunkedFileSize || (chunkSize < 1 && contentLength <= maxPartSize) {
+		return 0, nil
+	}
+
+	partSize := max(chunkSize, minPartSize)
+	if minSize := ceilDiv(contentLength, maxParts); partSize < minSize {
+		// rounded up to whole MBs to keep parts readable in logs
+		partSize = ceilDiv(minSize, 1024*1024) * 1024 * 1024
+	}
+
+	return min(partSize, maxSize), nil
+}
+
+func chunksForFile(contentLength, partSize int64) int {
+	if partSize < 1 {
+		return 1
+	}
+
+	return int(max(ceilDiv(contentLength, partSize), 1))
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func (m *multipartUpload) Upload(input io.Reader) (ETag, error) {
+	if len(m.uploadID) != 0 {
+		return "", errUploadAlreadyStarted
+	}
+
+	if m.ContentLength < 0 {
+		log.Printf("uploading %s of unknown size in chunks of %d MB\n", m.Filename, m.ChunkSize/1024/1024)
+	} else {
+		log.Printf("uploading %s of %d MB in %d chunks of %d MB\n",
+			m.Filename, m.ContentLength/1024/1024,
+			m.Chunks, m.ChunkSize/1024/1024,
+		)
+	}
+
+	uploadID, err := m.uploader.storage.InitiateMultipart(m.Bucket, m.Filename, m.ContentType, m.Metadata)
+	if err != nil {
+		if m.first != nil {
+			m.uploader.buffers.Put(m.first)
+		}
+		return "", errors.Join(errors.New("failed to initiate upload"), err)
+	}
+	m.uploadID = uploadID
+	m.journalBegin()
+
+	// buffered so jobs never block once Upload has returned
+	results := make(chan partResult, m.Chunks)
+	read := make(chan readResult, 1)
+	// closed when Upload returns to release the reader and queued jobs
+	done := make(chan struct{})
+	defer close(done)
+
+	go m.read(input, results, read, done)
+
+	allCompletedParts, err := m.collectCompletitions(results, read)
+	if err != nil {
+		m.abort()
+		return "", err
+	}
+
+	etag, err := m.uploader.storage.CompleteMultipart(m.Bucket, m.Filename, m.uploadID, allCompletedParts, m.Precondition)
+	if err != nil {
+		m.abort()
+		return "", err
+	}
+
+	m.journalEnd()
+	return etag, nil
+}
+
+// Reads the input into pooled buffers and queues them for upload. Reading
+// blocks while the upload has maxQueuedParts waiting or the memory limit is
+// reached.
+func (m *multipartUpload) read(input io.Reader, results chan<- partResult, result chan<- readResult, done <-chan struct{}) {
+	queue := &partQueue{}
+	slots := make(chan struct{}, maxQueuedParts)
+
+	for i := 0; i < m.Chunks; i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-done:
+			return
+		}
+
+		var data []byte
+		var n int
+		var err error
+		if i == 0 && m.first != nil {
+			data, n = m.first, len(m.first)
+		} else {
+			data = m.uploader.buffers.Get(m.ChunkSize)
+			n, err = io.ReadFull(input, data)
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			m.uploader.buffers.Put(data)
+			result <- readResult{Err: errors.Join(errors.New("error while reading encrypted input"), err)}
+			return
+		}
+
+		if n == 0 {
+			m.uploader.buffers.Put(data)
+			result <- readResult{Chunks: i}
+			return
+		}
+
+		job := chunk{i + 1, data[:n], int64(n)}
+		m.uploader.scheduler.Submit(queue, func() {
+			defer func() { <-slots }()
+
+			select {
+			case <-done:
+				// upload has failed, just release the buffer
+				m.uploader.buffers.Put(job.Data)
+			default:
+				results <- m.uploadChunk(job)
+			}
+		})
+
+		if err != nil {
+			result <- readResult{Chunks: i + 1}
+			return
+		}
+	}
+
+	// files of unknown length can't have more than maxParts
+	if m.ContentLength < 0 {
+		var probe [1]byte
+		if n, _ := input.Read(probe[:]); n > 0 {
+			result <- readResult{Err: fmt.Errorf("%w, max size is %d bytes", errFileTooLarge, int64(m.Chunks)*m.ChunkSize)}
+			return
+		}
+	}
+	result <- readResult{Chunks: m.Chunks}
+}
+
+func (m *multipartUpload) uploadChunk(job chunk) partResult {
+	defer m.uploader.buffers.Put(job.Data)
+
+	etag, err := m.uploader.storage.UploadPart(m.Bucket, m.Filename, m.uploadID, job.Part, job.Size, bytes.NewReader(job.Data))
+	if err == nil {
+		log.Println("upload", m.uploadID, "chunk", job.Part, "✔︎")
+		m.journalPart(CompletedPart{PartNumber: job.Part, ETag: etag, Size: job.Size})
+	} else {
+		log.Println("upload", m.uploadID, "chunk", job.Part, "X", err)
+		err = fmt.Errorf("failed to upload chunk %d: %w", job.Part, err)
+	}
+
+	return partResult{CompletedPart{PartNumber: job.Part, ETag: etag, Size: job.Size}, err}
+}
+
+func (m *multipartUpload) collectCompletitions(results <-chan partResult, read <-chan readResult) ([]CompletedPart, error) {
+	all := make([]CompletedPart, 0, m.Chunks)
+	// unknown until the whole input has been read
+	total := -1
+
+	for total < 0 || len(all) < total {
+		select {
+		case res := <-results:
+			if res.Err == nil && len(res.Part.ETag) == 0 {
+				res.Err = fmt.Errorf("failed to upload chunk %d", res.Part.PartNumber)
+			}
+			if res.Err != nil {
+				return nil, res.Err
+			}
+			all = append(all, res.Part)
+		case res := <-read:
+			if res.Err != nil {
+				return nil, res.Err
+			}
+			total = res.Chunks
+		}
+	}
+
+	sortParts(all)
+	return all, nil
+}
+
+func (m *multipartUpload) abort() {
+	if err := m.uploader.storage.AbortMultipart(m.Bucket, m.Filename, m.uploadID); err != nil {
+		// left in the journal to be cleaned up on the next start
+		log.Println("failed to abort upload", m.uploadID, err)
+		return
+	}
+	m.journalEnd()
+}
+
+// Journal failures are only logged, they don't affect the upload itself
+func (m *multipartUpload) journalBegin() {
+	if j := m.uploader.journal; j != nil {
+		if err := j.Begin(m.Bucket, m.Filename, m.uploadID, m.ContentType, m.ChunkSize); err != nil {
+			log.Println("failed to journal upload", m.uploadID, err)
+		}
+	}
+}
+
+func (m *multipartUpload) journalPart(part CompletedPart) {
+	if j := m.uploader.journal; j != nil {
+		if err := j.Part(m.uploadID, part); err != nil {
+			log.Println("failed to journal upload", m.uploadID, err)
+		}
+	}
+}
+
+func (m *multipartUpload) journalEnd() {
+	if j := m.uploader.journal; j != nil {
+		if err := j.End(m.uploadID); err != nil {
+			log.Println("failed to journal upload", m.uploadID, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package minioproxy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Hands out part buffers to multipart uploads while keeping the total size of
+// buffers in use under a limit shared by all uploads. Get blocks until enough
+// memory is released by other uploads, which in turn slows down reading of
+// request bodies.
+type bufferPool struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	inUse int64
+	// one pool per buffer size, in practice there is only one or two sizes in use
+	pools map[int64]*sync.Pool
+}
+
+func newBufferPool(limit int64) *bufferPool {
+	p := &bufferPool{
+		limit: limit,
+		pools: make(map[int64]*sync.Pool),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// size can't be larger than the limit, see Limit
+func (p *bufferPool) Get(size int64) []byte {
+	if size > p.limit {
+		panic(fmt.Sprintf("buffer of %d bytes is larger than the memory limit of %d bytes", size, p.limit))
+	}
+
+	p.mu.Lock()
+	for p.inUse+size > p.limit {
+		p.cond.Wait()
+	}
+	p.inUse += size
+
+	pool, exists := p.pools[size]
+	if !exists {
+		pool = &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		p.pools[size] = pool
+	}
+	p.mu.Unlock()
+
+	return *pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	size := int64(cap(buf))
+	buf = buf[:size]
+
+	p.mu.Lock()
+	p.pools[size].Put(&buf)
+	p.inUse -= size
+	p.mu.Unlock()
+
+	p.cond.Broadcast()
+}
+
+// Largest buffer that can be taken from the pool
+func (p *bufferPool) Limit() int64 {
+	return p.limit
+}
+
+func (p *bufferPool) InUse() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inUse
+}
@@ -0,0 +1,90 @@
+package minioproxy
+
+import (
+	"sync"
+)
+
+// Process-wide pool of part upload workers. Parts are queued per upload and
+// workers take them from uploads in a round robin fashion so a file with
+// many parts can't starve smaller ones.
+type partScheduler struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// uploads with queued parts, in the order they will be served
+	ring    []*partQueue
+	queued  int
+	active  int
+	workers int
+}
+
+type partQueue struct {
+	jobs []func()
+}
+
+type schedulerStats struct {
+	Workers       int `json:"workers"`
+	QueuedParts   int `json:"queuedParts"`
+	ActiveParts   int `json:"activeParts"`
+	QueuedUploads int `json:"queuedUploads"`
+}
+
+func newPartScheduler(workers int) *partScheduler {
+	s := &partScheduler{workers: workers}
+	s.cond = sync.NewCond(&s.mu)
+
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+func (s *partScheduler) Submit(q *partQueue, job func()) {
+	s.mu.Lock()
+	if len(q.jobs) == 0 {
+		s.ring = append(s.ring, q)
+	}
+	q.jobs = append(q.jobs, job)
+	s.queued++
+	s.mu.Unlock()
+
+	s.cond.Signal()
+}
+
+func (s *partScheduler) Stats() schedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return schedulerStats{
+		Workers:       s.workers,
+		QueuedParts:   s.queued,
+		ActiveParts:   s.active,
+		QueuedUploads: len(s.ring),
+	}
+}
+
+func (s *partScheduler) worker() {
+	for {
+		s.mu.Lock()
+		for len(s.ring) == 0 {
+			s.cond.Wait()
+		}
+
+		q := s.ring[0]
+		s.ring = s.ring[1:]
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		// uploads with more parts go to the back of the line
+		if len(q.jobs) > 0 {
+			s.ring = append(s.ring, q)
+		}
+		s.queued--
+		s.active++
+		s.mu.Unlock()
+
+		job()
+
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}
+}
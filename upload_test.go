@@ -0,0 +1,199 @@
+package minioproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// fails every upload of the given part
+type failingPartStorage struct {
+	*memoryStorage
+	failPart int
+}
+
+func (s *failingPartStorage) UploadPart(bucket, key, uploadID string, part int, size int64, input io.Reader) (ETag, error) {
+	if part == s.failPart {
+		return "", errors.New("part upload failed")
+	}
+	return s.memoryStorage.UploadPart(bucket, key, uploadID, part, size, input)
+}
+
+func TestBufferPoolLimit(t *testing.T) {
+	pool := newBufferPool(10)
+	a := pool.Get(6)
+
+	acquired := make(chan []byte)
+	go func() { acquired <- pool.Get(6) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected Get to block while over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pool.Put(a)
+	b := <-acquired
+	if len(b) != 6 || pool.InUse() != 6 {
+		t.Error("expected released memory to be reused, in use", pool.InUse())
+	}
+	pool.Put(b)
+
+	if pool.InUse() != 0 {
+		t.Error("expected all memory to be released, in use", pool.InUse())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected buffers over the limit not to be handed out")
+		}
+	}()
+	pool.Get(20)
+}
+
+func TestMultipartUploadWithinMemoryLimit(t *testing.T) {
+	storage := newMemoryStorage()
+	chunkSize := int64(MIN_CHUNK_SIZE_MB * 1024 * 1024)
+	u := newUploader(storage, 8, 2*chunkSize)
+	content := genRandBytes(minChunkedFileSize + 44)
+
+	etag, err := u.Upload("bucket", "rand.dat", "text/plain", nil, Precondition{}, int64(len(content)), chunkSize, bytes.NewReader(content))
+	if err != nil || len(etag) == 0 {
+		t.Fatal("upload failed", err)
+	}
+	if u.buffers.InUse() != 0 {
+		t.Error("expected all buffers to be released, in use", u.buffers.InUse())
+	}
+
+	file, _ := storage.Get("bucket", "rand.dat")
+	downloaded, _ := io.ReadAll(file.Data)
+	if !bytes.Equal(content, downloaded) {
+		t.Error("downloaded data is not same as uploaded")
+	}
+}
+
+func TestMultipartUploadFailure(t *testing.T) {
+	storage := &failingPartStorage{newMemoryStorage(), 2}
+	chunkSize := int64(MIN_CHUNK_SIZE_MB * 1024 * 1024)
+	u := newUploader(storage, 2, 2*chunkSize)
+	content := genRandBytes(minChunkedFileSize + 44)
+
+	if _, err := u.Upload("bucket", "rand.dat", "text/plain", nil, Precondition{}, int64(len(content)), chunkSize, bytes.NewReader(content)); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+
+	// workers release their buffers asynchronously
+	for i := 0; i < 100 && u.buffers.InUse() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if u.buffers.InUse() != 0 {
+		t.Error("expected all buffers to be released after a failure, in use", u.buffers.InUse())
+	}
+	if len(storage.uploads) != 0 {
+		t.Error("expected failed upload to be aborted")
+	}
+}
+
+func TestPartSchedulerFairness(t *testing.T) {
+	s := newPartScheduler(1)
+	blocker, started := make(chan struct{}), make(chan struct{})
+	s.Submit(&partQueue{}, func() {
+		close(started)
+		<-blocker
+	})
+	<-started
+
+	order := make(chan string, 4)
+	large, small := &partQueue{}, &partQueue{}
+	for _, name := range []string{"large-1", "large-2", "large-3"} {
+		name := name
+		s.Submit(large, func() { order <- name })
+	}
+	s.Submit(small, func() { order <- "small-1" })
+
+	if stats := s.Stats(); stats.QueuedParts != 4 || stats.QueuedUploads != 2 || stats.ActiveParts != 1 {
+		t.Error("unexpected scheduler stats", stats)
+	}
+	close(blocker)
+
+	expected := []string{"large-1", "small-1", "large-2", "large-3"}
+	for _, name := range expected {
+		if got := <-order; got != name {
+			t.Error("expected", name, "to be uploaded next, got", got)
+		}
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	const mb = 1024 * 1024
+	cases := []struct {
+		contentLength int64
+		chunkSize     int64
+		maxSize       int64
+		expected      int64
+	}{
+		{contentLength: 10 * mb, chunkSize: 5 * mb, expected: 0},
+		{contentLength: 100 * mb, chunkSize: -1, expected: 0},
+		{contentLength: 100 * mb, chunkSize: 5 * mb, expected: 5 * mb},
+		// too small chunks are raised to S3 minimum
+		{contentLength: 100 * mb, chunkSize: 3 * mb, expected: 5 * mb},
+		// 2 TB file won't fit in 10 000 parts of 100 MB
+		{contentLength: 2 * 1024 * 1024 * mb, chunkSize: 100 * mb, expected: 210 * mb},
+		// files over 5 GB can't be uploaded in one go even with chunking disabled
+		{contentLength: 6 * 1024 * mb, chunkSize: -1, expected: 5 * mb},
+		{contentLength: maxFileSize, chunkSize: 5 * mb, expected: maxPartSize},
+		// parts larger than the memory limit aren't buffered
+		{contentLength: 2 * 1024 * 1024 * mb, chunkSize: 100 * mb, maxSize: 512 * mb, expected: 210 * mb},
+		// rounding up to whole MBs stays within the limit
+		{contentLength: maxParts * (10*mb + 1), chunkSize: 5 * mb, maxSize: 10*mb + 1, expected: 10*mb + 1},
+	}
+
+	for _, c := range cases {
+		if c.maxSize == 0 {
+			c.maxSize = maxPartSize
+		}
+		partSize, err := partSizeFor(c.contentLength, c.chunkSize, c.maxSize)
+		if err != nil || partSize != c.expected {
+			t.Error("expected part size", c.expected, "for", c.contentLength, "got", partSize, err)
+		}
+		if partSize > 0 && chunksForFile(c.contentLength, partSize) > maxParts {
+			t.Error("expected at most", maxParts, "parts for", c.contentLength)
+		}
+	}
+
+	if _, err := partSizeFor(maxFileSize+1, 5*mb, maxPartSize); !errors.Is(err, errFileTooLarge) {
+		t.Error("expected files over", maxFileSize, "to be rejected, got", err)
+	}
+	if _, err := partSizeFor(maxParts*10*mb+1, 5*mb, 10*mb); !errors.Is(err, errFileTooLarge) {
+		t.Error("expected files which don't fit in parts within the memory limit to be rejected, got", err)
+	}
+}
+
+func TestUploadOfUnknownLength(t *testing.T) {
+	storage := newMemoryStorage()
+	chunkSize := int64(MIN_CHUNK_SIZE_MB * 1024 * 1024)
+	u := newUploader(storage, 2, 2*chunkSize)
+
+	for _, size := range []int{44, int(chunkSize), 2*int(chunkSize) + 44} {
+		content := genRandBytes(size)
+		// hides the length of the content
+		input := io.MultiReader(bytes.NewReader(content))
+		if _, err := u.Upload("bucket", "rand.dat", "text/plain", nil, Precondition{}, -1, chunkSize, input); err != nil {
+			t.Fatal("upload failed", size, err)
+		}
+
+		file, _ := storage.Get("bucket", "rand.dat")
+		downloaded, _ := io.ReadAll(file.Data)
+		if !bytes.Equal(content, downloaded) {
+			t.Error("downloaded data is not same as uploaded", size)
+		}
+	}
+	if u.buffers.InUse() != 0 {
+		t.Error("expected all buffers to be released, in use", u.buffers.InUse())
+	}
+	if len(storage.uploads) != 0 {
+		t.Error("expected all multipart uploads to be completed")
+	}
+}